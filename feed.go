@@ -0,0 +1,533 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/url"
+	"nicovideoRSSDIY/internal/config"
+	"nicovideoRSSDIY/internal/filter"
+	"nicovideoRSSDIY/internal/repository"
+	"nicovideoRSSDIY/internal/rss"
+	"nicovideoRSSDIY/internal/thumbnail"
+	"slices"
+	"time"
+)
+
+// feed 配信するフィード1つ分の動画とRSSを保持する
+// nameが空のものは全クエリの結果を混ぜた統合フィード(/)である
+type feed struct {
+	name    string
+	queries map[string]struct{} // config.SearchQuery.Key()
+	vRepo   *repository.VideoRepository
+	rRepo   *repository.RSSRepository // RSS 2.0
+	aRepo   *repository.RSSRepository // Atom 1.0
+	jRepo   *repository.RSSRepository // JSON Feed 1.1
+	opts    rss.Options
+}
+
+func newFeed(name string, queries []config.SearchQuery, retention config.Retention) *feed {
+	keys := make(map[string]struct{}, len(queries))
+	for _, q := range queries {
+		keys[q.Key()] = struct{}{}
+	}
+	vRepo := repository.NewVideoRepository(retention.MaxItems)
+	vRepo.SetQuotas(queryQuotas(queries))
+	vRepo.SetRetention(repoRetention(retention))
+	return &feed{
+		name:    name,
+		queries: keys,
+		vRepo:   vRepo,
+		rRepo:   repository.NewRSSRepository(),
+		aRepo:   repository.NewRSSRepository(),
+		jRepo:   repository.NewRSSRepository(),
+		opts:    feedOptions(name),
+	}
+}
+
+// reconfigured 動画とフィードの保持先を引き継ぎ、クエリと残す動画の指定を差し替えたフィードを返す
+// このフィードから外れたクエリだけから来た動画は削除される。取得元が不明な動画(起動中表示など)は残す
+func (f *feed) reconfigured(queries []config.SearchQuery, retention config.Retention) *feed {
+	next := newFeed(f.name, queries, retention)
+	next.vRepo = f.vRepo
+	next.rRepo = f.rRepo
+	next.aRepo = f.aRepo
+	next.jRepo = f.jRepo
+	next.opts = f.opts
+
+	removed := next.vRepo.RemoveVideos(func(v *repository.Video) bool {
+		return len(v.Sources) > 0 && !v.HasSourceIn(next.queries)
+	})
+	removed += next.vRepo.SetQuotas(queryQuotas(queries))
+	removed += next.vRepo.SetRetention(repoRetention(retention))
+	if removed > 0 {
+		slog.Info(fmt.Sprintf("フィード%qから動画を%d件削除しました", f.name, removed))
+	}
+	return next
+}
+
+// repoRetention 設定の残す動画の指定をVideoRepositoryの形にする
+func repoRetention(r config.Retention) repository.Retention {
+	return repository.Retention{Capacity: r.MaxItems, MaxAge: r.MaxAge(), MinItems: r.MinItems}
+}
+
+// seed 統合フィードの動画のうち、このフィードのクエリから来たものを載せる。新しく追加されたフィードに使う
+func (f *feed) seed(merged *feed) {
+	videos := make([]*repository.Video, 0)
+	for _, v := range merged.vRepo.Videos() {
+		if v.HasSourceIn(f.queries) {
+			videos = append(videos, v)
+		}
+	}
+	f.vRepo.AddSortedVideos(videos)
+}
+
+// queryQuotas 検索クエリごとの件数の指定(minItems・maxItems)を返す。同じキーのクエリが複数ある場合は先にあるものを使う
+func queryQuotas(queries []config.SearchQuery) map[string]repository.Quota {
+	seen := make(map[string]struct{}, len(queries))
+	quotas := make(map[string]repository.Quota)
+	for _, q := range queries {
+		if _, exists := seen[q.Key()]; exists {
+			continue
+		}
+		seen[q.Key()] = struct{}{}
+		if q.MinItems > 0 || q.MaxItems > 0 {
+			quotas[q.Key()] = repository.Quota{Min: q.MinItems, Max: q.MaxItems}
+		}
+	}
+	return quotas
+}
+
+// includes クエリの検索結果をこのフィードに載せるかを返す
+func (f *feed) includes(q config.SearchQuery) bool {
+	_, ok := f.queries[q.Key()]
+	return ok
+}
+
+// feedOptions フィード名からRSS生成時のチャンネル情報を決める
+func feedOptions(name string) rss.Options {
+	if name == "" {
+		return rss.Options{}
+	}
+	return rss.Options{
+		ID:    "urn:nicovideo-rss-diy:feeds:" + name,
+		Title: fmt.Sprintf("Nicovideo RSS DIY - %s", name),
+	}
+}
+
+// newNoticeFeed 通知のみを載せるフィード(/notifications)を作る
+func newNoticeFeed() *feed {
+	f := newFeed("notifications", nil, config.Retention{})
+	f.opts = rss.Options{
+		ID:          "urn:nicovideo-rss-diy:notifications",
+		Title:       "Nicovideo RSS DIY - 通知",
+		Description: "ニコニコ動画新着RSS(自作)の動作状況の通知",
+	}
+	return f
+}
+
+// repo 形式に対応するフィードの保持先を返す
+func (f *feed) repo(format feedFormat) *repository.RSSRepository {
+	switch format {
+	case formatAtom:
+		return f.aRepo
+	case formatJSON:
+		return f.jRepo
+	default:
+		return f.rRepo
+	}
+}
+
+// publish 現在の動画と通知から各形式のフィードを生成し保持する。thumbnailURLがnilの場合はサムネイルのURLをそのまま載せる
+// thumbnailVariantsがnilでなければ、RSSに大きさ違いのサムネイルも載せる
+func (f *feed) publish(notifications []repository.Notification, thumbnailURL func(v *repository.Video) string, thumbnailVariants func(v *repository.Video) []rss.MediaThumbnail) error {
+	opts := f.opts
+	opts.ThumbnailURL = thumbnailURL
+	opts.ThumbnailVariants = thumbnailVariants
+	videos := f.vRepo.Videos()
+	rssBytes, err := rss.GenerateRSS(notifications, videos, opts)
+	if err != nil {
+		return err
+	}
+	atomBytes, err := rss.GenerateAtom(notifications, videos, opts)
+	if err != nil {
+		return err
+	}
+	jsonBytes, err := rss.GenerateJSONFeed(notifications, videos, opts)
+	if err != nil {
+		return err
+	}
+	f.rRepo.SetFeed(rssBytes)
+	f.aRepo.SetFeed(atomBytes)
+	f.jRepo.SetFeed(jsonBytes)
+	return nil
+}
+
+// feedSet 統合フィードと名前付きフィードの一覧
+type feedSet struct {
+	merged  *feed
+	notices *feed // 通知のみのフィード。動画は持たない
+	named   map[string]*feed
+	order   []*feed                  // 統合フィードを先頭に、設定順
+	queries []config.SearchQuery     // 全フィードの検索クエリ(重複なし)
+	marks   map[string]time.Time     // config.SearchQuery.Key() -> 取り込み済みの最新の投稿日時
+	exclude map[string]*filter.Rules // config.SearchQuery.Key() -> 取得後に除外する条件
+
+	thumbs       *repository.ThumbnailCache // サムネイルのキャッシュ。無効の場合はnil
+	thumbBaseURL string                     // 空でなければキャッシュ済みのサムネイルをこのURLの/thumb/{contentId}として載せる
+}
+
+func newFeedSet(cfg *config.Config) *feedSet {
+	queries := cfg.AllSearchQueries()
+	merged := newFeed("", queries, cfg.Retention)
+
+	s := &feedSet{
+		merged:  merged,
+		notices: newNoticeFeed(),
+		named:   make(map[string]*feed, len(cfg.Feeds)),
+		order:   []*feed{merged},
+		queries: queries,
+		marks:   make(map[string]time.Time, len(queries)),
+		exclude: excludeRules(cfg, queries),
+	}
+	for _, fc := range cfg.Feeds {
+		f := newFeed(fc.Name, fc.SearchQueries, fc.Retention)
+		s.named[fc.Name] = f
+		s.order = append(s.order, f)
+	}
+	return s
+}
+
+// reconfigure 新しい設定に合わせたフィード一覧を返す。同名のフィード(統合フィードを含む)は動画を引き継ぐ
+// 新しく追加されたフィードには、既に統合フィードにある動画のうちそのフィードのクエリから来たものを載せる
+// 受け取ったfeedSet自体は変更しないため、差し替えるまでの間HTTPハンドラから参照されていても問題ない
+func (s *feedSet) reconfigure(cfg *config.Config) *feedSet {
+	queries := cfg.AllSearchQueries()
+	// 動画の保持先は引き継ぐため、差し替える前の指定を控えておく
+	previous := make(map[string]repository.Retention, len(s.order))
+	for _, f := range s.order {
+		previous[f.name] = f.vRepo.Retention()
+	}
+	merged := s.merged.reconfigured(queries, cfg.Retention)
+
+	next := &feedSet{
+		merged:  merged,
+		notices: s.notices,
+		named:   make(map[string]*feed, len(cfg.Feeds)),
+		order:   []*feed{merged},
+		queries: queries,
+		marks:   make(map[string]time.Time, len(queries)),
+		exclude: excludeRules(cfg, queries),
+
+		thumbs:       s.thumbs,
+		thumbBaseURL: s.thumbBaseURL,
+	}
+	for _, fc := range cfg.Feeds {
+		var f *feed
+		if old, ok := s.named[fc.Name]; ok {
+			f = old.reconfigured(fc.SearchQueries, fc.Retention)
+		} else {
+			f = newFeed(fc.Name, fc.SearchQueries, fc.Retention)
+			f.seed(merged)
+		}
+		next.named[fc.Name] = f
+		next.order = append(next.order, f)
+	}
+	// 検索クエリが変わらなければ続きから検索する。新しいフィードや残す範囲が広がったフィードのクエリは遡って検索し直す
+	next.restoreMarks(s.marks, previous)
+
+	// 全体の条件・ブロックリストの変更はクエリのキーを変えないため、取り込み済みの動画にも新しい条件を当てはめる
+	for _, f := range next.order {
+		if removed := f.vRepo.RemoveVideos(next.excluded); removed > 0 {
+			slog.Info(fmt.Sprintf("フィード%qから除外の条件に当てはまる動画を%d件削除しました", f.name, removed))
+		}
+	}
+	return next
+}
+
+// excludeRules 検索クエリごとの除外の条件を作成する
+func excludeRules(cfg *config.Config, queries []config.SearchQuery) map[string]*filter.Rules {
+	rules := make(map[string]*filter.Rules, len(queries))
+	for _, q := range queries {
+		if r := cfg.ExcludeRules(q); !r.Empty() {
+			rules[q.Key()] = r
+		}
+	}
+	return rules
+}
+
+// excludeRulesFor 検索クエリの結果に使う除外の条件を返す。条件が無い場合はnil
+func (s *feedSet) excludeRulesFor(q config.SearchQuery) *filter.Rules {
+	return s.exclude[q.Key()]
+}
+
+// excluded 動画が、取得元の全ての検索クエリの除外の条件に当てはまるかを返す。取得元が不明な動画(起動中表示など)は除外しない
+func (s *feedSet) excluded(v *repository.Video) bool {
+	if len(v.Sources) == 0 {
+		return false
+	}
+	for _, key := range v.Sources {
+		if _, ok := s.exclude[key].Excludes(v); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// publish 全フィードを生成し直す。動画のフィードにはRouteFeedの通知のみ、通知フィードには保持している全ての通知を載せる
+func (s *feedSet) publish(nRepo *repository.NotificationRepository) error {
+	feedNotifications := nRepo.FeedNotifications()
+	for _, f := range s.order {
+		if err := f.publish(feedNotifications, s.thumbnailURL, s.thumbnailVariants); err != nil {
+			return err
+		}
+	}
+	return s.notices.publish(nRepo.Notifications(), nil, nil)
+}
+
+// thumbnailURL フィードに載せるサムネイルのURLを返す。キャッシュ済みで公開URLが設定されていればキャッシュを指す
+func (s *feedSet) thumbnailURL(v *repository.Video) string {
+	if s.thumbs == nil || s.thumbBaseURL == "" || !s.thumbs.Has(v.ID) {
+		return v.ThumbnailURL
+	}
+	return s.thumbBaseURL + "/thumb/" + url.PathEscape(v.ID)
+}
+
+// thumbnailVariants フィードに載せる大きさ違いのサムネイル(/thumb/{contentId}.Mなど)を幅の小さい順に返す
+// 元の画像がキャッシュ済みで公開URLが設定されている場合のみ。幅と高さは一度配信して分かったもののみ載せる
+func (s *feedSet) thumbnailVariants(v *repository.Video) []rss.MediaThumbnail {
+	if s.thumbs == nil || s.thumbBaseURL == "" || !s.thumbs.Has(v.ID) {
+		return nil
+	}
+	names := slices.SortedFunc(maps.Keys(thumbnail.VariantWidths), func(a, b string) int {
+		return cmp.Compare(thumbnail.VariantWidths[a], thumbnail.VariantWidths[b])
+	})
+	variants := make([]rss.MediaThumbnail, 0, len(names))
+	for _, name := range names {
+		key := v.ID + "." + name
+		width, height, _ := s.thumbs.ImageSize(key)
+		variants = append(variants, rss.MediaThumbnail{
+			URL:    s.thumbBaseURL + "/thumb/" + url.PathEscape(key),
+			Width:  width,
+			Height: height,
+		})
+	}
+	return variants
+}
+
+// setThumbnailCache サムネイルのキャッシュの設定を反映する。保存先が変わらなければ開いているキャッシュを使い続ける
+// 開けなかった場合は以前の状態のままエラーを返す
+func (s *feedSet) setThumbnailCache(cfg *config.ThumbnailCache) error {
+	if cfg == nil {
+		s.thumbs = nil
+		s.thumbBaseURL = ""
+		return nil
+	}
+	if s.thumbs == nil || s.thumbs.Dir() != cfg.Dir {
+		thumbs, err := repository.OpenThumbnailCache(cfg.Dir, cfg.MaxBytes(), cfg.MaxAge())
+		if err != nil {
+			return err
+		}
+		s.thumbs = thumbs
+	}
+	s.thumbs.SetLimits(cfg.MaxBytes(), cfg.MaxAge())
+	s.thumbBaseURL = cfg.PublicBaseURL
+	return nil
+}
+
+// syncThumbnailCache フィードに載っている動画のサムネイルのURLをキャッシュへ記録し、
+// どのフィードにも載っていない動画のキャッシュをキャッシュの制限に従って削除しその数を返す
+func (s *feedSet) syncThumbnailCache(now time.Time) (int, error) {
+	if s.thumbs == nil {
+		return 0, nil
+	}
+	ids, videosByID := s.videosByID()
+	keep := make(map[string]struct{}, len(ids))
+	sources := make(map[string]string, len(ids))
+	for _, id := range ids {
+		keep[id] = struct{}{}
+		sources[id] = videosByID[id][0].ThumbnailURL
+	}
+	s.thumbs.SetSources(sources)
+	return s.thumbs.Evict(keep, now)
+}
+
+// capacityFor クエリの検索結果を載せるフィードの規定数のうち最大のものを返す。新しい順でこれより後の動画はどのフィードにも残らない
+func (s *feedSet) capacityFor(q config.SearchQuery) int {
+	capacity := 0
+	for _, f := range s.order {
+		if f.includes(q) {
+			capacity = max(capacity, f.vRepo.Capacity())
+		}
+	}
+	if capacity == 0 {
+		capacity = config.DefaultCapacity
+	}
+	return capacity
+}
+
+// searchEnd 検索クエリを初回に遡って検索する下限を返す
+// クエリを載せるフィードの全てに保持期間がある場合は、その最大の期間だけnowから遡る
+// 保持期間の無いフィードや、期間を過ぎても残す件数(MinItems)のあるフィードに載る場合はconfig.DefaultSearchWindowだけ遡る
+func (s *feedSet) searchEnd(q config.SearchQuery, now time.Time) time.Time {
+	var maxAge time.Duration
+	for _, f := range s.order {
+		if !f.includes(q) {
+			continue
+		}
+		retention := f.vRepo.Retention()
+		if retention.MaxAge == 0 || retention.MinItems > 0 {
+			return now.Add(-config.DefaultSearchWindow)
+		}
+		maxAge = max(maxAge, retention.MaxAge)
+	}
+	if maxAge == 0 {
+		return now.Add(-config.DefaultSearchWindow)
+	}
+	return now.Add(-maxAge)
+}
+
+// trim 全フィードから保持期間を過ぎた動画などを削除する。新しい動画が無くても時間の経過で期間を過ぎるため周回ごとに呼ぶ
+func (s *feedSet) trim() {
+	for _, f := range s.order {
+		if removed := f.vRepo.TrimToCapacity(); removed > 0 {
+			slog.Debug(fmt.Sprintf("フィード%qから保持期間を過ぎた動画などを%d件削除しました", f.name, removed))
+		}
+	}
+}
+
+// searchFrom 検索クエリを前回の続きから検索する場合の下限(この日時を含む)を返す
+// 一度も取り込んでいないクエリ、下限がrangeEnd以前になるクエリ、投稿日時の新しい順でないクエリはfalseを返し、rangeEndまで遡って検索する
+// 新しい順でない場合は件数の上限により取りこぼした新しい動画が取り込み済みの最新日時より前にある可能性がある
+// 再生数などの投稿後に増える値で除外するクエリもfalseを返す。除外した動画が後で条件を満たした場合に取り込めるよう、毎回判定し直す
+func (s *feedSet) searchFrom(q config.SearchQuery, rangeEnd time.Time) (time.Time, bool) {
+	mark, ok := s.marks[q.Key()]
+	if !ok || !q.NewestFirst() || !mark.After(rangeEnd) || s.exclude[q.Key()].Volatile() {
+		return time.Time{}, false
+	}
+	return mark, true
+}
+
+// advanceMark 検索クエリで取り込んだ動画から、取り込み済みの最新の投稿日時を進める
+func (s *feedSet) advanceMark(q config.SearchQuery, videos []*repository.Video) {
+	key := q.Key()
+	for _, v := range videos {
+		if v.StartTime.After(s.marks[key]) {
+			s.marks[key] = v.StartTime
+		}
+	}
+}
+
+// restoreMarks 現在の検索クエリの分だけ取り込み済みの最新の投稿日時を引き継ぐ
+// previousはフィード名 -> 以前の残す動画の指定。previousに無いフィードや、残す範囲が広がったフィードに載るクエリは引き継がない。
+// 引き継がなかったクエリは初回と同じ範囲まで遡って検索し、まだ載っていない古い動画を取り込む
+func (s *feedSet) restoreMarks(marks map[string]time.Time, previous map[string]repository.Retention) {
+	stale := make(map[string]struct{})
+	for _, f := range s.order {
+		old, ok := previous[f.name]
+		if !ok || f.vRepo.Retention().Widens(old) {
+			maps.Copy(stale, f.queries)
+		}
+	}
+	for _, q := range s.queries {
+		if _, ok := stale[q.Key()]; ok {
+			continue
+		}
+		if mark, ok := marks[q.Key()]; ok {
+			s.marks[q.Key()] = mark
+		}
+	}
+}
+
+// get 名前付きフィードを返す
+func (s *feedSet) get(name string) (*feed, bool) {
+	f, ok := s.named[name]
+	return f, ok
+}
+
+// all 統合フィードを含む全フィードを返す
+func (s *feedSet) all() []*feed {
+	return s.order
+}
+
+// videosByID 全フィードの動画をIDごとにまとめ、最初に現れた順のIDと共に返す
+// 動画の変更はフィードごとに複製を差し替えて行うため、同じ動画でもフィードごとに別のポインタを持っていることがある
+func (s *feedSet) videosByID() ([]string, map[string][]*repository.Video) {
+	var ids []string
+	byID := make(map[string][]*repository.Video)
+	for _, f := range s.order {
+		for _, v := range f.vRepo.Videos() {
+			list, exists := byID[v.ID]
+			if !exists {
+				ids = append(ids, v.ID)
+			}
+			byID[v.ID] = append(list, v)
+		}
+	}
+	return ids, byID
+}
+
+// updateVideo 全フィードのIDの動画を、updateを適用したものに差し替える
+// 動画はフィードごとに複製されるため、同じ動画を載せる全てのフィードへ適用する
+func (s *feedSet) updateVideo(id string, update func(v *repository.Video)) {
+	for _, f := range s.order {
+		f.vRepo.UpdateVideo(id, update)
+	}
+}
+
+// restore 状態ファイルの動画と検索クエリごとの取り込み状況を戻す。動画を1件でも戻した場合trueを返す
+// 設定から消えたフィードの動画・検索クエリの取り込み状況は無視される
+// 状態ファイルに無いフィードには統合フィードの動画を載せ、そのクエリは遡って検索し直す。残す範囲が広がったフィードも同様
+func (s *feedSet) restore(state *repository.State) bool {
+	restored := false
+	previous := make(map[string]repository.Retention, len(s.order))
+	for _, f := range s.order {
+		if _, ok := state.Feeds[f.name]; !ok {
+			continue
+		}
+		if f.vRepo.AddSortedVideos(state.FeedVideos(f.name)) > 0 {
+			restored = true
+		}
+		// 保存時の指定が分からない古い状態ファイルは、広がっていないものとして扱う
+		old, ok := state.Retention[f.name]
+		if !ok {
+			old = f.vRepo.Retention()
+		}
+		previous[f.name] = old
+	}
+	for _, f := range s.order[1:] {
+		if _, ok := previous[f.name]; !ok {
+			f.seed(s.merged)
+		}
+	}
+	s.restoreMarks(state.QueryMarks, previous)
+	return restored
+}
+
+// state 現在の動画を状態ファイルへ保存する形にする
+func (s *feedSet) state() *repository.State {
+	ids, videosByID := s.videosByID()
+	state := &repository.State{
+		Videos:     make([]*repository.Video, 0, len(ids)),
+		Feeds:      make(map[string][]string, len(s.order)),
+		QueryMarks: make(map[string]time.Time, len(s.marks)),
+		Retention:  make(map[string]repository.Retention, len(s.order)),
+	}
+	for key, mark := range s.marks {
+		state.QueryMarks[key] = mark
+	}
+	for _, id := range ids {
+		state.Videos = append(state.Videos, videosByID[id][0])
+	}
+	for _, f := range s.order {
+		videos := f.vRepo.Videos()
+		feedIDs := make([]string, 0, len(videos))
+		for _, v := range videos {
+			feedIDs = append(feedIDs, v.ID)
+		}
+		state.Feeds[f.name] = feedIDs
+		state.Retention[f.name] = f.vRepo.Retention()
+	}
+	return state
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"maps"
+	"nicovideoRSSDIY/internal/config"
+	"nicovideoRSSDIY/internal/repository"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func loadTestConfig(t *testing.T, content string) *config.Config {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+	return cfg
+}
+
+func TestFeedSet_RestoreBackfillsNewFeeds(t *testing.T) {
+	mark := time.Date(2025, 11, 10, 5, 0, 0, 0, time.UTC)
+	rangeEnd := mark.AddDate(-1, 0, 0)
+	cfg := loadTestConfig(t, `{
+	    "searchQueries": [{"query": "VOCALOID"}],
+	    "feeds": [{"name": "talk", "searchQueries": [{"query": "ソフトウェアトーク旅行"}]}]
+	}`)
+	vocaloid, talk := cfg.SearchQueries[0], cfg.Feeds[0].SearchQueries[0]
+
+	// talkフィードを追加する前の状態ファイル
+	state := &repository.State{
+		Videos: []*repository.Video{
+			{ID: "sm2", StartTime: mark, Sources: []string{vocaloid.Key()}},
+			{ID: "sm1", StartTime: mark.Add(-time.Hour), Sources: []string{talk.Key()}},
+		},
+		Feeds:      map[string][]string{"": {"sm2", "sm1"}},
+		QueryMarks: map[string]time.Time{vocaloid.Key(): mark, talk.Key(): mark},
+		Retention:  map[string]repository.Retention{"": {Capacity: config.DefaultCapacity}},
+	}
+	feeds := newFeedSet(cfg)
+	if !feeds.restore(state) {
+		t.Fatalf("expected videos to be restored")
+	}
+
+	if _, ok := feeds.searchFrom(vocaloid, rangeEnd); !ok {
+		t.Fatalf("expected incremental search for a query of existing feeds")
+	}
+	// 新しいフィードのクエリは遡って検索する
+	if _, ok := feeds.searchFrom(talk, rangeEnd); ok {
+		t.Fatalf("expected full-range search for a query of the new feed")
+	}
+	// 統合フィードにあった動画は新しいフィードにすぐ載る
+	f, _ := feeds.get("talk")
+	if videos := f.vRepo.Videos(); len(videos) != 1 || videos[0].ID != "sm1" {
+		t.Fatalf("expected the new feed to be seeded from the merged feed, got %v", videos)
+	}
+
+	// 保存時より規定数が増えた場合も遡って検索する
+	state.Feeds["talk"] = []string{"sm1"}
+	state.Retention["talk"] = repository.Retention{Capacity: 50}
+	feeds = newFeedSet(cfg)
+	feeds.restore(state)
+	if _, ok := feeds.searchFrom(talk, rangeEnd); ok {
+		t.Fatalf("expected full-range search after raising maxItems")
+	}
+	state.Retention["talk"] = repository.Retention{Capacity: config.DefaultCapacity}
+	feeds = newFeedSet(cfg)
+	feeds.restore(state)
+	if _, ok := feeds.searchFrom(talk, rangeEnd); !ok {
+		t.Fatalf("expected incremental search for an unchanged feed")
+	}
+}
+
+func TestFeedSet_ReconfigureBackfillsWidenedFeeds(t *testing.T) {
+	mark := time.Date(2025, 11, 10, 5, 0, 0, 0, time.UTC)
+	rangeEnd := mark.AddDate(-1, 0, 0)
+	cfg := loadTestConfig(t, `{
+	    "searchQueries": [{"query": "VOCALOID"}],
+	    "feeds": [{"name": "talk", "searchQueries": [{"query": "ソフトウェアトーク旅行"}], "retention": {"maxItems": 50, "maxAgeDays": 30}}]
+	}`)
+	vocaloid, talk := cfg.SearchQueries[0], cfg.Feeds[0].SearchQueries[0]
+	marks := map[string]time.Time{vocaloid.Key(): mark, talk.Key(): mark}
+
+	cases := []struct {
+		name      string
+		config    string
+		wantTalk  bool
+		wantVocal bool
+	}{
+		{
+			name:      "unchanged",
+			config:    `{"searchQueries": [{"query": "VOCALOID"}], "feeds": [{"name": "talk", "searchQueries": [{"query": "ソフトウェアトーク旅行"}], "retention": {"maxItems": 50, "maxAgeDays": 30}}]}`,
+			wantTalk:  true,
+			wantVocal: true,
+		},
+		{
+			name:      "narrowed",
+			config:    `{"searchQueries": [{"query": "VOCALOID"}], "feeds": [{"name": "talk", "searchQueries": [{"query": "ソフトウェアトーク旅行"}], "retention": {"maxItems": 40, "maxAgeDays": 7}}]}`,
+			wantTalk:  true,
+			wantVocal: true,
+		},
+		{
+			name:      "more_items",
+			config:    `{"searchQueries": [{"query": "VOCALOID"}], "feeds": [{"name": "talk", "searchQueries": [{"query": "ソフトウェアトーク旅行"}], "retention": {"maxItems": 100, "maxAgeDays": 30}}]}`,
+			wantTalk:  false,
+			wantVocal: true,
+		},
+		{
+			name:      "longer",
+			config:    `{"searchQueries": [{"query": "VOCALOID"}], "feeds": [{"name": "talk", "searchQueries": [{"query": "ソフトウェアトーク旅行"}], "retention": {"maxItems": 50, "maxAgeDays": 90}}]}`,
+			wantTalk:  false,
+			wantVocal: true,
+		},
+		{
+			// 統合フィードには全てのクエリが載る
+			name:      "merged_more_items",
+			config:    `{"searchQueries": [{"query": "VOCALOID"}], "retention": {"maxItems": 300}, "feeds": [{"name": "talk", "searchQueries": [{"query": "ソフトウェアトーク旅行"}], "retention": {"maxItems": 50, "maxAgeDays": 30}}]}`,
+			wantTalk:  false,
+			wantVocal: false,
+		},
+		{
+			name:      "new_feed",
+			config:    `{"searchQueries": [{"query": "VOCALOID"}], "feeds": [{"name": "talk", "searchQueries": [{"query": "ソフトウェアトーク旅行"}], "retention": {"maxItems": 50, "maxAgeDays": 30}}, {"name": "voca", "searchQueries": [{"query": "VOCALOID"}]}]}`,
+			wantTalk:  true,
+			wantVocal: false,
+		},
+	}
+	for _, tc := range cases {
+		// reconfigureは動画の保持先を引き継ぐため、毎回作り直す
+		base := newFeedSet(cfg)
+		maps.Copy(base.marks, marks)
+		next := base.reconfigure(loadTestConfig(t, tc.config))
+		if _, ok := next.searchFrom(talk, rangeEnd); ok != tc.wantTalk {
+			t.Errorf("%s: expected incremental search for talk %v, got %v", tc.name, tc.wantTalk, ok)
+		}
+		if _, ok := next.searchFrom(vocaloid, rangeEnd); ok != tc.wantVocal {
+			t.Errorf("%s: expected incremental search for VOCALOID %v, got %v", tc.name, tc.wantVocal, ok)
+		}
+	}
+}
+
+func TestFeedSet_SearchFromRechecksVolatileRules(t *testing.T) {
+	mark := time.Date(2025, 11, 10, 5, 0, 0, 0, time.UTC)
+	rangeEnd := mark.AddDate(-1, 0, 0)
+	cfg := loadTestConfig(t, `{
+	    "searchQueries": [
+	        {"query": "VOCALOID", "exclude": {"min": {"lengthSeconds": 60}}},
+	        {"query": "MMD", "exclude": {"min": {"viewCounter": 100}}},
+	        {"query": "UTAU", "where": "likeCounter >= 5"},
+	        {"query": "VOICEROID", "where": "lengthSeconds >= 60"}
+	    ]
+	}`)
+	feeds := newFeedSet(cfg)
+	for _, q := range cfg.SearchQueries {
+		feeds.marks[q.Key()] = mark
+	}
+
+	// 投稿後に増える値で除外するクエリは、除外した動画を判定し直すため毎回遡って検索する
+	want := []bool{true, false, false, true}
+	for i, q := range cfg.SearchQueries {
+		if _, ok := feeds.searchFrom(q, rangeEnd); ok != want[i] {
+			t.Errorf("%s: expected incremental search %v, got %v", q.Query, want[i], ok)
+		}
+	}
+
+	// 全体の条件に含まれる場合も同様
+	cfg = loadTestConfig(t, `{"searchQueries": [{"query": "VOCALOID"}], "exclude": {"min": {"mylistCounter": 1}}}`)
+	feeds = newFeedSet(cfg)
+	feeds.marks[cfg.SearchQueries[0].Key()] = mark
+	if _, ok := feeds.searchFrom(cfg.SearchQueries[0], rangeEnd); ok {
+		t.Fatalf("expected full-range search with a global counter threshold")
+	}
+}
@@ -9,16 +9,25 @@ import (
 	"net/http"
 	"net/url"
 	"nicovideoRSSDIY/internal/repository"
+	"nicovideoRSSDIY/internal/thumbnail"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 )
 
-// todo: HTTPエラー周り処理の重複が多い。共通化
+// エラーは全て*APIErrorで返す(error.go)
 
 type VideoClient struct {
 	httpClient *http.Client
 	baseURL    string
 	UserAgent  string
+	// RequestTimeout 1リクエストごとのタイムアウト。Limiterの順番待ちの時間は含まない。0の場合は呼び出し元のコンテキストのみに従う
+	RequestTimeout time.Duration
+	// Retry 通信エラー・サーバーの異常(500)で失敗した場合の再試行方法
+	Retry RetryPolicy
+	// Limiter 全てのリクエストはこれの順番を待ってから送られる。既定ではDefaultLimiterを他のクライアントと共有する
+	Limiter *RateLimiter
 }
 
 var (
@@ -26,13 +35,18 @@ var (
 	ErrRespQueryParse   = errors.New("リクエストに不正なパラメーターがあります")
 	ErrRespInternal     = errors.New("サーバーの異常です。")
 	ErrRespMaintainance = errors.New("サービスがメンテナンス中です。メンテナンス終了までお待ち下さい。")
+	ErrTruncated        = errors.New("_offsetの上限に達したため検索結果を全て取得できません")
+	ErrThumbnailInvalid = errors.New("サムネイルが有効な画像ではありません")
 )
 
 func NewVideoClient(baseURL string, userAgent string) *VideoClient {
 	return &VideoClient{
-		httpClient: &http.Client{},
-		baseURL:    baseURL,
-		UserAgent:  userAgent,
+		httpClient:     &http.Client{},
+		baseURL:        baseURL,
+		UserAgent:      userAgent,
+		RequestTimeout: 20 * time.Second,
+		Retry:          DefaultRetryPolicy,
+		Limiter:        DefaultLimiter,
 	}
 }
 
@@ -46,76 +60,181 @@ type ResponseMetadata struct {
 type SearchVideoResponse struct {
 	Meta   ResponseMetadata    `json:"meta"`
 	Videos []*repository.Video `json:"data,omitempty"`
+	// Truncated _offsetの上限に達したため、totalCount件(MaxResults指定時はその件数)を全て取得できなかった
+	Truncated bool `json:"-"`
+	// ResponseTime 最後のリクエストのレスポンス時間
+	ResponseTime time.Duration `json:"-"`
 }
 
-// SearchVideo 動画検索APIを呼び出す。tagExact検索である。filtersは"[フィールド名][演算子]=値"の形式で指定する。その他必要なものは関数内でセットされる。
-func (c *VideoClient) SearchVideo(ctx context.Context, query string, filters []string) (*SearchVideoResponse, error) {
+const (
+	DefaultSearchTargets = "tagsExact"
+	DefaultSearchSort    = "-startTime"
+	DefaultSearchLimit   = 100
+)
+
+// searchMaxOffset _offsetに指定できる最大値
+// https://site.nicovideo.jp/search-api-docs/snapshot
+var searchMaxOffset = 100000
+
+// searchBaseFields repository.Videoへ格納するため常に取得するフィールド
+var searchBaseFields = []string{
+	"contentId", "title", "description", "thumbnailUrl", "startTime", "tags",
+	"viewCounter", "commentCounter", "mylistCounter", "likeCounter",
+	"lengthSeconds", "genre", "userId", "channelId", "lastCommentTime",
+}
+
+// SearchOptions 検索クエリごとに変わる追加の指定。空の項目は既定値が使われる
+type SearchOptions struct {
+	// JSONFilter jsonFilterパラメーター。指定された場合、filtersもjsonFilterへ変換しANDで結合して送る
+	JSONFilter json.RawMessage
+	Targets    []string // 既定値: tagsExact
+	Sort       string   // 既定値: -startTime
+	Limit      int      // 既定値: 100。SearchAllVideosでは1リクエストあたりの件数になる
+	Fields     []string // searchBaseFieldsに加えて取得するフィールド
+	Offset     int      // 先頭から飛ばす件数
+	// MaxResults SearchAllVideosで取得する最大件数。0の場合はtotalCount件全て
+	MaxResults int
+}
+
+// fields 取得するフィールドを重複なしで返す
+func (o SearchOptions) fields() string {
+	fields := append([]string{}, searchBaseFields...)
+	for _, f := range o.Fields {
+		if !slices.Contains(fields, f) {
+			fields = append(fields, f)
+		}
+	}
+	return strings.Join(fields, ",")
+}
+
+// SearchVideo 動画検索APIを呼び出す。既定ではtagExact検索・投稿日時の新しい順である。filtersは"[フィールド名][演算子]=値"の形式で指定する。その他必要なものは関数内でセットされる。
+// 通信エラー・サーバーの異常はc.Retryに従い再試行する。メンテナンス中の場合は再試行せずClassMaintenanceのAPIErrorを返す
+func (c *VideoClient) SearchVideo(ctx context.Context, query string, filters []string, opts SearchOptions) (*SearchVideoResponse, error) {
+	targets := DefaultSearchTargets
+	if len(opts.Targets) > 0 {
+		targets = strings.Join(opts.Targets, ",")
+	}
+	sortBy := DefaultSearchSort
+	if opts.Sort != "" {
+		sortBy = opts.Sort
+	}
+	limit := DefaultSearchLimit
+	if opts.Limit > 0 {
+		limit = opts.Limit
+	}
+
 	params := url.Values{}
 	params.Set("q", query)
-	params.Set("_limit", "100")
-	params.Set("_sort", "-startTime")
-	params.Set("targets", "tagsExact")
-	params.Set("fields", "contentId,title,description,thumbnailUrl,startTime,tags")
+	params.Set("_limit", strconv.Itoa(limit))
+	if opts.Offset > 0 {
+		params.Set("_offset", strconv.Itoa(opts.Offset))
+	}
+	params.Set("_sort", sortBy)
+	params.Set("targets", targets)
+	params.Set("fields", opts.fields())
 	params.Set("_context", c.UserAgent)
 
-	for _, filter := range filters {
-		splited := strings.Split(filter, "=")
-		if len(splited) != 2 {
-			return nil, fmt.Errorf("filtersパラメーターをセットできません: %w", ErrFiltersFormat)
+	if len(opts.JSONFilter) > 0 {
+		jsonFilter, err := combineJSONFilter(opts.JSONFilter, filters)
+		if err != nil {
+			return nil, requestError(EndpointSearch, fmt.Errorf("jsonFilterパラメーターをセットできません: %w", err))
+		}
+		params.Set("jsonFilter", string(jsonFilter))
+	} else {
+		for _, filter := range filters {
+			key, value, err := splitFilter(filter)
+			if err != nil {
+				return nil, requestError(EndpointSearch, fmt.Errorf("filtersパラメーターをセットできません: %w", err))
+			}
+			params.Set("filters"+key, value)
 		}
-		params.Set(fmt.Sprintf("filters%s", splited[0]), splited[1])
 	}
 
 	urlStr, err := url.JoinPath(c.baseURL, "video", "contents", "search")
 	if err != nil {
-		return nil, fmt.Errorf("URLを作成できません: %w", err)
+		return nil, requestError(EndpointSearch, fmt.Errorf("URLを作成できません: %w", err))
 	}
 
 	// log.Print(urlStr)
-	req, err := http.NewRequestWithContext(ctx, "GET", urlStr+"?"+params.Encode(), nil)
+	return withRetry(ctx, c.Retry, func() (*SearchVideoResponse, error) {
+		return c.searchVideoOnce(ctx, urlStr+"?"+params.Encode())
+	})
+}
+
+// searchVideoOnce 組み立て済みのURLで動画検索APIを1回呼び出す
+func (c *VideoClient) searchVideoOnce(ctx context.Context, reqURL string) (*SearchVideoResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
 	if err != nil {
-		return nil, fmt.Errorf("コンテキストを作成できません: %w", err)
+		return nil, requestError(EndpointSearch, fmt.Errorf("コンテキストを作成できません: %w", err))
 	}
 	req.Header.Set("User-Agent", c.UserAgent)
 
-	resp, err := c.httpClient.Do(req)
+	reqBeginAt := time.Now()
+	resp, err := doRequest(c.Limiter, c.httpClient, EndpointSearch, req, c.RequestTimeout)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	// 注意: Do()は2xx以外でもエラーを返さない。下記は必要
-	switch resp.StatusCode {
-	case http.StatusOK:
-		// OK
-	case http.StatusInternalServerError:
-		return nil, fmt.Errorf("動画情報取得に失敗しました: %w", ErrRespInternal)
-	case http.StatusServiceUnavailable:
-		return nil, fmt.Errorf("動画情報取得に失敗しました: %w", ErrRespMaintainance)
-	default:
-		return nil, fmt.Errorf("動画情報取得に不明なエラーで失敗しました: HTTP %d %s", resp.StatusCode, resp.Status)
-	}
-
 	var body io.Reader = resp.Body
 
 	// body = io.TeeReader(resp.Body, os.Stderr) // for debugging
 
 	var respoData SearchVideoResponse
 	if err := json.NewDecoder(body).Decode(&respoData); err != nil {
-		return nil, fmt.Errorf("レスポンスのデコードに失敗しました: %w", err)
+		return nil, decodeError(EndpointSearch, resp, err)
+	}
+	respoData.ResponseTime = time.Since(reqBeginAt)
+
+	if err := metaError(EndpointSearch, resp, respoData.Meta); err != nil {
+		return nil, err
+	}
+	return &respoData, nil
+}
+
+// SearchAllVideos _offsetをずらしながらSearchVideoを繰り返し、totalCount件(opts.MaxResultsが指定された場合はその件数まで)を全て取得する
+// リクエストの間隔はc.Limiterが空ける
+// _offsetの上限に達した場合はそこまでの結果を返し、Truncatedをtrueにする。途中で失敗した場合は取得済みの結果も捨ててエラーを返す
+func (c *VideoClient) SearchAllVideos(ctx context.Context, query string, filters []string, opts SearchOptions) (*SearchVideoResponse, error) {
+	pageSize := DefaultSearchLimit
+	if opts.Limit > 0 {
+		pageSize = opts.Limit
 	}
 
-	switch respoData.Meta.Status {
-	case 200:
-		return &respoData, nil
-	case 400:
-		return nil, fmt.Errorf("エラーが返却されました: %w (HTTP status %d, %s)", ErrRespQueryParse, respoData.Meta.Status, respoData.Meta.ErrorMessage)
-	case 500:
-		return nil, fmt.Errorf("エラーが返却されました: %w (HTTP status %d, %s)", ErrRespInternal, respoData.Meta.Status, respoData.Meta.ErrorMessage)
-	case 503:
-		return nil, fmt.Errorf("エラーが返却されました: %w (HTTP status %d, %s)", ErrRespMaintainance, respoData.Meta.Status, respoData.Meta.ErrorMessage)
-	default:
-		return nil, fmt.Errorf("不明なエラーが発生しました: HTTP status code %d, %s", respoData.Meta.Status, respoData.Meta.ErrorMessage)
+	result := &SearchVideoResponse{Videos: make([]*repository.Video, 0, pageSize)}
+	pageOpts := opts
+	pageOpts.Limit = pageSize
+	if opts.MaxResults > 0 && opts.MaxResults < pageSize {
+		pageOpts.Limit = opts.MaxResults
+	}
+	for {
+		resp, err := c.SearchVideo(ctx, query, filters, pageOpts)
+		if err != nil {
+			if pageOpts.Offset == opts.Offset {
+				return nil, err
+			}
+			return nil, fmt.Errorf("%d件目以降の取得に失敗しました: %w", pageOpts.Offset, err)
+		}
+
+		result.Meta = resp.Meta
+		result.ResponseTime = resp.ResponseTime
+		result.Videos = append(result.Videos, resp.Videos...)
+
+		want := resp.Meta.TotalCount - opts.Offset
+		if opts.MaxResults > 0 && opts.MaxResults < want {
+			want = opts.MaxResults
+		}
+		remaining := want - len(result.Videos)
+		if len(resp.Videos) == 0 || remaining <= 0 {
+			return result, nil
+		}
+
+		pageOpts.Offset += len(resp.Videos)
+		if pageOpts.Offset > searchMaxOffset {
+			result.Truncated = true
+			return result, nil
+		}
+		pageOpts.Limit = min(pageSize, remaining)
 	}
 }
 
@@ -123,95 +242,241 @@ type LastModified struct {
 	LastModified time.Time `json:"last_modified"`
 }
 
+// FetchLastModified データ切り替え日時を取得する。SearchVideoと同様に再試行する
 func (c *VideoClient) FetchLastModified(ctx context.Context) (time.Time, error) {
 	urlStr, err := url.JoinPath(c.baseURL, "version")
 	if err != nil {
-		return time.Now(), fmt.Errorf("URLを作成できません: %w", err)
+		return time.Now(), requestError(EndpointVersion, fmt.Errorf("URLを作成できません: %w", err))
 	}
 
+	return withRetry(ctx, c.Retry, func() (time.Time, error) {
+		return c.fetchLastModifiedOnce(ctx, urlStr)
+	})
+}
+
+func (c *VideoClient) fetchLastModifiedOnce(ctx context.Context, urlStr string) (time.Time, error) {
 	req, err := http.NewRequestWithContext(ctx, "GET", urlStr, nil)
 	if err != nil {
-		return time.Now(), fmt.Errorf("コンテキストを作成できません: %w", err)
+		return time.Now(), requestError(EndpointVersion, fmt.Errorf("コンテキストを作成できません: %w", err))
 	}
 	req.Header.Set("User-Agent", c.UserAgent)
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := doRequest(c.Limiter, c.httpClient, EndpointVersion, req, c.RequestTimeout)
 	if err != nil {
 		return time.Now(), err
 	}
 	defer resp.Body.Close()
 
-	// 注意: Do()は2xx以外でもエラーを返さない。下記は必要
-	switch resp.StatusCode {
-	case http.StatusOK:
-		// OK
-	case http.StatusInternalServerError:
-		return time.Now(), fmt.Errorf("データ切り替え日時情報取得に失敗しました: %w", ErrRespInternal)
-	case http.StatusServiceUnavailable:
-		return time.Now(), fmt.Errorf("データ切り替え日時情報取得に失敗しました: %w", ErrRespMaintainance)
-	default:
-		return time.Now(), fmt.Errorf("データ切り替え日時情報取得に不明なエラーで失敗しました: HTTP %d %s", resp.StatusCode, resp.Status)
-	}
-
 	var body io.Reader = resp.Body
 
 	var respData LastModified
 	if err := json.NewDecoder(body).Decode(&respData); err != nil {
-		return time.Now(), fmt.Errorf("レスポンスのデコードに失敗しました: %w", err)
+		return time.Now(), decodeError(EndpointVersion, resp, err)
 	}
 
 	return respData.LastModified, nil
 }
 
-type thumbnailMeta struct {
+// ThumbnailMeta サムネイル画像の種類と大きさ
+type ThumbnailMeta struct {
 	URL    string
 	Type   string
 	Length int64
+	// Width, Height 画像の幅と高さ。画像の先頭を取得した場合のみ得られる。分からない場合は0
+	Width  int
+	Height int
 }
 
 type ThumbnailClient struct {
 	httpClient *http.Client
 	UserAgent  string
+	// RequestTimeout 1リクエストごとのタイムアウト。Limiterの順番待ちの時間は含まない。0の場合は呼び出し元のコンテキストのみに従う
+	RequestTimeout time.Duration
+	// Limiter 全てのリクエストはこれの順番を待ってから送られる。既定ではDefaultLimiterを他のクライアントと共有する
+	Limiter *RateLimiter
 }
 
 func NewThumbnailClient(userAgent string) *ThumbnailClient {
 	return &ThumbnailClient{
-		httpClient: &http.Client{},
-		UserAgent:  userAgent,
+		httpClient:     &http.Client{},
+		UserAgent:      userAgent,
+		RequestTimeout: 20 * time.Second,
+		Limiter:        DefaultLimiter,
 	}
 }
 
-// FetchThumbnailMeta サムネイルのTypeとLengthを取得する。Lengthはサーバーが提供しない場合-1になる可能性がある
-func (c *ThumbnailClient) FetchThumbnailMeta(ctx context.Context, thumbnailURL string) (*thumbnailMeta, error) {
+// SetLimit CDNへのリクエストの同時実行数と開始間隔の上限を変更する。Limiterを共有する他のクライアントにも反映される
+// 並行して取得するため、前回のレスポンス時間だけ待つ規則は適用せずminIntervalのみで間隔を空ける
+func (c *ThumbnailClient) SetLimit(concurrency int, minInterval time.Duration) {
+	if c.Limiter == nil {
+		return
+	}
+	c.Limiter.SetPolicy(ThumbnailHost, HostPolicy{MinInterval: minInterval, Concurrency: concurrency})
+}
+
+// thumbnailSniffLen MIMEタイプの判別のために読む先頭のバイト数(http.DetectContentTypeが参照する長さ)
+const thumbnailSniffLen = 512
+
+// thumbnailMaxLength GETで大きさを数える際に読む上限。これを超えるものはサムネイルとして扱わない
+const thumbnailMaxLength = 10 << 20
+
+// FetchThumbnailMeta サムネイルのTypeとLengthを取得する
+// HEADでContent-Lengthが得られない、または画像以外のContent-Typeが返った場合は、GETで実際の大きさと種類を確かめる
+// 画像でない・空の場合はClassPermanentのAPIError(ErrThumbnailInvalid)を返す
+func (c *ThumbnailClient) FetchThumbnailMeta(ctx context.Context, thumbnailURL string) (*ThumbnailMeta, error) {
 	req, err := http.NewRequestWithContext(ctx, "HEAD", thumbnailURL, nil)
 	if err != nil {
-		return nil, fmt.Errorf("サムネイルのHEADリクエストを作成できません: %w", err)
+		return nil, requestError(EndpointThumbnail, fmt.Errorf("サムネイルのHEADリクエストを作成できません: %w", err))
 	}
 
 	req.Header.Set("User-Agent", c.UserAgent)
-	resp, err := c.httpClient.Do(req)
+	resp, err := doRequest(c.Limiter, c.httpClient, EndpointThumbnail, req, c.RequestTimeout)
 	if err != nil {
-		return nil, fmt.Errorf("サムネイル情報取得のHEADリクエストに失敗しました: %w", err)
+		return nil, err
+	}
+	resp.Body.Close()
+
+	meta := &ThumbnailMeta{
+		URL:    resp.Request.URL.String(),
+		Type:   resp.Header.Get("Content-Type"),
+		Length: resp.ContentLength,
+	}
+	if meta.Length > 0 && strings.HasPrefix(meta.Type, "image/") {
+		return meta, nil
+	}
+
+	// まず先頭だけを要求し、Content-Rangeから全体の大きさを得る。Rangeに対応していなければ全体を読んで数える
+	meta, err = c.fetchThumbnailMetaByGet(ctx, thumbnailURL, true)
+	if errors.Is(err, errNoContentRangeTotal) {
+		meta, err = c.fetchThumbnailMetaByGet(ctx, thumbnailURL, false)
+	}
+	return meta, err
+}
+
+// errNoContentRangeTotal 部分的な応答のContent-Rangeに全体の大きさが無い。範囲指定なしで取得し直す
+var errNoContentRangeTotal = errors.New("Content-Rangeに全体の大きさがありません")
+
+// fetchThumbnailMetaByGet GETでサムネイルを取得し、先頭から種類を判別して大きさを数える
+// rangedの場合は先頭thumbnailSniffLenバイトのみを要求する
+func (c *ThumbnailClient) fetchThumbnailMetaByGet(ctx context.Context, thumbnailURL string, ranged bool) (*ThumbnailMeta, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", thumbnailURL, nil)
+	if err != nil {
+		return nil, requestError(EndpointThumbnail, fmt.Errorf("サムネイルのGETリクエストを作成できません: %w", err))
+	}
+	req.Header.Set("User-Agent", c.UserAgent)
+	if ranged {
+		req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", thumbnailSniffLen-1))
+	}
+
+	resp, err := doRequest(c.Limiter, c.httpClient, EndpointThumbnail, req, c.RequestTimeout)
+	if err != nil {
+		return nil, err
 	}
 	defer resp.Body.Close()
 
-	// 注意: Do()は2xx以外でもエラーを返さない。下記は必要
-	switch resp.StatusCode {
-	case http.StatusOK:
-		// OK
-	case http.StatusInternalServerError:
-		return nil, fmt.Errorf("サムネイル情報取得に失敗しました: %w", ErrRespInternal)
-	case http.StatusServiceUnavailable:
-		return nil, fmt.Errorf("サムネイル情報取得に失敗しました: %w", ErrRespMaintainance)
-	default:
-		return nil, fmt.Errorf("サムネイル情報取得に不明なエラーで失敗しました: HTTP %d %s", resp.StatusCode, resp.Status)
+	head, err := io.ReadAll(io.LimitReader(resp.Body, thumbnailSniffLen))
+	if err != nil {
+		return nil, decodeError(EndpointThumbnail, resp, err)
+	}
+
+	length := resp.ContentLength
+	if resp.StatusCode == http.StatusPartialContent {
+		length = contentRangeTotal(resp.Header.Get("Content-Range"))
+		if length < 0 {
+			return nil, errNoContentRangeTotal
+		}
+	} else if length < 0 {
+		// Content-Lengthが無い(chunkedなど)ので最後まで読んで数える
+		rest, err := io.Copy(io.Discard, io.LimitReader(resp.Body, thumbnailMaxLength))
+		if err != nil {
+			return nil, decodeError(EndpointThumbnail, resp, err)
+		}
+		length = int64(len(head)) + rest
+	}
+
+	return checkThumbnail(resp, head, length)
+}
+
+// checkThumbnail 取得した内容の先頭headと全体の大きさlengthからサムネイルの種類を判別する
+// 先頭の内容から判別した種類を優先し、判別できなければContent-Typeを使う。有効な画像でない場合はClassPermanentのAPIErrorを返す
+func checkThumbnail(resp *http.Response, head []byte, length int64) (*ThumbnailMeta, error) {
+	invalid := func(reason string) *APIError {
+		return &APIError{
+			Endpoint:   EndpointThumbnail,
+			HTTPStatus: resp.StatusCode,
+			Class:      ClassPermanent,
+			Err:        fmt.Errorf("%s: %w", reason, ErrThumbnailInvalid),
+		}
+	}
+	if length <= 0 || len(head) == 0 {
+		return nil, invalid("内容が空です")
+	}
+	if length > thumbnailMaxLength {
+		return nil, invalid(fmt.Sprintf("大きすぎます(%dバイト超)", thumbnailMaxLength))
+	}
+	mimeType := http.DetectContentType(head)
+	if !strings.HasPrefix(mimeType, "image/") {
+		mimeType = resp.Header.Get("Content-Type")
+	}
+	if !strings.HasPrefix(mimeType, "image/") {
+		return nil, invalid(fmt.Sprintf("画像ではありません(%s)", mimeType))
 	}
 
-	meta := &thumbnailMeta{
+	meta := &ThumbnailMeta{
 		URL:    resp.Request.URL.String(),
-		Type:   resp.Header.Get("Content-Type"),
-		Length: resp.ContentLength,
+		Type:   mimeType,
+		Length: length,
 	}
+	// 先頭だけで読み取れない場合(JPEGのメタデータが大きいなど)は分からないままとする
+	if size, err := thumbnail.DecodeSize(head); err == nil {
+		meta.Width, meta.Height = size.Width, size.Height
+	}
+	return meta, nil
+}
 
+// CacheThumbnail サムネイル画像全体をGETしてcacheへkey(動画IDなど)で保存し、その種類と大きさを返す。画像の幅と高さもcacheへ記録する
+// 保存に失敗した場合(ディスクの空き不足など)は時間を置けば成功する可能性があるためClassRetryableになる
+func (c *ThumbnailClient) CacheThumbnail(ctx context.Context, cache *repository.ThumbnailCache, key string, thumbnailURL string) (*ThumbnailMeta, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", thumbnailURL, nil)
+	if err != nil {
+		return nil, requestError(EndpointThumbnail, fmt.Errorf("サムネイルのGETリクエストを作成できません: %w", err))
+	}
+	req.Header.Set("User-Agent", c.UserAgent)
+
+	resp, err := doRequest(c.Limiter, c.httpClient, EndpointThumbnail, req, c.RequestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, thumbnailMaxLength+1))
+	if err != nil {
+		return nil, decodeError(EndpointThumbnail, resp, err)
+	}
+	meta, err := checkThumbnail(resp, data, int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	if err := cache.Put(key, meta.Type, data); err != nil {
+		class := ClassRetryable
+		if errors.Is(err, repository.ErrThumbnailType) {
+			class = ClassPermanent
+		}
+		return nil, &APIError{Endpoint: EndpointThumbnail, HTTPStatus: resp.StatusCode, Class: class, Err: err}
+	}
+	cache.SetImageSize(key, meta.Width, meta.Height)
 	return meta, nil
 }
+
+// contentRangeTotal Content-Range(例: "bytes 0-511/6337")から全体の大きさを返す。分からない場合は-1
+func contentRangeTotal(contentRange string) int64 {
+	_, total, ok := strings.Cut(contentRange, "/")
+	if !ok {
+		return -1
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(total), 10, 64)
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
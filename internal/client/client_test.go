@@ -1,15 +1,25 @@
 package client
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"image"
+	"image/png"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"nicovideoRSSDIY/internal/repository"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestSearchVideo_ReturnsVideos(t *testing.T) {
@@ -37,7 +47,7 @@ func TestSearchVideo_ReturnsVideos(t *testing.T) {
 	ctx := context.Background()
 
 	for _, q := range []string{"vocaloid", "software_talk", "vocaloidd"} {
-		resp, err := c.SearchVideo(ctx, q, nil)
+		resp, err := c.SearchVideo(ctx, q, nil, SearchOptions{})
 		if err != nil {
 			t.Fatalf("SearchVideo error: %v", err)
 		}
@@ -72,6 +82,189 @@ func TestSearchVideo_ReturnsVideos(t *testing.T) {
 
 }
 
+func TestSearchVideo_DecodesStats(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, filepath.Join("..", "..", "testdata", "client", "stats.json"))
+	}))
+	defer srv.Close()
+
+	c := NewVideoClient(srv.URL, "niconico-rss-diy/0.1 test")
+	resp, err := c.SearchVideo(context.Background(), "VOCALOID", nil, SearchOptions{})
+	if err != nil {
+		t.Fatalf("SearchVideo error: %v", err)
+	}
+	if len(resp.Videos) != 2 {
+		t.Fatalf("expected 2 videos, got %d", len(resp.Videos))
+	}
+
+	v := resp.Videos[0]
+	if v.ViewCounter == nil || *v.ViewCounter != 12345 || v.CommentCounter == nil || *v.CommentCounter != 67 ||
+		v.MylistCounter == nil || *v.MylistCounter != 8 || v.LikeCounter == nil || *v.LikeCounter != 910 {
+		t.Fatalf("unexpected counters: %+v", v)
+	}
+	lastComment := time.Date(2025, 10, 16, 8, 1, 2, 0, time.FixedZone("JST", 9*60*60))
+	if v.LengthSeconds != 3725 || v.Genre != "音楽・サウンド" || v.UserID != 123456 || v.ChannelID != 0 || !v.LastCommentTime.Equal(lastComment) {
+		t.Fatalf("unexpected video fields: %+v", v)
+	}
+
+	// nullは未設定として扱う。0は0として残る
+	ch := resp.Videos[1]
+	if ch.UserID != 0 || ch.ChannelID != 2600000 || !ch.LastCommentTime.IsZero() || ch.ViewCounter == nil || *ch.ViewCounter != 0 {
+		t.Fatalf("unexpected channel video fields: %+v", ch)
+	}
+}
+
+func TestSearchVideo_FiltersAndJSONFilter(t *testing.T) {
+	var got url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.Query()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"meta": {"status": 200, "totalCount": 0}, "data": []}`))
+	}))
+	defer srv.Close()
+
+	c := NewVideoClient(srv.URL, "niconico-rss-diy/0.1 test")
+	ctx := context.Background()
+	filters := []string{"[startTime][lte]=2025-11-10T00:00:00+09:00", "[startTime][gt]=2024-11-10T00:00:00+09:00", "[userId][0]=12345"}
+
+	// filtersのみ: filters[...]パラメーターとして送る
+	if _, err := c.SearchVideo(ctx, "", filters, SearchOptions{}); err != nil {
+		t.Fatalf("SearchVideo error: %v", err)
+	}
+	if got.Get("filters[userId][0]") != "12345" || got.Get("filters[startTime][lte]") != "2025-11-10T00:00:00+09:00" {
+		t.Fatalf("filters not sent: %v", got)
+	}
+	if got.Has("jsonFilter") {
+		t.Fatalf("unexpected jsonFilter: %s", got.Get("jsonFilter"))
+	}
+
+	// jsonFilterあり: filtersもjsonFilterに変換してANDで結合する
+	userFilter := json.RawMessage(`{"type":"equal","field":"channelId","value":2632720}`)
+	if _, err := c.SearchVideo(ctx, "", filters, SearchOptions{JSONFilter: userFilter}); err != nil {
+		t.Fatalf("SearchVideo error: %v", err)
+	}
+	for k := range got {
+		if strings.HasPrefix(k, "filters[") {
+			t.Fatalf("filters should be merged into jsonFilter, got %s", k)
+		}
+	}
+	want := `{"filters":[{"type":"equal","field":"channelId","value":2632720},{"field":"startTime","from":"2024-11-10T00:00:00+09:00","include_lower":false,"include_upper":true,"to":"2025-11-10T00:00:00+09:00","type":"range"},{"field":"userId","type":"equal","value":12345}],"type":"and"}`
+	if got.Get("jsonFilter") != want {
+		t.Fatalf("expected jsonFilter %s, got %s", want, got.Get("jsonFilter"))
+	}
+
+	if _, err := c.SearchVideo(ctx, "", []string{"userId=1"}, SearchOptions{}); !errors.Is(err, ErrFiltersFormat) {
+		t.Fatalf("expected ErrFiltersFormat, got %v", err)
+	}
+}
+
+func TestSearchVideo_SearchParams(t *testing.T) {
+	var got url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.Query()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"meta": {"status": 200, "totalCount": 0}, "data": []}`))
+	}))
+	defer srv.Close()
+
+	c := NewVideoClient(srv.URL, "niconico-rss-diy/0.1 test")
+	ctx := context.Background()
+	baseFields := "contentId,title,description,thumbnailUrl,startTime,tags," +
+		"viewCounter,commentCounter,mylistCounter,likeCounter,lengthSeconds,genre,userId,channelId,lastCommentTime"
+
+	if _, err := c.SearchVideo(ctx, "VOCALOID", nil, SearchOptions{}); err != nil {
+		t.Fatalf("SearchVideo error: %v", err)
+	}
+	if got.Get("targets") != "tagsExact" || got.Get("_sort") != "-startTime" || got.Get("_limit") != "100" ||
+		got.Get("fields") != baseFields {
+		t.Fatalf("unexpected default params: %v", got)
+	}
+
+	opts := SearchOptions{
+		Targets: []string{"title", "description", "tags"},
+		Sort:    "-viewCounter",
+		Limit:   30,
+		Fields:  []string{"viewCounter", "categoryTags", "title"},
+	}
+	if _, err := c.SearchVideo(ctx, "VOCALOID", nil, opts); err != nil {
+		t.Fatalf("SearchVideo error: %v", err)
+	}
+	if got.Get("targets") != "title,description,tags" || got.Get("_sort") != "-viewCounter" || got.Get("_limit") != "30" ||
+		got.Get("fields") != baseFields+",categoryTags" {
+		t.Fatalf("unexpected params: %v", got)
+	}
+}
+
+// pagingServer totalCount件の動画を_offset・_limitに従って返すテストサーバーを作る。受け取った_offsetを記録する
+func pagingServer(totalCount int, offsets *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*offsets = append(*offsets, r.URL.Query().Get("_offset"))
+		offset, _ := strconv.Atoi(r.URL.Query().Get("_offset"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("_limit"))
+
+		data := make([]map[string]any, 0, limit)
+		for i := offset; i < offset+limit && i < totalCount; i++ {
+			data = append(data, map[string]any{"contentId": fmt.Sprintf("sm%d", i+1), "title": "t", "startTime": "2025-11-10T00:00:00+09:00"})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"meta": map[string]any{"status": 200, "totalCount": totalCount},
+			"data": data,
+		})
+	}))
+}
+
+func TestSearchAllVideos_Paging(t *testing.T) {
+	var offsets []string
+	srv := pagingServer(250, &offsets)
+	defer srv.Close()
+
+	c := NewVideoClient(srv.URL, "niconico-rss-diy/0.1 test")
+	ctx := context.Background()
+
+	resp, err := c.SearchAllVideos(ctx, "VOCALOID", nil, SearchOptions{})
+	if err != nil {
+		t.Fatalf("SearchAllVideos error: %v", err)
+	}
+	if len(resp.Videos) != 250 || resp.Videos[249].ID != "sm250" || resp.Truncated {
+		t.Fatalf("expected all 250 videos, got %d (truncated: %t)", len(resp.Videos), resp.Truncated)
+	}
+	if strings.Join(offsets, ",") != ",100,200" {
+		t.Fatalf("unexpected offsets: %v", offsets)
+	}
+
+	// MaxResultsまでで止める
+	offsets = nil
+	resp, err = c.SearchAllVideos(ctx, "VOCALOID", nil, SearchOptions{Limit: 40, MaxResults: 90})
+	if err != nil {
+		t.Fatalf("SearchAllVideos error: %v", err)
+	}
+	if len(resp.Videos) != 90 || resp.Truncated {
+		t.Fatalf("expected 90 videos, got %d (truncated: %t)", len(resp.Videos), resp.Truncated)
+	}
+	if strings.Join(offsets, ",") != ",40,80" {
+		t.Fatalf("unexpected offsets: %v", offsets)
+	}
+}
+
+func TestSearchAllVideos_Truncated(t *testing.T) {
+	defer func(v int) { searchMaxOffset = v }(searchMaxOffset)
+	searchMaxOffset = 200
+
+	var offsets []string
+	srv := pagingServer(1000, &offsets)
+	defer srv.Close()
+
+	c := NewVideoClient(srv.URL, "niconico-rss-diy/0.1 test")
+	resp, err := c.SearchAllVideos(context.Background(), "VOCALOID", nil, SearchOptions{})
+	if err != nil {
+		t.Fatalf("SearchAllVideos error: %v", err)
+	}
+	if !resp.Truncated || len(resp.Videos) != 300 || resp.Meta.TotalCount != 1000 {
+		t.Fatalf("expected truncated 300 of 1000 videos, got %d of %d (truncated: %t)", len(resp.Videos), resp.Meta.TotalCount, resp.Truncated)
+	}
+}
+
 func TestSearchVideo_ErrorStatusMapping(t *testing.T) {
 	cases := []struct {
 		name         string
@@ -79,10 +272,11 @@ func TestSearchVideo_ErrorStatusMapping(t *testing.T) {
 		code         string
 		errorMessage string
 		want         error
+		class        ErrorClass
 	}{
-		{name: "bad_request", status: 400, code: "QUERY_PARSE_ERROR", errorMessage: "query parse error", want: ErrRespQueryParse},
-		{name: "internal", status: 500, code: "INTERNAL_SERVER_ERROR", errorMessage: "please retry later", want: ErrRespInternal},
-		{name: "maint", status: 503, code: "MAINTENANCE", errorMessage: "please retry later.", want: ErrRespMaintainance},
+		{name: "bad_request", status: 400, code: "QUERY_PARSE_ERROR", errorMessage: "query parse error", want: ErrRespQueryParse, class: ClassPermanent},
+		{name: "internal", status: 500, code: "INTERNAL_SERVER_ERROR", errorMessage: "please retry later", want: ErrRespInternal, class: ClassRetryable},
+		{name: "maint", status: 503, code: "MAINTENANCE", errorMessage: "please retry later.", want: ErrRespMaintainance, class: ClassMaintenance},
 	}
 
 	for _, tc := range cases {
@@ -102,19 +296,145 @@ func TestSearchVideo_ErrorStatusMapping(t *testing.T) {
 			defer srv.Close()
 
 			c := NewVideoClient(srv.URL, "niconico-rss-diy/0.1 test")
+			c.Retry = fastRetry
 			ctx := context.Background()
-			_, err := c.SearchVideo(ctx, "vocaloid", nil)
+			_, err := c.SearchVideo(ctx, "vocaloid", nil, SearchOptions{})
 			if err == nil {
 				t.Fatalf("expected error for status %d", tc.status)
 			}
 			if !errors.Is(err, tc.want) {
 				t.Fatalf("expected error %v, got %v", tc.want, err)
 			}
+			apiErr, ok := AsAPIError(err)
+			if !ok || apiErr.Endpoint != EndpointSearch || apiErr.MetaStatus != tc.status || apiErr.ErrorCode != tc.code ||
+				apiErr.ErrorMessage != tc.errorMessage || apiErr.Class != tc.class {
+				t.Fatalf("unexpected APIError: %+v", apiErr)
+			}
 			t.Logf("received error(expect: %d): %v", tc.status, err)
 		})
 	}
 }
 
+func TestAPIError_HTTPStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"meta": {"status": 400, "errorCode": "QUERY_PARSE_ERROR", "errorMessage": "query parse error"}}`))
+	}))
+	defer srv.Close()
+
+	// HTTPステータスがエラーの場合もmetaを読む
+	c := NewVideoClient(srv.URL, "niconico-rss-diy/0.1 test")
+	_, err := c.SearchVideo(context.Background(), "VOCALOID", nil, SearchOptions{})
+	apiErr, ok := AsAPIError(err)
+	if !ok || !apiErr.Permanent() || apiErr.HTTPStatus != 400 || apiErr.ErrorCode != "QUERY_PARSE_ERROR" || !errors.Is(err, ErrRespQueryParse) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// リクエストを組み立てられない場合も同じ型で返る
+	_, err = c.SearchVideo(context.Background(), "", []string{"userId=1"}, SearchOptions{})
+	if apiErr, ok := AsAPIError(err); !ok || !apiErr.Permanent() || apiErr.HTTPStatus != 0 {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// スナップショット検索API以外の503はメンテナンスではない
+	_, err = NewThumbnailClient("niconico-rss-diy/0.1 test").FetchThumbnailMeta(context.Background(), srv.URL+"/thumb")
+	if apiErr, ok := AsAPIError(err); !ok || !apiErr.Retryable() || apiErr.Endpoint != EndpointThumbnail {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// fastRetry テストで待たずに再試行するための設定
+var fastRetry = RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+
+func TestSearchVideo_RetryTransient(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"meta": {"status": 200, "totalCount": 0}, "data": []}`))
+	}))
+	defer srv.Close()
+
+	c := NewVideoClient(srv.URL, "niconico-rss-diy/0.1 test")
+	c.Retry = fastRetry
+	if _, err := c.SearchVideo(context.Background(), "VOCALOID", nil, SearchOptions{}); err != nil {
+		t.Fatalf("expected success after retries, got %v", err)
+	}
+	if requests != 3 {
+		t.Fatalf("expected 3 requests, got %d", requests)
+	}
+
+	// 試行回数を使い切った場合は最後のエラーを返す
+	requests = -10
+	_, err := c.SearchVideo(context.Background(), "VOCALOID", nil, SearchOptions{})
+	if !errors.Is(err, ErrRespInternal) || requests != -7 {
+		t.Fatalf("expected ErrRespInternal after 3 attempts, got %v (%d requests)", err, requests+10)
+	}
+
+	// Retry-AfterがMaxDelayより長い場合は再試行しない
+	requests = -10
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	if _, err := c.SearchVideo(context.Background(), "VOCALOID", nil, SearchOptions{}); err == nil || requests != -9 {
+		t.Fatalf("expected single attempt, got %v (%d requests)", err, requests+10)
+	}
+}
+
+func TestSearchVideo_Maintenance(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Retry-After", "600")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	c := NewVideoClient(srv.URL, "niconico-rss-diy/0.1 test")
+	c.Retry = fastRetry
+	_, err := c.SearchVideo(context.Background(), "VOCALOID", nil, SearchOptions{})
+
+	maintenance, ok := AsAPIError(err)
+	if !ok || !maintenance.Maintenance() || !errors.Is(err, ErrRespMaintainance) {
+		t.Fatalf("expected maintenance APIError, got %v", err)
+	}
+	if maintenance.RetryAfter != 10*time.Minute || requests != 1 {
+		t.Fatalf("expected no retry and RetryAfter 10m, got %s (%d requests)", maintenance.RetryAfter, requests)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2025, 11, 10, 0, 0, 0, 0, time.UTC)
+	cases := map[string]time.Duration{
+		"":                              0,
+		"30":                            30 * time.Second,
+		"-1":                            0,
+		"Mon, 10 Nov 2025 00:05:00 GMT": 5 * time.Minute,
+		"Sun, 09 Nov 2025 23:00:00 GMT": 0,
+		"soon":                          0,
+	}
+	for v, want := range cases {
+		h := http.Header{}
+		if v != "" {
+			h.Set("Retry-After", v)
+		}
+		if got := parseRetryAfter(h, now); got != want {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s", v, got, want)
+		}
+	}
+}
+
 func TestFetchThumbnailMeta_ReturnsHeaders(t *testing.T) {
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "HEAD" {
@@ -184,3 +504,266 @@ func TestFetchThumbnailMeta_ErrorStatusMapping(t *testing.T) {
 		})
 	}
 }
+
+// pngHeader http.DetectContentTypeがimage/pngと判別する先頭
+var pngHeader = []byte("\x89PNG\x0D\x0A\x1A\x0A")
+
+func TestFetchThumbnailMeta_GetFallback(t *testing.T) {
+	body := append(slices.Clone(pngHeader), bytes.Repeat([]byte{0}, 1000)...)
+
+	cases := []struct {
+		name    string
+		handler func(w http.ResponseWriter, r *http.Request)
+		gets    int
+	}{
+		{
+			name: "ranged",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Range") != "bytes=0-511" {
+					t.Errorf("unexpected Range %q", r.Header.Get("Range"))
+				}
+				w.Header().Set("Content-Type", "application/octet-stream")
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-511/%d", len(body)))
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(body[:512])
+			},
+			gets: 1,
+		},
+		{
+			name: "range_ignored_streamed",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+				w.Write(body[:100])
+				w.(http.Flusher).Flush() // Content-Lengthなし(chunked)
+				w.Write(body[100:])
+			},
+			gets: 1,
+		},
+		{
+			name: "range_without_total",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Range") != "" {
+					w.Header().Set("Content-Range", "bytes 0-511/*")
+					w.WriteHeader(http.StatusPartialContent)
+					w.Write(body[:512])
+					return
+				}
+				w.Write(body)
+			},
+			gets: 2,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			gets := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == "HEAD" {
+					// Content-Lengthを返さないCDN
+					w.Header().Set("Content-Type", "image/png")
+					w.Header().Set("Transfer-Encoding", "chunked")
+					w.WriteHeader(http.StatusOK)
+					return
+				}
+				gets++
+				tc.handler(w, r)
+			}))
+			defer srv.Close()
+
+			c := NewThumbnailClient("niconico-rss-diy/0.1 test")
+			meta, err := c.FetchThumbnailMeta(context.Background(), srv.URL+"/thumb")
+			if err != nil {
+				t.Fatalf("FetchThumbnailMeta error: %v", err)
+			}
+			if meta.Type != "image/png" || meta.Length != int64(len(body)) {
+				t.Fatalf("unexpected meta: %+v", meta)
+			}
+			if gets != tc.gets {
+				t.Fatalf("expected %d GET requests, got %d", tc.gets, gets)
+			}
+		})
+	}
+}
+
+func TestFetchThumbnailMeta_Permanent(t *testing.T) {
+	cases := map[string]http.HandlerFunc{
+		"not_found": func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		},
+		"not_image": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html><body>not found</body></html>"))
+		},
+		"empty": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.WriteHeader(http.StatusOK)
+		},
+	}
+
+	for name, handler := range cases {
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewServer(handler)
+			defer srv.Close()
+
+			c := NewThumbnailClient("niconico-rss-diy/0.1 test")
+			_, err := c.FetchThumbnailMeta(context.Background(), srv.URL+"/thumb")
+			apiErr, ok := AsAPIError(err)
+			if !ok || !apiErr.Permanent() {
+				t.Fatalf("expected permanent APIError, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCacheThumbnail(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 130, 100))); err != nil {
+		t.Fatalf("png encode: %v", err)
+	}
+	body := buf.Bytes()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			t.Errorf("expected GET request, got %s", r.Method)
+		}
+		w.Header().Set("Content-Type", "image/jpeg") // 実際の内容を優先する
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	cache, err := repository.OpenThumbnailCache(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatalf("OpenThumbnailCache error: %v", err)
+	}
+	c := NewThumbnailClient("niconico-rss-diy/0.1 test")
+	meta, err := c.CacheThumbnail(context.Background(), cache, "sm9", srv.URL+"/thumb")
+	if err != nil {
+		t.Fatalf("CacheThumbnail error: %v", err)
+	}
+	if meta.Type != "image/png" || meta.Length != int64(len(body)) || meta.Width != 130 || meta.Height != 100 {
+		t.Fatalf("unexpected meta: %+v", meta)
+	}
+	entry, ok := cache.Get("sm9")
+	if !ok || entry.Type != "image/png" || entry.Size != int64(len(body)) {
+		t.Fatalf("unexpected cache entry: %+v, %v", entry, ok)
+	}
+	data, err := os.ReadFile(entry.Path)
+	if err != nil || !bytes.Equal(data, body) {
+		t.Fatalf("unexpected cached content: %v", err)
+	}
+}
+
+func TestContentRangeTotal(t *testing.T) {
+	cases := map[string]int64{
+		"bytes 0-511/6337": 6337,
+		"bytes 0-511/*":    -1,
+		"":                 -1,
+	}
+	for in, want := range cases {
+		if got := contentRangeTotal(in); got != want {
+			t.Errorf("contentRangeTotal(%q): expected %d, got %d", in, want, got)
+		}
+	}
+}
+
+func TestRateLimiter_Interval(t *testing.T) {
+	l := NewRateLimiter(map[string]HostPolicy{
+		"api.example.com": {MinInterval: 50 * time.Millisecond, WaitResponseTime: true},
+	}, HostPolicy{})
+	ctx := context.Background()
+
+	begin := time.Now()
+	done, err := l.Wait(ctx, "api.example.com")
+	if err != nil {
+		t.Fatalf("Wait error: %v", err)
+	}
+	time.Sleep(80 * time.Millisecond) // レスポンス時間
+	done()
+
+	// レスポンス時間(80ms)と同じだけ待つ
+	done, err = l.Wait(ctx, "API.example.com")
+	if err != nil {
+		t.Fatalf("Wait error: %v", err)
+	}
+	done()
+	if elapsed := time.Since(begin); elapsed < 160*time.Millisecond {
+		t.Fatalf("expected to wait for response time, elapsed %s", elapsed)
+	}
+
+	// 他のホストは待たない
+	begin = time.Now()
+	done, _ = l.Wait(ctx, "cdn.example.com")
+	done()
+	if elapsed := time.Since(begin); elapsed > 40*time.Millisecond {
+		t.Fatalf("unexpected wait for other host: %s", elapsed)
+	}
+
+	stats := l.Stats()
+	if len(stats) != 2 || stats[0].Host != "api.example.com" || stats[0].Requests != 2 || stats[0].MaxWait < 70*time.Millisecond {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	// 待機中にキャンセルされた場合は順番待ちから外れる
+	cctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	done, _ = l.Wait(ctx, "api.example.com")
+	if _, err := l.Wait(cctx, "api.example.com"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	done()
+	if st := l.Stats()[0]; st.Waiting != 0 || st.InFlight != 0 {
+		t.Fatalf("unexpected stats after cancel: %+v", st)
+	}
+}
+
+func TestRateLimiter_Concurrency(t *testing.T) {
+	l := NewRateLimiter(nil, HostPolicy{Concurrency: 2})
+
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			done, err := l.Wait(context.Background(), "cdn.example.com")
+			if err != nil {
+				t.Errorf("Wait error: %v", err)
+				return
+			}
+			mu.Lock()
+			inFlight++
+			maxInFlight = max(maxInFlight, inFlight)
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+			done()
+		}()
+	}
+	wg.Wait()
+
+	if maxInFlight != 2 {
+		t.Fatalf("expected at most 2 concurrent requests, got %d", maxInFlight)
+	}
+	if st := l.Stats()[0]; st.Requests != 6 || st.Waiting != 0 || st.InFlight != 0 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+}
+
+func TestThumbnailClient_SetLimit(t *testing.T) {
+	c := NewThumbnailClient("test")
+	c.Limiter = NewRateLimiter(DefaultHostPolicies, DefaultFallbackPolicy)
+	c.SetLimit(4, 250*time.Millisecond)
+
+	done, err := c.Limiter.Wait(context.Background(), ThumbnailHost)
+	if err != nil {
+		t.Fatalf("Wait error: %v", err)
+	}
+	done()
+	st := c.Limiter.Stats()[0]
+	want := HostPolicy{MinInterval: 250 * time.Millisecond, Concurrency: 4}
+	if st.Host != ThumbnailHost || st.Policy != want {
+		t.Fatalf("unexpected policy: %+v", st)
+	}
+}
@@ -0,0 +1,223 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Endpoint エラーが発生したAPIの種類
+type Endpoint string
+
+const (
+	EndpointSearch    Endpoint = "search"    // 動画検索API
+	EndpointVersion   Endpoint = "version"   // データ切り替え日時API
+	EndpointThumbnail Endpoint = "thumbnail" // サムネイル画像(CDN)
+)
+
+// snapshot スナップショット検索APIのエンドポイントかを返す。メタ情報のstatus・メンテナンスはこれらにのみ存在する
+func (e Endpoint) snapshot() bool {
+	return e == EndpointSearch || e == EndpointVersion
+}
+
+// ErrorClass エラーの分類。呼び出し元はこれを見て再試行・中断・一時停止を決める
+type ErrorClass int
+
+const (
+	ClassRetryable   ErrorClass = iota // 通信エラー・サーバーの異常など。時間を置けば成功する可能性がある
+	ClassPermanent                     // リクエストの誤りなど。同じリクエストを繰り返しても成功しない
+	ClassMaintenance                   // APIがメンテナンス中。メンテナンスが終わるまで全てのリクエストを止める
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ClassRetryable:
+		return "retryable"
+	case ClassPermanent:
+		return "permanent"
+	case ClassMaintenance:
+		return "maintenance"
+	default:
+		return "unknown"
+	}
+}
+
+// ErrRespUnexpected 分類できない応答。HTTPステータスなどはAPIErrorに含まれる
+var ErrRespUnexpected = errors.New("予期しない応答です")
+
+// APIError クライアントが返すエラー。通信・HTTPステータス・レスポンスのメタ情報から作られる
+// Errには分類に対応するErrResp*などが含まれるため、errors.Isでも判定できる
+type APIError struct {
+	Endpoint     Endpoint
+	HTTPStatus   int    // 応答が無い場合は0
+	MetaStatus   int    // レスポンスのmeta.status。無い場合は0
+	ErrorCode    string // レスポンスのmeta.errorCode
+	ErrorMessage string // レスポンスのmeta.errorMessage
+	Class        ErrorClass
+	RetryAfter   time.Duration // Retry-Afterで指示された待ち時間。指示が無ければ0
+	Err          error
+}
+
+func (e *APIError) Error() string {
+	var b strings.Builder
+	b.WriteString(string(e.Endpoint))
+	if e.HTTPStatus != 0 {
+		fmt.Fprintf(&b, " HTTP %d", e.HTTPStatus)
+	}
+	if e.MetaStatus != 0 && e.MetaStatus != e.HTTPStatus {
+		fmt.Fprintf(&b, " (meta status %d)", e.MetaStatus)
+	}
+	if e.ErrorCode != "" {
+		fmt.Fprintf(&b, " %s", e.ErrorCode)
+	}
+	if e.ErrorMessage != "" {
+		fmt.Fprintf(&b, " %q", e.ErrorMessage)
+	}
+	fmt.Fprintf(&b, ": %v", e.Err)
+	return b.String()
+}
+
+func (e *APIError) Unwrap() error { return e.Err }
+
+// Retryable 時間を置いて再試行すれば成功する可能性があるかを返す
+func (e *APIError) Retryable() bool { return e.Class == ClassRetryable }
+
+// Permanent 同じリクエストを繰り返しても成功しないかを返す
+func (e *APIError) Permanent() bool { return e.Class == ClassPermanent }
+
+// Maintenance APIがメンテナンス中かを返す
+func (e *APIError) Maintenance() bool { return e.Class == ClassMaintenance }
+
+// AsAPIError errからAPIErrorを取り出す
+func AsAPIError(err error) (*APIError, bool) {
+	var apiErr *APIError
+	ok := errors.As(err, &apiErr)
+	return apiErr, ok
+}
+
+// TruncatedError 検索クエリの結果が_offsetの上限に達して全て取得できなかったことを表す。errors.Is(err, ErrTruncated)で判定できる
+// Unwrapを辿った最も内側のエラーになるよう、件数などの毎回変わる値は含めずクエリごとに同じメッセージになる
+type TruncatedError struct {
+	Query string // 検索クエリのキー
+}
+
+func (e *TruncatedError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Query, ErrTruncated)
+}
+
+func (e *TruncatedError) Is(target error) bool { return target == ErrTruncated }
+
+// requestError リクエストを組み立てられなかった場合のエラー。同じ内容で繰り返しても成功しないためClassPermanentになる
+func requestError(endpoint Endpoint, err error) *APIError {
+	return &APIError{Endpoint: endpoint, Class: ClassPermanent, Err: err}
+}
+
+// classifyStatus ステータスコード(HTTPまたはmeta.status)から分類と対応するエラーを決める
+func classifyStatus(endpoint Endpoint, status int) (ErrorClass, error) {
+	switch {
+	case status == http.StatusBadRequest:
+		if endpoint.snapshot() {
+			return ClassPermanent, ErrRespQueryParse
+		}
+		return ClassPermanent, ErrRespUnexpected
+	case status == http.StatusServiceUnavailable:
+		// CDNなどの503は一時的な過負荷とみなす
+		if endpoint.snapshot() {
+			return ClassMaintenance, ErrRespMaintainance
+		}
+		return ClassRetryable, ErrRespMaintainance
+	case status == http.StatusTooManyRequests, status == http.StatusRequestTimeout, status >= 500:
+		return ClassRetryable, ErrRespInternal
+	default:
+		return ClassPermanent, ErrRespUnexpected
+	}
+}
+
+// doRequest limiterの順番を待ってからリクエストを送り、成功(2xx)した場合のみレスポンスを返す。失敗した場合は分類したAPIErrorを返す
+// レスポンスのBodyを閉じた時点でリクエストが終わったものとしてlimiterへ伝える。limiterがnilの場合は待たない
+// timeoutが0より大きい場合、順番が来てからBodyを閉じるまでにタイムアウトを設ける
+// スナップショット検索APIのエラー応答に含まれるmeta(status・errorCode・errorMessage)もAPIErrorへ入れる
+func doRequest(limiter *RateLimiter, httpClient *http.Client, endpoint Endpoint, req *http.Request, timeout time.Duration) (*http.Response, error) {
+	release := func() {}
+	if limiter != nil {
+		var err error
+		release, err = limiter.Wait(req.Context(), req.URL.Host)
+		if err != nil {
+			return nil, &APIError{Endpoint: endpoint, Class: ClassRetryable, Err: err}
+		}
+	}
+	done := release
+	if timeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		req = req.WithContext(ctx)
+		done = func() {
+			cancel()
+			release()
+		}
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		done()
+		return nil, &APIError{Endpoint: endpoint, Class: ClassRetryable, Err: err}
+	}
+	resp.Body = &limitedBody{ReadCloser: resp.Body, done: done}
+
+	// 注意: Do()は2xx以外でもエラーを返さない
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	apiErr := &APIError{
+		Endpoint:   endpoint,
+		HTTPStatus: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header, time.Now()),
+	}
+	status := resp.StatusCode
+	if endpoint.snapshot() {
+		var body struct {
+			Meta ResponseMetadata `json:"meta"`
+		}
+		if json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&body) == nil && body.Meta.Status != 0 {
+			apiErr.MetaStatus = body.Meta.Status
+			apiErr.ErrorCode = body.Meta.ErrorCode
+			apiErr.ErrorMessage = body.Meta.ErrorMessage
+			status = body.Meta.Status
+		}
+	}
+	apiErr.Class, apiErr.Err = classifyStatus(endpoint, status)
+	return nil, apiErr
+}
+
+// metaError 2xxで返ったレスポンスのmeta.statusがエラーを示す場合にAPIErrorを返す。正常な場合はnil
+func metaError(endpoint Endpoint, resp *http.Response, meta ResponseMetadata) error {
+	if meta.Status == http.StatusOK {
+		return nil
+	}
+	apiErr := &APIError{
+		Endpoint:     endpoint,
+		HTTPStatus:   resp.StatusCode,
+		MetaStatus:   meta.Status,
+		ErrorCode:    meta.ErrorCode,
+		ErrorMessage: meta.ErrorMessage,
+		RetryAfter:   parseRetryAfter(resp.Header, time.Now()),
+	}
+	apiErr.Class, apiErr.Err = classifyStatus(endpoint, meta.Status)
+	return apiErr
+}
+
+// decodeError レスポンスを解析できなかった場合のエラー。途中で切断された可能性があるためClassRetryableになる
+func decodeError(endpoint Endpoint, resp *http.Response, err error) *APIError {
+	return &APIError{
+		Endpoint:   endpoint,
+		HTTPStatus: resp.StatusCode,
+		Class:      ClassRetryable,
+		Err:        fmt.Errorf("レスポンスのデコードに失敗しました: %w", err),
+	}
+}
@@ -0,0 +1,120 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// splitFilter "[フィールド名][演算子]=値"を"[フィールド名][演算子]"と値に分ける
+func splitFilter(filter string) (key string, value string, err error) {
+	key, value, found := strings.Cut(filter, "=")
+	if !found || !strings.HasPrefix(key, "[") || !strings.HasSuffix(key, "]") {
+		return "", "", ErrFiltersFormat
+	}
+	return key, value, nil
+}
+
+// parseFilterKey "[フィールド名][演算子]"をフィールド名と演算子に分ける
+func parseFilterKey(key string) (field string, op string, err error) {
+	parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(key, "["), "]"), "][")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", ErrFiltersFormat
+	}
+	return parts[0], parts[1], nil
+}
+
+// filterValue filtersの値をjsonFilter用に変換する。数値として読めるものは数値にする
+func filterValue(value string) any {
+	if _, err := strconv.ParseFloat(value, 64); err == nil {
+		return json.Number(value)
+	}
+	return value
+}
+
+// combineJSONFilter jsonFilterとfiltersをANDで結合した1つのjsonFilterにする。
+// filtersは同じフィールドの番号指定をOR(equal)、gt/gte/lt/lteをrangeとして変換する
+func combineJSONFilter(jsonFilter json.RawMessage, filters []string) (json.RawMessage, error) {
+	if len(filters) == 0 {
+		return jsonFilter, nil
+	}
+
+	type rangeNode struct {
+		from, to                   any
+		includeLower, includeUpper bool
+	}
+	equals := make(map[string][]any)
+	ranges := make(map[string]*rangeNode)
+	fields := make([]string, 0, len(filters))
+	seen := make(map[string]struct{})
+
+	for _, filter := range filters {
+		key, value, err := splitFilter(filter)
+		if err != nil {
+			return nil, err
+		}
+		field, op, err := parseFilterKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := seen[field]; !ok {
+			seen[field] = struct{}{}
+			fields = append(fields, field)
+		}
+
+		switch op {
+		case "gt", "gte", "lt", "lte":
+			r, ok := ranges[field]
+			if !ok {
+				r = &rangeNode{}
+				ranges[field] = r
+			}
+			switch op {
+			case "gt", "gte":
+				r.from = filterValue(value)
+				r.includeLower = op == "gte"
+			default:
+				r.to = filterValue(value)
+				r.includeUpper = op == "lte"
+			}
+		default:
+			equals[field] = append(equals[field], filterValue(value))
+		}
+	}
+	sort.Strings(fields)
+
+	nodes := []any{jsonFilter}
+	for _, field := range fields {
+		if values, ok := equals[field]; ok {
+			or := make([]any, 0, len(values))
+			for _, v := range values {
+				or = append(or, map[string]any{"type": "equal", "field": field, "value": v})
+			}
+			if len(or) == 1 {
+				nodes = append(nodes, or[0])
+			} else {
+				nodes = append(nodes, map[string]any{"type": "or", "filters": or})
+			}
+		}
+		if r, ok := ranges[field]; ok {
+			node := map[string]any{"type": "range", "field": field}
+			if r.from != nil {
+				node["from"] = r.from
+				node["include_lower"] = r.includeLower
+			}
+			if r.to != nil {
+				node["to"] = r.to
+				node["include_upper"] = r.includeUpper
+			}
+			nodes = append(nodes, node)
+		}
+	}
+
+	combined, err := json.Marshal(map[string]any{"type": "and", "filters": nodes})
+	if err != nil {
+		return nil, fmt.Errorf("jsonFilterを結合できません: %w", err)
+	}
+	return combined, nil
+}
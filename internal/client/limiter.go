@@ -0,0 +1,224 @@
+package client
+
+import (
+	"context"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HostPolicy ホストごとのリクエストの間隔の規則
+type HostPolicy struct {
+	// MinInterval リクエストを開始してから次のリクエストを開始するまでの最低間隔
+	MinInterval time.Duration
+	// WaitResponseTime リクエストが終わってから、そのレスポンス時間と同じだけ次のリクエストを待たせる
+	// API利用制限: 「繰り返しAPIリクエストを行う場合は、前回のAPIレスポンス時間と同じだけ待機時間を設けてご利用ください。」
+	WaitResponseTime bool
+	// Concurrency 同時に行うリクエストの上限。0以下の場合は1
+	Concurrency int
+}
+
+const (
+	SnapshotHost  = "snapshot.search.nicovideo.jp" // スナップショット検索API
+	ThumbnailHost = "nicovideo.cdn.nimg.jp"        // サムネイル画像のCDN
+)
+
+// DefaultHostPolicies ニコニコ動画のホストごとの既定の規則
+// スナップショット検索APIはレスポンス時間と同じだけ待つ。CDNにも適用されるのか分からないが、同様に待った上で最低1秒空ける
+var DefaultHostPolicies = map[string]HostPolicy{
+	SnapshotHost:  {MinInterval: 3 * time.Second, WaitResponseTime: true, Concurrency: 1},
+	ThumbnailHost: {MinInterval: 1 * time.Second, WaitResponseTime: true, Concurrency: 1},
+}
+
+// DefaultFallbackPolicy DefaultHostPoliciesに無いホストの規則
+var DefaultFallbackPolicy = HostPolicy{WaitResponseTime: true, Concurrency: 1}
+
+// DefaultLimiter クライアントが既定で共有するRateLimiter
+var DefaultLimiter = NewRateLimiter(DefaultHostPolicies, DefaultFallbackPolicy)
+
+// LimiterStats ホストごとの待機状況
+type LimiterStats struct {
+	Host             string
+	Policy           HostPolicy
+	Waiting          int           // 順番を待っているリクエスト数
+	InFlight         int           // 実行中のリクエスト数
+	Requests         int64         // 完了したリクエスト数
+	TotalWait        time.Duration // 順番待ちにかかった時間の合計
+	MaxWait          time.Duration // 順番待ちにかかった時間の最大
+	LastResponseTime time.Duration // 最後に完了したリクエストのレスポンス時間
+}
+
+// RateLimiter ホストごとの規則に従ってリクエストの開始を待たせる。複数のクライアント・goroutineから共有できる
+type RateLimiter struct {
+	mu       sync.Mutex
+	policies map[string]HostPolicy
+	fallback HostPolicy
+	hosts    map[string]*hostLimiter
+}
+
+type hostLimiter struct {
+	policy HostPolicy
+	slots  chan struct{} // 同時リクエスト数の上限
+
+	mu     sync.Mutex
+	nextAt time.Time // 次のリクエストを開始できる日時
+	stats  LimiterStats
+}
+
+func NewRateLimiter(policies map[string]HostPolicy, fallback HostPolicy) *RateLimiter {
+	copied := make(map[string]HostPolicy, len(policies))
+	for host, p := range policies {
+		copied[strings.ToLower(host)] = p
+	}
+	return &RateLimiter{
+		policies: copied,
+		fallback: fallback,
+		hosts:    make(map[string]*hostLimiter),
+	}
+}
+
+// SetPolicy ホストの規則を変更する。既に待機中・実行中のリクエストには同時リクエスト数の変更は反映されない
+func (l *RateLimiter) SetPolicy(host string, policy HostPolicy) {
+	host = strings.ToLower(host)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.policies[host] = policy
+	if h, ok := l.hosts[host]; ok {
+		l.hosts[host] = newHostLimiter(policy, h)
+	}
+}
+
+func newHostLimiter(policy HostPolicy, prev *hostLimiter) *hostLimiter {
+	concurrency := policy.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	h := &hostLimiter{policy: policy, slots: make(chan struct{}, concurrency)}
+	if prev != nil {
+		// 間隔の規則は引き継ぐ
+		prev.mu.Lock()
+		h.nextAt = prev.nextAt
+		h.stats = prev.stats
+		prev.mu.Unlock()
+	}
+	h.stats.Policy = policy
+	return h
+}
+
+func (l *RateLimiter) host(host string) *hostLimiter {
+	host = strings.ToLower(host)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h, ok := l.hosts[host]
+	if !ok {
+		policy, ok := l.policies[host]
+		if !ok {
+			policy = l.fallback
+		}
+		h = newHostLimiter(policy, nil)
+		h.stats.Host = host
+		l.hosts[host] = h
+	}
+	return h
+}
+
+// Wait hostへのリクエストを開始できるまで待つ。リクエストが終わったら(レスポンスを読み終えてから)返された関数を呼ぶ必要がある
+func (l *RateLimiter) Wait(ctx context.Context, host string) (done func(), err error) {
+	h := l.host(host)
+	queuedAt := time.Now()
+
+	h.mu.Lock()
+	h.stats.Waiting++
+	h.mu.Unlock()
+	leave := func() {
+		h.mu.Lock()
+		h.stats.Waiting--
+		h.mu.Unlock()
+	}
+
+	select {
+	case h.slots <- struct{}{}:
+	case <-ctx.Done():
+		leave()
+		return nil, ctx.Err()
+	}
+
+	for {
+		h.mu.Lock()
+		wait := time.Until(h.nextAt)
+		if wait <= 0 {
+			break // ロックしたまま開始を記録する
+		}
+		h.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			<-h.slots
+			leave()
+			return nil, ctx.Err()
+		}
+	}
+	startedAt := time.Now()
+	h.nextAt = startedAt.Add(h.policy.MinInterval)
+	waited := startedAt.Sub(queuedAt)
+	h.stats.Waiting--
+	h.stats.InFlight++
+	h.stats.TotalWait += waited
+	h.stats.MaxWait = max(h.stats.MaxWait, waited)
+	h.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			finishedAt := time.Now()
+			responseTime := finishedAt.Sub(startedAt)
+			h.mu.Lock()
+			if h.policy.WaitResponseTime {
+				if next := finishedAt.Add(responseTime); next.After(h.nextAt) {
+					h.nextAt = next
+				}
+			}
+			h.stats.InFlight--
+			h.stats.Requests++
+			h.stats.LastResponseTime = responseTime
+			h.mu.Unlock()
+			<-h.slots
+		})
+	}, nil
+}
+
+// Stats ホストごとの待機状況をホスト名順で返す
+func (l *RateLimiter) Stats() []LimiterStats {
+	l.mu.Lock()
+	hosts := make([]*hostLimiter, 0, len(l.hosts))
+	for _, h := range l.hosts {
+		hosts = append(hosts, h)
+	}
+	l.mu.Unlock()
+
+	result := make([]LimiterStats, 0, len(hosts))
+	for _, h := range hosts {
+		h.mu.Lock()
+		result = append(result, h.stats)
+		h.mu.Unlock()
+	}
+	slices.SortFunc(result, func(a, b LimiterStats) int { return strings.Compare(a.Host, b.Host) })
+	return result
+}
+
+// limitedBody レスポンスを読み終えて閉じた時点でリクエストの終了をRateLimiterへ伝える
+type limitedBody struct {
+	io.ReadCloser
+	done func()
+}
+
+func (b *limitedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.done()
+	return err
+}
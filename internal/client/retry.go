@@ -0,0 +1,87 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy 一時的なエラー(通信エラー・サーバーの異常)の再試行方法
+type RetryPolicy struct {
+	MaxAttempts int           // 最初の1回を含む試行回数。1以下の場合は再試行しない
+	BaseDelay   time.Duration // 1回目の再試行までの待ち時間の基準。以降は倍々に増える
+	MaxDelay    time.Duration // 待ち時間の上限。Retry-Afterでこれより長く待つよう指示された場合は再試行しない
+}
+
+// DefaultRetryPolicy VideoClientの既定の再試行方法
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   2 * time.Second,
+	MaxDelay:    30 * time.Second,
+}
+
+// backoff attempt回目(1から)の失敗後の待ち時間を返す。
+// 同時に失敗した複数のリクエストが揃って再試行しないよう、指数的に増やした値の半分から全体までの間でランダムにずらす
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.BaseDelay << (attempt - 1)
+	if d <= 0 || d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// parseRetryAfter Retry-Afterヘッダー(秒数またはHTTP日付)を待ち時間にする。無い・解釈できない場合は0
+func parseRetryAfter(header http.Header, now time.Time) time.Duration {
+	v := header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if sec, err := strconv.Atoi(v); err == nil {
+		if sec > 0 {
+			return time.Duration(sec) * time.Second
+		}
+		return 0
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// withRetry fnを実行し、ClassRetryableのAPIErrorで失敗した場合はpolicyに従い待機して再試行する
+// 再試行しても失敗した場合は最後のエラーを返す
+func withRetry[T any](ctx context.Context, policy RetryPolicy, fn func() (T, error)) (T, error) {
+	for attempt := 1; ; attempt++ {
+		result, err := fn()
+
+		apiErr, ok := AsAPIError(err)
+		if err == nil || !ok || !apiErr.Retryable() || ctx.Err() != nil {
+			return result, err
+		}
+		if attempt >= policy.MaxAttempts {
+			if attempt > 1 {
+				err = fmt.Errorf("%d回試行しましたが失敗しました: %w", attempt, err)
+			}
+			return result, err
+		}
+
+		wait := policy.backoff(attempt)
+		if apiErr.RetryAfter > 0 {
+			if apiErr.RetryAfter > policy.MaxDelay {
+				return result, err
+			}
+			wait = apiErr.RetryAfter
+		}
+		select {
+		case <-ctx.Done():
+			return result, err
+		case <-time.After(wait):
+		}
+	}
+}
@@ -3,13 +3,94 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"nicovideoRSSDIY/internal/filter"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 )
 
-// filters追加など拡張性確保のため
+// DefaultCapacity フィードに載せる動画数の既定値
+const DefaultCapacity = 200
+
+// SearchQuery 検索クエリ。FiltersとJSONFilterはスナップショット検索APIのfilters・jsonFilterにそのまま渡される
+// Targets, Sort, Limit, Fieldsは省略時にVideoClientの既定値(tagsExact, -startTime, 100, 基本フィールドのみ)が使われる
 type SearchQuery struct {
-	Query string `json:"query"`
+	Query      string                            `json:"query"`
+	Filters    map[string]map[string]FilterValue `json:"filters,omitempty"`    // フィールド名 -> 演算子(gt/gte/lt/lteまたは0からの番号) -> 値
+	JSONFilter json.RawMessage                   `json:"jsonFilter,omitempty"` // LoadConfigで正規化される
+	Targets    []string                          `json:"targets,omitempty"`    // 検索対象フィールド
+	Sort       string                            `json:"sort,omitempty"`       // 例: -viewCounter
+	Limit      int                               `json:"limit,omitempty"`      // 1回の検索で取得する件数(1～100)
+	Fields     []string                          `json:"fields,omitempty"`     // 基本フィールドに加えて取得するフィールド
+	Exclude    *Exclude                          `json:"exclude,omitempty"`    // 取得後に除外する条件(Config.Excludeと合わせて使う)
+	Where      Expression                        `json:"where,omitempty"`      // 取得後にこの条件式を満たす動画のみを残す
+	MinItems   int                               `json:"minItems,omitempty"`   // フィードの規定数の範囲で、このクエリの動画を少なくともこの件数残す
+	MaxItems   int                               `json:"maxItems,omitempty"`   // フィードにこのクエリの動画をこの件数まで載せる
+
+	where *filter.Expr // LoadConfigで作成される
+}
+
+// FilterValue filtersの値。JSONでは文字列・数値・真偽値のいずれでも書ける
+type FilterValue string
+
+func (v *FilterValue) UnmarshalJSON(data []byte) error {
+	var raw any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	switch value := raw.(type) {
+	case string:
+		*v = FilterValue(value)
+	case float64, bool:
+		*v = FilterValue(strings.TrimSpace(string(data)))
+	default:
+		return fmt.Errorf("filtersの値は文字列・数値・真偽値のいずれかである必要があります: %s", string(data))
+	}
+	return nil
+}
+
+// Key クエリを識別するためのキーを返す。同じキーのクエリは同じ検索結果を返す
+// MinItems・MaxItemsはフィードへの載せ方の指定のため含めない
+func (q SearchQuery) Key() string {
+	q.MinItems, q.MaxItems = 0, 0
+	if len(q.Filters) == 0 && len(q.JSONFilter) == 0 && len(q.Targets) == 0 && q.Sort == "" && q.Limit == 0 && len(q.Fields) == 0 && q.Exclude == nil && q.Where == "" {
+		return q.Query
+	}
+	// mapはキー順にエンコードされ、JSONFilter・Targets・Fields・ExcludeはLoadConfigで正規化済みのため安定する
+	// Exclude・Whereが異なるクエリは、同じ検索でもフィードに載る動画が異なるため別のキーになる
+	b, err := json.Marshal(q)
+	if err != nil {
+		return q.Query
+	}
+	return string(b)
+}
+
+// NewestFirst 検索結果が投稿日時の新しい順(-startTime、省略時の既定値)で返るかを返す
+func (q SearchQuery) NewestFirst() bool {
+	return q.Sort == "" || q.Sort == "-startTime"
+}
+
+// FilterStrings Filtersを"[フィールド名][演算子]=値"の形式にして返す。順序は安定している
+func (q SearchQuery) FilterStrings() []string {
+	result := make([]string, 0, len(q.Filters))
+	for field, ops := range q.Filters {
+		for op, value := range ops {
+			result = append(result, fmt.Sprintf("[%s][%s]=%s", field, op, value))
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Feed 名前付きフィード。/feeds/{name} で配信される
+// Capacityはretention.maxItemsの古い書き方。LoadConfig後はRetention.MaxItemsと同じ値になる
+type Feed struct {
+	Name          string        `json:"name"`
+	SearchQueries []SearchQuery `json:"searchQueries"`
+	Capacity      int           `json:"capacity,omitempty"`
+	Retention     Retention     `json:"retention,omitzero"` // 省略した項目はConfig.Retentionの値を使う
 }
 
 type System struct {
@@ -18,10 +99,40 @@ type System struct {
 
 type Config struct {
 	SearchQueries []SearchQuery `json:"searchQueries"`
+	Feeds         []Feed        `json:"feeds,omitempty"`
 	Log           string        `json:"log,omitempty"`
+	Notifications Notifications `json:"notifications,omitempty"`
+	Thumbnail     Thumbnail     `json:"thumbnail,omitempty"`
+	Exclude       *Exclude      `json:"exclude,omitempty"`  // 全ての検索クエリの結果に使う除外の条件
+	Retention     Retention     `json:"retention,omitzero"` // 統合フィードに残す動画の指定。名前付きフィードの既定値にもなる
 	System        System        `json:"-"`
+
+	blocklists *blocklistLoader // 読み込んだブロックリスト
 }
 
+// AllSearchQueries トップレベルと全フィードの検索クエリを重複なしで返す。出現順は維持する
+func (c *Config) AllSearchQueries() []SearchQuery {
+	seen := make(map[string]struct{})
+	result := make([]SearchQuery, 0, len(c.SearchQueries))
+	add := func(queries []SearchQuery) {
+		for _, q := range queries {
+			if _, exists := seen[q.Key()]; exists {
+				continue
+			}
+			seen[q.Key()] = struct{}{}
+			result = append(result, q)
+		}
+	}
+
+	add(c.SearchQueries)
+	for _, f := range c.Feeds {
+		add(f.SearchQueries)
+	}
+	return result
+}
+
+var feedNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
 // LoadConfig 設定ファイルを読み込み、検証して返す。
 func LoadConfig(path string) (*Config, error) {
 	data, err := os.ReadFile(path)
@@ -45,14 +156,121 @@ func LoadConfig(path string) (*Config, error) {
 		return nil, fmt.Errorf("logはdebug/info/errorのいずれかである必要があります。")
 	}
 
-	for i := range cfg.SearchQueries {
-		trimmed := strings.TrimSpace(cfg.SearchQueries[i].Query)
-		if trimmed == "" {
-			return nil, fmt.Errorf("検索タグ内容を空にすることはできません。APIガイドを参照してください(https://site.nicovideo.jp/search-api-docs/snapshot)。(任意のfilters併用は未対応です)")
+	cfg.blocklists = newBlocklistLoader(filepath.Dir(path))
+	if err := cfg.Exclude.normalize(cfg.blocklists); err != nil {
+		return nil, err
+	}
+	if err := validateSearchQueries(cfg.SearchQueries, cfg.blocklists); err != nil {
+		return nil, err
+	}
+
+	cfg.Retention = cfg.Retention.inherit(Retention{MaxItems: DefaultCapacity})
+	if err := cfg.Retention.validate(); err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]struct{}, len(cfg.Feeds))
+	for i := range cfg.Feeds {
+		f := &cfg.Feeds[i]
+		f.Name = strings.TrimSpace(f.Name)
+		if !feedNamePattern.MatchString(f.Name) {
+			return nil, fmt.Errorf("feeds[%d]: フィード名は英数字・ハイフン・アンダースコアのみで構成する必要があります: %q", i, f.Name)
+		}
+		if _, exists := names[f.Name]; exists {
+			return nil, fmt.Errorf("feeds[%d]: フィード名が重複しています: %q", i, f.Name)
+		}
+		names[f.Name] = struct{}{}
+
+		if len(f.SearchQueries) == 0 {
+			return nil, fmt.Errorf("feeds[%d](%s): 検索クエリが1件もありません", i, f.Name)
+		}
+		if err := validateSearchQueries(f.SearchQueries, cfg.blocklists); err != nil {
+			return nil, fmt.Errorf("feeds[%d](%s): %w", i, f.Name, err)
+		}
+
+		if f.Capacity < 0 {
+			return nil, fmt.Errorf("feeds[%d](%s): capacityは0以上である必要があります(0で既定値%d)", i, f.Name, cfg.Retention.MaxItems)
+		}
+		if f.Capacity > 0 && f.Retention.MaxItems > 0 && f.Capacity != f.Retention.MaxItems {
+			return nil, fmt.Errorf("feeds[%d](%s): capacityとretention.maxItemsが異なります。retention.maxItemsのみを指定してください", i, f.Name)
+		}
+		if f.Retention.MaxItems == 0 {
+			f.Retention.MaxItems = f.Capacity
 		}
-		cfg.SearchQueries[i].Query = trimmed
+		f.Retention = f.Retention.inherit(cfg.Retention)
+		if err := f.Retention.validate(); err != nil {
+			return nil, fmt.Errorf("feeds[%d](%s): %w", i, f.Name, err)
+		}
+		f.Capacity = f.Retention.MaxItems
+		if err := validateQuotas(f.SearchQueries, f.Capacity); err != nil {
+			return nil, fmt.Errorf("feeds[%d](%s): %w", i, f.Name, err)
+		}
+	}
+	// 統合フィードには全てのクエリが載る
+	if err := validateQuotas(cfg.AllSearchQueries(), cfg.Retention.MaxItems); err != nil {
+		return nil, fmt.Errorf("統合フィード: %w", err)
+	}
+
+	if _, err := cfg.Notifications.rules(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Thumbnail.normalize(filepath.Dir(path)); err != nil {
+		return nil, err
 	}
 
 	cfg.System.Version = "1.0.0"
 	return &cfg, nil
 }
+
+// validateSearchQueries 検索クエリを検証し、前後の空白を取り除く。除外の条件で参照するブロックリストはloaderで読み込む
+func validateSearchQueries(queries []SearchQuery, loader *blocklistLoader) error {
+	for i := range queries {
+		q := &queries[i]
+		q.Query = strings.TrimSpace(q.Query)
+
+		if err := validateFilters(q.Filters); err != nil {
+			return fmt.Errorf("searchQueries[%d]: %w", i, err)
+		}
+		if len(q.JSONFilter) > 0 {
+			normalized, err := normalizeJSONFilter(q.JSONFilter)
+			if err != nil {
+				return fmt.Errorf("searchQueries[%d]: %w", i, err)
+			}
+			q.JSONFilter = normalized
+		}
+
+		if err := validateSearchParams(q); err != nil {
+			return fmt.Errorf("searchQueries[%d]: %w", i, err)
+		}
+		if err := q.Exclude.normalize(loader); err != nil {
+			return fmt.Errorf("searchQueries[%d]: %w", i, err)
+		}
+		if err := q.compileWhere(); err != nil {
+			return fmt.Errorf("searchQueries[%d]: %w", i, err)
+		}
+		if q.MinItems < 0 || q.MaxItems < 0 {
+			return fmt.Errorf("searchQueries[%d]: minItems・maxItemsは0以上である必要があります(0で指定なし)", i)
+		}
+		if q.MaxItems > 0 && q.MinItems > q.MaxItems {
+			return fmt.Errorf("searchQueries[%d]: minItems(%d)がmaxItems(%d)を超えています", i, q.MinItems, q.MaxItems)
+		}
+
+		// キーワードなし検索はfiltersかjsonFilterで絞り込む場合のみ許可する
+		if q.Query == "" && len(q.Filters) == 0 && len(q.JSONFilter) == 0 {
+			return fmt.Errorf("searchQueries[%d]: 検索タグ内容を空にすることはできません(filtersかjsonFilterを指定する場合を除く)。APIガイドを参照してください(https://site.nicovideo.jp/search-api-docs/snapshot)。", i)
+		}
+	}
+	return nil
+}
+
+// validateQuotas 1つのフィードに載るクエリのminItemsの合計が規定数を超えないことを検証する
+func validateQuotas(queries []SearchQuery, capacity int) error {
+	total := 0
+	for _, q := range queries {
+		total += q.MinItems
+	}
+	if total > capacity {
+		return fmt.Errorf("minItemsの合計(%d)がフィードの規定数(%d)を超えています", total, capacity)
+	}
+	return nil
+}
@@ -1,9 +1,12 @@
 package config
 
 import (
+	"nicovideoRSSDIY/internal/repository"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestLoadConfig_Success(t *testing.T) {
@@ -62,6 +65,222 @@ func TestLoadConfig_DefaultLogUsed(t *testing.T) {
 	}
 }
 
+func TestLoadConfig_Feeds(t *testing.T) {
+	path := writeConfigTempFile(t, `{
+	    "searchQueries": [{"query": "VOCALOID"}],
+	    "feeds": [
+	        {"name": "talk", "searchQueries": [{"query": " ソフトウェアトーク劇場 "}, {"query": "VOCALOID"}], "capacity": 50},
+	        {"name": "mmd", "searchQueries": [{"query": "MMD"}]}
+	    ]
+	}`)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+
+	if cfg.Feeds[0].Capacity != 50 {
+		t.Fatalf("expected capacity 50, got %d", cfg.Feeds[0].Capacity)
+	}
+	if cfg.Feeds[1].Capacity != DefaultCapacity {
+		t.Fatalf("expected default capacity %d, got %d", DefaultCapacity, cfg.Feeds[1].Capacity)
+	}
+	if cfg.Feeds[0].SearchQueries[0].Query != "ソフトウェアトーク劇場" {
+		t.Fatalf("expected trimmed feed query, got %q", cfg.Feeds[0].SearchQueries[0].Query)
+	}
+
+	// VOCALOIDはトップレベルとtalkの両方にあるが1回だけ数える
+	all := cfg.AllSearchQueries()
+	if len(all) != 3 {
+		t.Fatalf("expected 3 unique queries, got %d", len(all))
+	}
+	if all[0].Query != "VOCALOID" || all[1].Query != "ソフトウェアトーク劇場" || all[2].Query != "MMD" {
+		t.Fatalf("unexpected query order: %+v", all)
+	}
+}
+
+func TestLoadConfig_InvalidFeeds(t *testing.T) {
+	cases := map[string]string{
+		"duplicate_name": `{"feeds": [{"name": "a", "searchQueries": [{"query": "x"}]}, {"name": "a", "searchQueries": [{"query": "y"}]}]}`,
+		"invalid_name":   `{"feeds": [{"name": "a/b", "searchQueries": [{"query": "x"}]}]}`,
+		"empty_name":     `{"feeds": [{"name": "", "searchQueries": [{"query": "x"}]}]}`,
+		"no_queries":     `{"feeds": [{"name": "a", "searchQueries": []}]}`,
+		"empty_query":    `{"feeds": [{"name": "a", "searchQueries": [{"query": " "}]}]}`,
+		"negative_cap":   `{"feeds": [{"name": "a", "searchQueries": [{"query": "x"}], "capacity": -1}]}`,
+	}
+	for name, content := range cases {
+		t.Run(name, func(t *testing.T) {
+			path := writeConfigTempFile(t, content)
+			if _, err := LoadConfig(path); err == nil {
+				t.Fatalf("expected error")
+			}
+		})
+	}
+}
+
+func TestLoadConfig_Filters(t *testing.T) {
+	path := writeConfigTempFile(t, `{
+	    "searchQueries": [
+	        {"query": "", "filters": {"userId": {"0": 12345, "1": "67890"}, "lengthSeconds": {"gte": 60}}},
+	        {"query": "VOCALOID", "jsonFilter": {
+	            "type": "or",
+	            "filters": [
+	                {"type": "equal", "field": "channelId", "value": 2632720},
+	                {"type": "range", "field": "viewCounter", "from": 1000, "include_lower": true}
+	            ]
+	        }}
+	    ]
+	}`)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+
+	got := cfg.SearchQueries[0].FilterStrings()
+	want := []string{"[lengthSeconds][gte]=60", "[userId][0]=12345", "[userId][1]=67890"}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+
+	// jsonFilterはキー順が正規化される
+	wantJSON := `{"filters":[{"field":"channelId","type":"equal","value":2632720},{"field":"viewCounter","from":1000,"include_lower":true,"type":"range"}],"type":"or"}`
+	if string(cfg.SearchQueries[1].JSONFilter) != wantJSON {
+		t.Fatalf("expected normalized jsonFilter %s, got %s", wantJSON, cfg.SearchQueries[1].JSONFilter)
+	}
+
+	// filtersが異なれば同じqでも別のクエリとして扱う
+	if cfg.SearchQueries[0].Key() == (SearchQuery{}).Key() || cfg.SearchQueries[1].Key() == "VOCALOID" {
+		t.Fatalf("expected keys to include filters")
+	}
+}
+
+func TestLoadConfig_InvalidFilters(t *testing.T) {
+	cases := map[string]string{
+		"unknown_field":     `{"searchQueries": [{"query": "x", "filters": {"foo": {"0": 1}}}]}`,
+		"start_time":        `{"searchQueries": [{"query": "x", "filters": {"startTime": {"gte": "2025-01-01T00:00:00+09:00"}}}]}`,
+		"invalid_op":        `{"searchQueries": [{"query": "x", "filters": {"userId": {"eq": 1}}}]}`,
+		"object_value":      `{"searchQueries": [{"query": "x", "filters": {"userId": {"0": {"a": 1}}}}]}`,
+		"empty_query":       `{"searchQueries": [{"query": ""}]}`,
+		"json_not_object":   `{"searchQueries": [{"query": "x", "jsonFilter": []}]}`,
+		"json_unknown_type": `{"searchQueries": [{"query": "x", "jsonFilter": {"type": "xor"}}]}`,
+		"json_no_value":     `{"searchQueries": [{"query": "x", "jsonFilter": {"type": "equal", "field": "userId"}}]}`,
+		"json_nested_field": `{"searchQueries": [{"query": "x", "jsonFilter": {"type": "not", "filter": {"type": "range", "field": "foo", "from": 1}}}]}`,
+		"json_no_range":     `{"searchQueries": [{"query": "x", "jsonFilter": {"type": "range", "field": "viewCounter"}}]}`,
+	}
+	for name, content := range cases {
+		t.Run(name, func(t *testing.T) {
+			path := writeConfigTempFile(t, content)
+			if _, err := LoadConfig(path); err == nil {
+				t.Fatalf("expected error")
+			}
+		})
+	}
+}
+
+func TestLoadConfig_SearchParams(t *testing.T) {
+	path := writeConfigTempFile(t, `{
+	    "searchQueries": [
+	        {"query": "VOCALOID", "targets": ["tags", "title", "description", "tags"], "sort": "-viewCounter", "limit": 50, "fields": ["likeCounter", "viewCounter"]},
+	        {"query": "VOCALOID"}
+	    ]
+	}`)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+
+	q := cfg.SearchQueries[0]
+	if len(q.Targets) != 3 || q.Targets[0] != "description" || q.Targets[2] != "title" {
+		t.Fatalf("expected deduplicated sorted targets, got %v", q.Targets)
+	}
+	if q.Sort != "-viewCounter" || q.Limit != 50 || len(q.Fields) != 2 {
+		t.Fatalf("unexpected search params: %+v", q)
+	}
+	if q.Key() == cfg.SearchQueries[1].Key() {
+		t.Fatalf("expected different keys for different search params")
+	}
+	if len(cfg.AllSearchQueries()) != 2 {
+		t.Fatalf("expected 2 unique queries, got %d", len(cfg.AllSearchQueries()))
+	}
+	if q.NewestFirst() || !cfg.SearchQueries[1].NewestFirst() {
+		t.Fatalf("unexpected NewestFirst result")
+	}
+}
+
+func TestLoadConfig_InvalidSearchParams(t *testing.T) {
+	cases := map[string]string{
+		"unknown_target": `{"searchQueries": [{"query": "x", "targets": ["body"]}]}`,
+		"unknown_sort":   `{"searchQueries": [{"query": "x", "sort": "-random"}]}`,
+		"double_sign":    `{"searchQueries": [{"query": "x", "sort": "--viewCounter"}]}`,
+		"limit_over":     `{"searchQueries": [{"query": "x", "limit": 101}]}`,
+		"limit_negative": `{"searchQueries": [{"query": "x", "limit": -1}]}`,
+		"unknown_field":  `{"searchQueries": [{"query": "x", "fields": ["secret"]}]}`,
+	}
+	for name, content := range cases {
+		t.Run(name, func(t *testing.T) {
+			path := writeConfigTempFile(t, content)
+			if _, err := LoadConfig(path); err == nil {
+				t.Fatalf("expected error")
+			}
+		})
+	}
+}
+
+func TestLoadConfig_Notifications(t *testing.T) {
+	path := writeConfigTempFile(t, `{
+	    "searchQueries": [{"query": "foo"}],
+	    "notifications": {
+	        "minLevel": "error",
+	        "default": "notifications",
+	        "levels": {"error": "feed"},
+	        "kinds": {"thumbnail": "log"}
+	    }
+	}`)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+
+	rules := cfg.Notifications.Rules()
+	if got := rules.Route(repository.NotificationInfo, repository.NotificationKindPaused); got != repository.RouteLog {
+		t.Fatalf("expected info below minLevel to be log, got %s", got)
+	}
+	if got := rules.Route(repository.NotificationError, repository.NotificationKindSearch); got != repository.RouteFeed {
+		t.Fatalf("expected error to be feed, got %s", got)
+	}
+	if got := rules.Route(repository.NotificationError, repository.NotificationKindThumbnail); got != repository.RouteLog {
+		t.Fatalf("expected thumbnail to be log, got %s", got)
+	}
+
+	// 省略時は全てフィードへ
+	var empty Notifications
+	if got := empty.Rules().Route(repository.NotificationInfo, repository.NotificationKindStartup); got != repository.RouteFeed {
+		t.Fatalf("expected default route feed, got %s", got)
+	}
+}
+
+func TestLoadConfig_InvalidNotifications(t *testing.T) {
+	cases := map[string]string{
+		"min_level":     `{"notifications": {"minLevel": "warn"}}`,
+		"default_route": `{"notifications": {"default": "mail"}}`,
+		"level_key":     `{"notifications": {"levels": {"debug": "log"}}}`,
+		"kind_key":      `{"notifications": {"kinds": {"unknown": "log"}}}`,
+		"kind_route":    `{"notifications": {"kinds": {"search": "slack"}}}`,
+	}
+	for name, content := range cases {
+		t.Run(name, func(t *testing.T) {
+			path := writeConfigTempFile(t, content)
+			if _, err := LoadConfig(path); err == nil {
+				t.Fatalf("expected error")
+			}
+		})
+	}
+}
+
 func writeConfigTempFile(t *testing.T, content string) string {
 	t.Helper()
 	path := filepath.Join(t.TempDir(), "config.json")
@@ -70,3 +289,319 @@ func writeConfigTempFile(t *testing.T, content string) string {
 	}
 	return path
 }
+
+func TestLoadConfig_Thumbnail(t *testing.T) {
+	path := writeConfigTempFile(t, `{"searchQueries": [{"query": "foo"}]}`)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+	if cfg.Thumbnail.Concurrency != DefaultThumbnailConcurrency || cfg.Thumbnail.RequestsPerSecond != DefaultThumbnailRequestsPerSecond {
+		t.Fatalf("expected default thumbnail settings, got %+v", cfg.Thumbnail)
+	}
+
+	path = writeConfigTempFile(t, `{"searchQueries": [{"query": "foo"}], "thumbnail": {"concurrency": 2, "requestsPerSecond": 0.5}}`)
+	cfg, err = LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+	if cfg.Thumbnail.Concurrency != 2 || cfg.Thumbnail.MinInterval() != 2*time.Second {
+		t.Fatalf("unexpected thumbnail settings: %+v (interval %s)", cfg.Thumbnail, cfg.Thumbnail.MinInterval())
+	}
+}
+
+func TestLoadConfig_ThumbnailCache(t *testing.T) {
+	path := writeConfigTempFile(t, `{"searchQueries": [{"query": "foo"}], "thumbnail": {"cache": {"publicBaseURL": "http://192.168.1.10:2525/"}}}`)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+	cache := cfg.Thumbnail.Cache
+	if cache == nil {
+		t.Fatalf("expected cache settings")
+	}
+	if cache.Dir != filepath.Join(filepath.Dir(path), DefaultThumbnailCacheDir) {
+		t.Fatalf("expected cache dir next to config file, got %q", cache.Dir)
+	}
+	if cache.PublicBaseURL != "http://192.168.1.10:2525" {
+		t.Fatalf("expected trailing slash trimmed, got %q", cache.PublicBaseURL)
+	}
+	if cache.MaxBytes() != DefaultThumbnailCacheMaxMegabytes<<20 || cache.MaxAge() != DefaultThumbnailCacheMaxAgeDays*24*time.Hour {
+		t.Fatalf("unexpected limits: %+v", cache)
+	}
+
+	// 省略時はキャッシュしない
+	path = writeConfigTempFile(t, `{"searchQueries": [{"query": "foo"}]}`)
+	if cfg, err := LoadConfig(path); err != nil || cfg.Thumbnail.Cache != nil {
+		t.Fatalf("expected no cache, got %+v, %v", cfg, err)
+	}
+}
+
+func TestLoadConfig_InvalidThumbnail(t *testing.T) {
+	cases := map[string]string{
+		"cache_base_url_scheme": `{"searchQueries": [{"query": "foo"}], "thumbnail": {"cache": {"publicBaseURL": "ftp://example.com"}}}`,
+		"cache_base_url_query":  `{"searchQueries": [{"query": "foo"}], "thumbnail": {"cache": {"publicBaseURL": "http://example.com/?a=1"}}}`,
+		"cache_max_megabytes":   `{"searchQueries": [{"query": "foo"}], "thumbnail": {"cache": {"maxMegabytes": -1}}}`,
+		"concurrency_negative":  `{"searchQueries": [{"query": "foo"}], "thumbnail": {"concurrency": -1}}`,
+		"concurrency_too_many":  `{"searchQueries": [{"query": "foo"}], "thumbnail": {"concurrency": 100}}`,
+		"rate_negative":         `{"searchQueries": [{"query": "foo"}], "thumbnail": {"requestsPerSecond": -1}}`,
+		"rate_too_high":         `{"searchQueries": [{"query": "foo"}], "thumbnail": {"requestsPerSecond": 50}}`,
+	}
+	for name, content := range cases {
+		t.Run(name, func(t *testing.T) {
+			path := writeConfigTempFile(t, content)
+			if _, err := LoadConfig(path); err == nil {
+				t.Fatalf("expected error")
+			}
+		})
+	}
+}
+
+func TestLoadConfig_Exclude(t *testing.T) {
+	path := writeConfigTempFile(t, `{
+	    "searchQueries": [
+	        {"query": "VOCALOID", "exclude": {"title": ["日刊トップテン"], "tags": [" 再うｐ "], "min": {"viewCounter": 100}}},
+	        {"query": "VOCALOID"}
+	    ],
+	    "exclude": {"userIds": [2, 1, 2], "blocklists": ["blocklist.txt"]}
+	}`)
+	blocklist := filepath.Join(filepath.Dir(path), "blocklist.txt")
+	if err := os.WriteFile(blocklist, []byte("# 共有のブロックリスト\n\ntag: 転載\nuser:3\nchannel: ch2600000\ndescription:(?i)reupload\n"), 0o600); err != nil {
+		t.Fatalf("write blocklist: %v", err)
+	}
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+	if got := cfg.WatchedFiles(); len(got) != 1 || got[0] != blocklist {
+		t.Fatalf("unexpected watched files: %v", got)
+	}
+	if ids := cfg.Exclude.UserIDs; len(ids) != 2 || ids[0] != 1 || ids[1] != 2 {
+		t.Fatalf("expected sorted unique user ids, got %v", ids)
+	}
+
+	// 除外の条件が異なるクエリは別のキーになる
+	withRules, plain := cfg.SearchQueries[0], cfg.SearchQueries[1]
+	if withRules.Key() == plain.Key() || plain.Key() != "VOCALOID" {
+		t.Fatalf("unexpected keys: %q, %q", withRules.Key(), plain.Key())
+	}
+
+	rules := cfg.ExcludeRules(withRules)
+	if len(rules.Title) != 1 || len(rules.Description) != 1 || rules.Min["viewCounter"] != 100 {
+		t.Fatalf("unexpected rules: %+v", rules)
+	}
+	for _, tag := range []string{"再うｐ", "転載"} {
+		if _, ok := rules.Tags[tag]; !ok {
+			t.Fatalf("expected tag %q in rules: %v", tag, rules.Tags)
+		}
+	}
+	if len(rules.UserIDs) != 3 || len(rules.ChannelIDs) != 1 {
+		t.Fatalf("unexpected uploader rules: %v, %v", rules.UserIDs, rules.ChannelIDs)
+	}
+	// 全体の条件のみ
+	if rules := cfg.ExcludeRules(plain); len(rules.Title) != 0 || len(rules.UserIDs) != 3 {
+		t.Fatalf("unexpected global rules: %+v", rules)
+	}
+}
+
+func TestLoadConfig_InvalidExclude(t *testing.T) {
+	cases := map[string]struct {
+		config    string
+		blocklist string
+	}{
+		"title_regexp":         {config: `{"searchQueries": [{"query": "foo", "exclude": {"title": ["("]}}]}`},
+		"tag_with_space":       {config: `{"searchQueries": [{"query": "foo"}], "exclude": {"tags": ["a b"]}}`},
+		"user_id":              {config: `{"searchQueries": [{"query": "foo"}], "exclude": {"userIds": [0]}}`},
+		"min_field":            {config: `{"searchQueries": [{"query": "foo", "exclude": {"min": {"title": 1}}}]}`},
+		"blocklist_missing":    {config: `{"searchQueries": [{"query": "foo"}], "exclude": {"blocklists": ["missing.txt"]}}`},
+		"blocklist_kind":       {config: `{"searchQueries": [{"query": "foo"}], "exclude": {"blocklists": ["blocklist.txt"]}}`, blocklist: "uploader:1\n"},
+		"blocklist_format":     {config: `{"searchQueries": [{"query": "foo"}], "exclude": {"blocklists": ["blocklist.txt"]}}`, blocklist: "tag\n"},
+		"blocklist_regexp":     {config: `{"searchQueries": [{"query": "foo"}], "exclude": {"blocklists": ["blocklist.txt"]}}`, blocklist: "title:[\n"},
+		"blocklist_channel":    {config: `{"searchQueries": [{"query": "foo"}], "exclude": {"blocklists": ["blocklist.txt"]}}`, blocklist: "channel:abc\n"},
+		"feed_query_blocklist": {config: `{"searchQueries": [{"query": "foo"}], "feeds": [{"name": "a", "searchQueries": [{"query": "bar", "exclude": {"blocklists": [""]}}]}]}`},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			path := writeConfigTempFile(t, tc.config)
+			if tc.blocklist != "" {
+				if err := os.WriteFile(filepath.Join(filepath.Dir(path), "blocklist.txt"), []byte("# comment\n"+tc.blocklist), 0o600); err != nil {
+					t.Fatalf("write blocklist: %v", err)
+				}
+			}
+			_, err := LoadConfig(path)
+			if err == nil {
+				t.Fatalf("expected error")
+			}
+			// ブロックリストの誤りは行番号付きで示す
+			if tc.blocklist != "" && !strings.Contains(err.Error(), "blocklist.txt:2:") {
+				t.Fatalf("expected line number in error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_Where(t *testing.T) {
+	path := writeConfigTempFile(t, `{
+	    "searchQueries": [
+	        {"query": "VOCALOID", "where": "tags has \"MMD\" and lengthSeconds > 120"},
+	        {"query": "VOCALOID", "where": ["tags has \"MMD\"", "  and not title matches \"(?i)test\""]},
+	        {"query": "VOCALOID", "where": "  "}
+	    ],
+	    "exclude": {"tags": ["転載"]}
+	}`)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+	if got := cfg.SearchQueries[1].Where; got != "tags has \"MMD\"\n  and not title matches \"(?i)test\"" {
+		t.Fatalf("expected lines joined, got %q", got)
+	}
+	if cfg.SearchQueries[0].Key() == cfg.SearchQueries[1].Key() || cfg.SearchQueries[2].Key() != "VOCALOID" {
+		t.Fatalf("unexpected keys: %q, %q, %q", cfg.SearchQueries[0].Key(), cfg.SearchQueries[1].Key(), cfg.SearchQueries[2].Key())
+	}
+
+	// 全体の除外の条件と合わせて使う
+	rules := cfg.ExcludeRules(cfg.SearchQueries[0])
+	if len(rules.Where) != 1 || len(rules.Tags) != 1 {
+		t.Fatalf("unexpected rules: %+v", rules)
+	}
+	if rules := cfg.ExcludeRules(cfg.SearchQueries[2]); len(rules.Where) != 0 {
+		t.Fatalf("expected no where for blank expression, got %+v", rules)
+	}
+}
+
+func TestLoadConfig_InvalidWhere(t *testing.T) {
+	cases := map[string]struct {
+		config string
+		want   string
+	}{
+		"unknown_field": {config: `{"searchQueries": [{"query": "foo", "where": "tags has \"MMD\" and size > 1"}]}`, want: "searchQueries[0]: where: 1行20列: "},
+		"multiline":     {config: `{"searchQueries": [{"query": "foo", "where": ["tags has \"MMD\"", "and (lengthSeconds > 1"]}]}`, want: "searchQueries[0]: where: 2行23列: "},
+		"feed_query":    {config: `{"searchQueries": [{"query": "foo"}], "feeds": [{"name": "a", "searchQueries": [{"query": "bar", "where": "title matches \"(\""}]}]}`, want: "where: 1行15列: "},
+		"type":          {config: `{"searchQueries": [{"query": "foo", "where": 1}]}`, want: "where"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			path := writeConfigTempFile(t, tc.config)
+			_, err := LoadConfig(path)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("expected error containing %q, got %v", tc.want, err)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_Quotas(t *testing.T) {
+	path := writeConfigTempFile(t, `{
+	    "searchQueries": [{"query": "VOCALOID", "maxItems": 150}],
+	    "feeds": [{"name": "talk", "capacity": 50, "searchQueries": [{"query": "ソフトウェアトーク旅行", "minItems": 20}]}]
+	}`)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+	// 件数の指定はキーに含めない
+	if cfg.SearchQueries[0].Key() != "VOCALOID" || cfg.Feeds[0].SearchQueries[0].Key() != "ソフトウェアトーク旅行" {
+		t.Fatalf("unexpected keys: %q, %q", cfg.SearchQueries[0].Key(), cfg.Feeds[0].SearchQueries[0].Key())
+	}
+}
+
+func TestLoadConfig_InvalidQuotas(t *testing.T) {
+	cases := map[string]string{
+		"negative":       `{"searchQueries": [{"query": "foo", "minItems": -1}]}`,
+		"min_over_max":   `{"searchQueries": [{"query": "foo", "minItems": 10, "maxItems": 5}]}`,
+		"feed_capacity":  `{"searchQueries": [{"query": "foo"}], "feeds": [{"name": "a", "capacity": 10, "searchQueries": [{"query": "bar", "minItems": 6}, {"query": "baz", "minItems": 5}]}]}`,
+		"merged_default": `{"searchQueries": [{"query": "foo", "minItems": 150}], "feeds": [{"name": "a", "searchQueries": [{"query": "bar", "minItems": 60}]}]}`,
+	}
+	for name, content := range cases {
+		t.Run(name, func(t *testing.T) {
+			path := writeConfigTempFile(t, content)
+			if _, err := LoadConfig(path); err == nil {
+				t.Fatalf("expected error")
+			}
+		})
+	}
+}
+
+func TestLoadConfig_Retention(t *testing.T) {
+	path := writeConfigTempFile(t, `{
+	    "searchQueries": [{"query": "VOCALOID"}],
+	    "retention": {"maxItems": 300, "maxAgeDays": 30},
+	    "feeds": [
+	        {"name": "talk", "searchQueries": [{"query": "ソフトウェアトーク旅行"}], "retention": {"maxAgeDays": 90, "minItems": 10}},
+	        {"name": "legacy", "searchQueries": [{"query": "MMD"}], "capacity": 50},
+	        {"name": "inherit", "searchQueries": [{"query": "UTAU"}]}
+	    ]
+	}`)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+
+	if cfg.Retention != (Retention{MaxItems: 300, MaxAgeDays: 30}) {
+		t.Fatalf("unexpected global retention: %+v", cfg.Retention)
+	}
+	if cfg.Feeds[0].Retention != (Retention{MaxItems: 300, MaxAgeDays: 90, MinItems: 10}) || cfg.Feeds[0].Capacity != 300 {
+		t.Fatalf("unexpected feed retention: %+v", cfg.Feeds[0])
+	}
+	// capacityはretention.maxItemsとして扱う
+	if cfg.Feeds[1].Retention != (Retention{MaxItems: 50, MaxAgeDays: 30}) {
+		t.Fatalf("unexpected legacy capacity: %+v", cfg.Feeds[1].Retention)
+	}
+	if cfg.Feeds[2].Retention != cfg.Retention {
+		t.Fatalf("expected the global retention, got %+v", cfg.Feeds[2].Retention)
+	}
+	if cfg.Feeds[0].Retention.MaxAge() != 90*24*time.Hour {
+		t.Fatalf("unexpected max age: %s", cfg.Feeds[0].Retention.MaxAge())
+	}
+
+	// -1で全体の指定を引き継がない
+	path = writeConfigTempFile(t, `{
+	    "searchQueries": [{"query": "VOCALOID"}],
+	    "retention": {"maxItems": 300, "maxAgeDays": 30, "minItems": 10},
+	    "feeds": [
+	        {"name": "archive", "searchQueries": [{"query": "MMD"}], "retention": {"maxAgeDays": -1, "minItems": -1}},
+	        {"name": "keep", "searchQueries": [{"query": "UTAU"}], "retention": {"minItems": -1}}
+	    ]
+	}`)
+	cfg, err = LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+	if cfg.Feeds[0].Retention != (Retention{MaxItems: 300}) || cfg.Feeds[0].Retention.MaxAge() != 0 {
+		t.Fatalf("expected unset max age and min items, got %+v", cfg.Feeds[0].Retention)
+	}
+	if cfg.Feeds[1].Retention != (Retention{MaxItems: 300, MaxAgeDays: 30}) {
+		t.Fatalf("expected unset min items, got %+v", cfg.Feeds[1].Retention)
+	}
+
+	// 省略時は200件・無期限
+	path = writeConfigTempFile(t, `{"searchQueries": [{"query": "VOCALOID"}]}`)
+	cfg, err = LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+	if cfg.Retention != (Retention{MaxItems: DefaultCapacity}) || cfg.Retention.MaxAge() != 0 {
+		t.Fatalf("unexpected default retention: %+v", cfg.Retention)
+	}
+}
+
+func TestLoadConfig_InvalidRetention(t *testing.T) {
+	cases := map[string]string{
+		"negative_age":       `{"searchQueries": [{"query": "foo"}], "retention": {"maxAgeDays": -2}}`,
+		"unset_max_items":    `{"searchQueries": [{"query": "foo"}], "retention": {"maxItems": -1}}`,
+		"min_over_max":       `{"searchQueries": [{"query": "foo"}], "retention": {"maxItems": 10, "minItems": 20}}`,
+		"feed_min_over_max":  `{"searchQueries": [{"query": "foo"}], "feeds": [{"name": "a", "searchQueries": [{"query": "bar"}], "retention": {"maxItems": 10, "minItems": 20}}]}`,
+		"capacity_conflict":  `{"searchQueries": [{"query": "foo"}], "feeds": [{"name": "a", "searchQueries": [{"query": "bar"}], "capacity": 50, "retention": {"maxItems": 60}}]}`,
+		"merged_quota_total": `{"searchQueries": [{"query": "foo", "minItems": 20}], "retention": {"maxItems": 10}}`,
+	}
+	for name, content := range cases {
+		t.Run(name, func(t *testing.T) {
+			path := writeConfigTempFile(t, content)
+			if _, err := LoadConfig(path); err == nil {
+				t.Fatalf("expected error")
+			}
+		})
+	}
+}
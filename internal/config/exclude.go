@@ -0,0 +1,231 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"maps"
+	"nicovideoRSSDIY/internal/filter"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Exclude 取得後の動画を除外する条件。全体(Config.Exclude)と検索クエリごと(SearchQuery.Exclude)に書け、両方の条件が使われる
+// いずれかの条件に当てはまる動画はフィードに追加しない
+type Exclude struct {
+	Title       []string       `json:"title,omitempty"`       // タイトルの正規表現
+	Description []string       `json:"description,omitempty"` // 説明文の正規表現
+	Tags        []string       `json:"tags,omitempty"`        // タグ(完全一致。大文字小文字を区別しない)
+	UserIDs     []int64        `json:"userIds,omitempty"`     // 投稿者のユーザーID
+	ChannelIDs  []int64        `json:"channelIds,omitempty"`  // チャンネルID
+	Min         map[string]int `json:"min,omitempty"`         // フィールド名(viewCounterなど) -> 下限。取得時点の値で判断する
+	Blocklists  []string       `json:"blocklists,omitempty"`  // 共有のブロックリストファイル。相対パスは設定ファイルのディレクトリから
+
+	rules *filter.Rules // LoadConfigで作成される。ブロックリストの内容を含む
+}
+
+// Rules 除外の条件を返す。LoadConfigで検証済みであることを前提とする。nilの場合は何も除外しない
+func (e *Exclude) Rules() *filter.Rules {
+	if e == nil {
+		return nil
+	}
+	return e.rules
+}
+
+// ExcludeRules 検索クエリの結果に使う除外の条件(全体とクエリごとの条件を合わせたもの)を返す
+// whereの条件式もここに含まれる
+func (c *Config) ExcludeRules(q SearchQuery) *filter.Rules {
+	rules := c.Exclude.Rules().Merge(q.Exclude.Rules())
+	if q.where != nil {
+		rules = rules.Merge(&filter.Rules{Where: []*filter.Expr{q.where}})
+	}
+	return rules
+}
+
+// WatchedFiles 設定ファイルの他に、更新されたら再読込すべきファイル(ブロックリスト)を返す
+func (c *Config) WatchedFiles() []string {
+	return c.blocklists.paths()
+}
+
+// blocklistLoader ブロックリストファイルを読み込む。同じファイルは1回だけ読む
+type blocklistLoader struct {
+	baseDir string
+	loaded  map[string]*Exclude
+}
+
+func newBlocklistLoader(baseDir string) *blocklistLoader {
+	return &blocklistLoader{baseDir: baseDir, loaded: make(map[string]*Exclude)}
+}
+
+// paths 読み込んだファイルのパスを返す。順序は安定している
+func (l *blocklistLoader) paths() []string {
+	if l == nil {
+		return nil
+	}
+	return slices.Sorted(maps.Keys(l.loaded))
+}
+
+// load pathのブロックリストを読み込む
+// 1行に1件、"種類:値"の形式で書く。種類はtitle・description(正規表現)、tag、user、channel。#から始まる行と空行は無視する
+func (l *blocklistLoader) load(path string) (*Exclude, error) {
+	if e, ok := l.loaded[path]; ok {
+		return e, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("ブロックリストを読み込めません: %w", err)
+	}
+	defer file.Close()
+
+	e := &Exclude{}
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kind, value, ok := strings.Cut(line, ":")
+		value = strings.TrimSpace(value)
+		if !ok || value == "" {
+			return nil, fmt.Errorf("%s:%d: \"種類:値\"の形式で書く必要があります: %q", path, lineNo, line)
+		}
+		switch strings.TrimSpace(kind) {
+		case "title", "description":
+			if _, err := regexp.Compile(value); err != nil {
+				return nil, fmt.Errorf("%s:%d: 正規表現の誤りです: %w", path, lineNo, err)
+			}
+			if strings.TrimSpace(kind) == "title" {
+				e.Title = append(e.Title, value)
+			} else {
+				e.Description = append(e.Description, value)
+			}
+		case "tag":
+			if strings.ContainsAny(value, " \t") {
+				return nil, fmt.Errorf("%s:%d: タグに空白は含められません: %q", path, lineNo, value)
+			}
+			e.Tags = append(e.Tags, value)
+		case "user":
+			id, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || id <= 0 {
+				return nil, fmt.Errorf("%s:%d: ユーザーIDは正の整数である必要があります: %q", path, lineNo, value)
+			}
+			e.UserIDs = append(e.UserIDs, id)
+		case "channel":
+			id, err := strconv.ParseInt(strings.TrimPrefix(value, "ch"), 10, 64)
+			if err != nil || id <= 0 {
+				return nil, fmt.Errorf("%s:%d: チャンネルIDは正の整数(chを付けても可)である必要があります: %q", path, lineNo, value)
+			}
+			e.ChannelIDs = append(e.ChannelIDs, id)
+		default:
+			return nil, fmt.Errorf("%s:%d: 未対応の種類です(title/description/tag/user/channel): %q", path, lineNo, kind)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("ブロックリストを読み込めません: %w", err)
+	}
+
+	l.loaded[path] = e
+	return e, nil
+}
+
+// normalize 条件を検証して並びを揃え、ブロックリストを読み込んで除外の条件を作成する
+func (e *Exclude) normalize(loader *blocklistLoader) error {
+	if e == nil {
+		return nil
+	}
+
+	blocklists := make([]*Exclude, 0, len(e.Blocklists))
+	for i, path := range e.Blocklists {
+		if strings.TrimSpace(path) == "" {
+			return fmt.Errorf("exclude.blocklists[%d]: パスが空です", i)
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(loader.baseDir, path)
+		}
+		e.Blocklists[i] = path
+		b, err := loader.load(path)
+		if err != nil {
+			return fmt.Errorf("exclude.blocklists[%d]: %w", i, err)
+		}
+		blocklists = append(blocklists, b)
+	}
+
+	rules, err := e.compile(blocklists)
+	if err != nil {
+		return fmt.Errorf("exclude.%w", err)
+	}
+	e.rules = rules
+
+	// Keyが安定するよう並びを揃える
+	for i, tag := range e.Tags {
+		e.Tags[i] = strings.TrimSpace(tag)
+	}
+	for _, list := range [][]string{e.Title, e.Description, e.Tags, e.Blocklists} {
+		slices.Sort(list)
+	}
+	e.Title = slices.Compact(e.Title)
+	e.Description = slices.Compact(e.Description)
+	e.Tags = slices.Compact(e.Tags)
+	e.Blocklists = slices.Compact(e.Blocklists)
+	slices.Sort(e.UserIDs)
+	e.UserIDs = slices.Compact(e.UserIDs)
+	slices.Sort(e.ChannelIDs)
+	e.ChannelIDs = slices.Compact(e.ChannelIDs)
+	return nil
+}
+
+// compile 条件とブロックリストの内容を合わせた除外の条件を作成する
+func (e *Exclude) compile(blocklists []*Exclude) (*filter.Rules, error) {
+	rules := &filter.Rules{
+		Tags:       make(map[string]struct{}),
+		UserIDs:    make(map[int64]struct{}),
+		ChannelIDs: make(map[int64]struct{}),
+		Min:        make(map[string]int, len(e.Min)),
+	}
+	for field, threshold := range e.Min {
+		if _, ok := filter.Counters[field]; !ok {
+			return nil, fmt.Errorf("min: 未対応のフィールドです(%s): %q", strings.Join(slices.Sorted(maps.Keys(filter.Counters)), "/"), field)
+		}
+		rules.Min[field] = threshold
+	}
+
+	for _, src := range append([]*Exclude{e}, blocklists...) {
+		for i, pattern := range src.Title {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("title[%d]: 正規表現の誤りです: %w", i, err)
+			}
+			rules.Title = append(rules.Title, re)
+		}
+		for i, pattern := range src.Description {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("description[%d]: 正規表現の誤りです: %w", i, err)
+			}
+			rules.Description = append(rules.Description, re)
+		}
+		for i, tag := range src.Tags {
+			if filter.NormalizeTag(tag) == "" || strings.ContainsAny(strings.TrimSpace(tag), " \t") {
+				return nil, fmt.Errorf("tags[%d]: タグが空か空白を含んでいます: %q", i, tag)
+			}
+			rules.Tags[filter.NormalizeTag(tag)] = struct{}{}
+		}
+		for i, id := range src.UserIDs {
+			if id <= 0 {
+				return nil, fmt.Errorf("userIds[%d]: 正の整数である必要があります", i)
+			}
+			rules.UserIDs[id] = struct{}{}
+		}
+		for i, id := range src.ChannelIDs {
+			if id <= 0 {
+				return nil, fmt.Errorf("channelIds[%d]: 正の整数である必要があります", i)
+			}
+			rules.ChannelIDs[id] = struct{}{}
+		}
+	}
+	return rules, nil
+}
@@ -0,0 +1,137 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// filterFields filters・jsonFilterに指定できるフィールド
+// https://site.nicovideo.jp/search-api-docs/snapshot
+var filterFields = map[string]struct{}{
+	"contentId":       {},
+	"tags":            {},
+	"categoryTags":    {},
+	"genre":           {},
+	"genre.keyword":   {},
+	"viewCounter":     {},
+	"mylistCounter":   {},
+	"likeCounter":     {},
+	"lengthSeconds":   {},
+	"startTime":       {},
+	"commentCounter":  {},
+	"lastCommentTime": {},
+	"userId":          {},
+	"channelId":       {},
+}
+
+// validateFilters filtersのフィールド名・演算子・値を検証する
+// startTimeは更新範囲の指定に使うためfiltersでは指定できない(jsonFilterでは可能)
+func validateFilters(filters map[string]map[string]FilterValue) error {
+	for field, ops := range filters {
+		if _, ok := filterFields[field]; !ok {
+			return fmt.Errorf("filters: 未対応のフィールドです: %q", field)
+		}
+		if field == "startTime" {
+			return fmt.Errorf("filters: startTimeは更新範囲の指定に使われるため指定できません。jsonFilterを使用してください")
+		}
+		if len(ops) == 0 {
+			return fmt.Errorf("filters[%s]: 条件がありません", field)
+		}
+		for op, value := range ops {
+			switch op {
+			case "gt", "gte", "lt", "lte":
+			default:
+				if n, err := strconv.Atoi(op); err != nil || n < 0 {
+					return fmt.Errorf("filters[%s]: 演算子はgt/gte/lt/lteまたは0以上の番号である必要があります: %q", field, op)
+				}
+			}
+			if value == "" {
+				return fmt.Errorf("filters[%s][%s]: 値が空です", field, op)
+			}
+		}
+	}
+	return nil
+}
+
+// normalizeJSONFilter jsonFilterを検証し、キー順を揃えた形にして返す
+func normalizeJSONFilter(raw json.RawMessage) (json.RawMessage, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var node any
+	if err := dec.Decode(&node); err != nil {
+		return nil, fmt.Errorf("jsonFilter: 解析に失敗しました: %w", err)
+	}
+	if err := validateJSONFilterNode(node, "jsonFilter"); err != nil {
+		return nil, err
+	}
+
+	normalized, err := json.Marshal(node)
+	if err != nil {
+		return nil, fmt.Errorf("jsonFilter: %w", err)
+	}
+	return normalized, nil
+}
+
+// validateJSONFilterNode jsonFilterの1ノードを再帰的に検証する。pathはエラー表示用
+func validateJSONFilterNode(node any, path string) error {
+	obj, ok := node.(map[string]any)
+	if !ok {
+		return fmt.Errorf("%s: オブジェクトである必要があります", path)
+	}
+
+	typ, _ := obj["type"].(string)
+	switch typ {
+	case "or", "and":
+		children, ok := obj["filters"].([]any)
+		if !ok || len(children) == 0 {
+			return fmt.Errorf("%s: type %sにはfiltersの配列が必要です", path, typ)
+		}
+		for i, child := range children {
+			if err := validateJSONFilterNode(child, fmt.Sprintf("%s.filters[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case "not":
+		child, ok := obj["filter"]
+		if !ok {
+			return fmt.Errorf("%s: type notにはfilterが必要です", path)
+		}
+		return validateJSONFilterNode(child, path+".filter")
+	case "equal":
+		if err := validateJSONFilterField(obj, path); err != nil {
+			return err
+		}
+		if _, ok := obj["value"]; !ok {
+			return fmt.Errorf("%s: type equalにはvalueが必要です", path)
+		}
+	case "range":
+		if err := validateJSONFilterField(obj, path); err != nil {
+			return err
+		}
+		_, hasFrom := obj["from"]
+		_, hasTo := obj["to"]
+		if !hasFrom && !hasTo {
+			return fmt.Errorf("%s: type rangeにはfromかtoが必要です", path)
+		}
+		for _, key := range []string{"include_lower", "include_upper"} {
+			if v, ok := obj[key]; ok {
+				if _, isBool := v.(bool); !isBool {
+					return fmt.Errorf("%s: %sは真偽値である必要があります", path, key)
+				}
+			}
+		}
+	default:
+		return fmt.Errorf("%s: typeはor/and/not/equal/rangeのいずれかである必要があります: %q", path, typ)
+	}
+	return nil
+}
+
+func validateJSONFilterField(obj map[string]any, path string) error {
+	field, _ := obj["field"].(string)
+	if _, ok := filterFields[field]; !ok {
+		return fmt.Errorf("%s: 未対応のフィールドです: %q", path, field)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package config
+
+import (
+	"fmt"
+	"nicovideoRSSDIY/internal/repository"
+	"slices"
+)
+
+// Notifications フィードへの通知の振り分け設定。省略時は全ての通知をフィードへ送る
+type Notifications struct {
+	MinLevel string            `json:"minLevel,omitempty"` // これ未満のレベルの通知はログのみ(info/error)
+	Default  string            `json:"default,omitempty"`  // 送り先の既定値(feed/log/notifications/drop)
+	Levels   map[string]string `json:"levels,omitempty"`   // レベル -> 送り先
+	Kinds    map[string]string `json:"kinds,omitempty"`    // 通知の種類 -> 送り先
+}
+
+// Rules 振り分け規則にする。LoadConfigで検証済みであることを前提とする
+func (n Notifications) Rules() repository.NotificationRules {
+	rules, _ := n.rules()
+	return rules
+}
+
+func (n Notifications) rules() (repository.NotificationRules, error) {
+	rules := repository.NotificationRules{
+		MinLevel: repository.NotificationInfo,
+		Default:  repository.RouteFeed,
+		Levels:   make(map[repository.NotificationLevel]repository.NotificationRoute, len(n.Levels)),
+		Kinds:    make(map[repository.NotificationKind]repository.NotificationRoute, len(n.Kinds)),
+	}
+
+	if n.MinLevel != "" {
+		level, err := repository.ParseNotificationLevel(n.MinLevel)
+		if err != nil {
+			return rules, fmt.Errorf("notifications.minLevel: %w", err)
+		}
+		rules.MinLevel = level
+	}
+	if n.Default != "" {
+		route, err := repository.ParseNotificationRoute(n.Default)
+		if err != nil {
+			return rules, fmt.Errorf("notifications.default: %w", err)
+		}
+		rules.Default = route
+	}
+	for levelStr, routeStr := range n.Levels {
+		level, err := repository.ParseNotificationLevel(levelStr)
+		if err != nil {
+			return rules, fmt.Errorf("notifications.levels: %w", err)
+		}
+		route, err := repository.ParseNotificationRoute(routeStr)
+		if err != nil {
+			return rules, fmt.Errorf("notifications.levels.%s: %w", levelStr, err)
+		}
+		rules.Levels[level] = route
+	}
+	for kindStr, routeStr := range n.Kinds {
+		kind := repository.NotificationKind(kindStr)
+		if !slices.Contains(repository.NotificationKinds, kind) {
+			return rules, fmt.Errorf("notifications.kinds: 未対応の通知の種類です: %q (%v)", kindStr, repository.NotificationKinds)
+		}
+		route, err := repository.ParseNotificationRoute(routeStr)
+		if err != nil {
+			return rules, fmt.Errorf("notifications.kinds.%s: %w", kindStr, err)
+		}
+		rules.Kinds[kind] = route
+	}
+	return rules, nil
+}
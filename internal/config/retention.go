@@ -0,0 +1,57 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultSearchWindow 保持期間が無い(またはminItemsで期間を過ぎた動画も残す)フィードのクエリを、初回に遡って検索する期間
+const DefaultSearchWindow = 365 * 24 * time.Hour
+
+// RetentionUnset maxAgeDays・minItemsに書くと、全体の指定を引き継がず指定なし(無期限・0件)にする
+const RetentionUnset = -1
+
+// Retention フィードに残す動画の指定。全体(Config.Retention)とフィードごと(Feed.Retention)に書ける
+// 全体の指定は統合フィードに使われ、名前付きフィードでは省略した項目の既定値になる
+type Retention struct {
+	MaxItems   int `json:"maxItems,omitempty"`   // 最大数(省略時: 200)
+	MaxAgeDays int `json:"maxAgeDays,omitempty"` // 投稿からこの日数を過ぎた動画は削除する(省略時: 無期限。-1で無期限)
+	MinItems   int `json:"minItems,omitempty"`   // maxAgeDaysを過ぎても新しい順にこの件数は残す(-1で0件)
+}
+
+// MaxAge 保持期間を返す。0は無期限
+func (r Retention) MaxAge() time.Duration {
+	return time.Duration(r.MaxAgeDays) * 24 * time.Hour
+}
+
+// inherit 省略された項目をbaseの値にしたものを返す。RetentionUnsetの項目はbaseによらず0にする
+func (r Retention) inherit(base Retention) Retention {
+	if r.MaxItems == 0 {
+		r.MaxItems = base.MaxItems
+	}
+	r.MaxAgeDays = inheritUnset(r.MaxAgeDays, base.MaxAgeDays)
+	r.MinItems = inheritUnset(r.MinItems, base.MinItems)
+	return r
+}
+
+// inheritUnset 0(省略)はbaseの値、RetentionUnsetは0にする
+func inheritUnset(value, base int) int {
+	switch value {
+	case 0:
+		return base
+	case RetentionUnset:
+		return 0
+	}
+	return value
+}
+
+// validate 値の範囲を検証する。省略された項目は既定値になっていることを前提とする
+func (r Retention) validate() error {
+	if r.MaxItems < 0 || r.MaxAgeDays < 0 || r.MinItems < 0 {
+		return fmt.Errorf("retention: maxItemsは0以上、maxAgeDays・minItemsは%d以上である必要があります(0で既定値、%dで指定なし)", RetentionUnset, RetentionUnset)
+	}
+	if r.MinItems > r.MaxItems {
+		return fmt.Errorf("retention: minItems(%d)がmaxItems(%d)を超えています", r.MinItems, r.MaxItems)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// searchTargets targetsに指定できるフィールド
+var searchTargets = map[string]struct{}{
+	"title":         {},
+	"description":   {},
+	"tags":          {},
+	"tagsExact":     {},
+	"lockTagsExact": {},
+	"genre":         {},
+	"genre.keyword": {},
+}
+
+// sortFields _sortに指定できるフィールド
+var sortFields = map[string]struct{}{
+	"viewCounter":     {},
+	"mylistCounter":   {},
+	"likeCounter":     {},
+	"lengthSeconds":   {},
+	"startTime":       {},
+	"commentCounter":  {},
+	"lastCommentTime": {},
+}
+
+// resultFields fieldsに指定できるフィールド
+var resultFields = map[string]struct{}{
+	"contentId":       {},
+	"title":           {},
+	"description":     {},
+	"userId":          {},
+	"channelId":       {},
+	"viewCounter":     {},
+	"mylistCounter":   {},
+	"likeCounter":     {},
+	"lengthSeconds":   {},
+	"thumbnailUrl":    {},
+	"startTime":       {},
+	"lastResBody":     {},
+	"commentCounter":  {},
+	"lastCommentTime": {},
+	"categoryTags":    {},
+	"tags":            {},
+	"tagsExact":       {},
+	"genre":           {},
+	"genre.keyword":   {},
+}
+
+// MaxLimit 1回の検索で取得できる件数の上限
+const MaxLimit = 100
+
+// validateSearchParams targets, sort, limit, fieldsを検証し、targetsとfieldsは重複を除いて並べ替える
+func validateSearchParams(q *SearchQuery) error {
+	targets, err := normalizeFieldList(q.Targets, searchTargets, "targets")
+	if err != nil {
+		return err
+	}
+	q.Targets = targets
+
+	q.Sort = strings.TrimSpace(q.Sort)
+	if q.Sort != "" {
+		field := strings.TrimLeft(q.Sort, "+-")
+		if _, ok := sortFields[field]; !ok || len(q.Sort)-len(field) > 1 {
+			return fmt.Errorf("sort: 未対応の並び順です: %q", q.Sort)
+		}
+	}
+
+	if q.Limit < 0 || q.Limit > MaxLimit {
+		return fmt.Errorf("limit: 1～%dである必要があります(0で既定値)", MaxLimit)
+	}
+
+	fields, err := normalizeFieldList(q.Fields, resultFields, "fields")
+	if err != nil {
+		return err
+	}
+	q.Fields = fields
+	return nil
+}
+
+// normalizeFieldList フィールド名の一覧を検証し、重複を除いて並べ替えたものを返す
+func normalizeFieldList(list []string, allowed map[string]struct{}, name string) ([]string, error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+	seen := make(map[string]struct{}, len(list))
+	result := make([]string, 0, len(list))
+	for _, f := range list {
+		f = strings.TrimSpace(f)
+		if _, ok := allowed[f]; !ok {
+			return nil, fmt.Errorf("%s: 未対応のフィールドです: %q", name, f)
+		}
+		if _, exists := seen[f]; exists {
+			continue
+		}
+		seen[f] = struct{}{}
+		result = append(result, f)
+	}
+	sort.Strings(result)
+	return result, nil
+}
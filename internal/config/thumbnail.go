@@ -0,0 +1,117 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultThumbnailConcurrency サムネイル画像情報を同時に取得する数の既定値
+	DefaultThumbnailConcurrency = 4
+	// DefaultThumbnailRequestsPerSecond サムネイル画像情報を1秒間に取得する数の上限の既定値
+	DefaultThumbnailRequestsPerSecond = 4.0
+
+	maxThumbnailConcurrency       = 16
+	maxThumbnailRequestsPerSecond = 20.0
+
+	// DefaultThumbnailCacheDir サムネイルのキャッシュの保存先の既定値。設定ファイルのディレクトリからの相対パス
+	DefaultThumbnailCacheDir = "thumbnails"
+	// DefaultThumbnailCacheMaxMegabytes フィードから外れた動画のキャッシュを残す合計の大きさの既定値
+	DefaultThumbnailCacheMaxMegabytes = 100
+	// DefaultThumbnailCacheMaxAgeDays フィードから外れた動画のキャッシュを残す日数の既定値
+	DefaultThumbnailCacheMaxAgeDays = 7
+)
+
+// Thumbnail サムネイル画像情報(CDNへのHEADリクエスト)の取得方法。省略した項目はLoadConfigで既定値になる
+type Thumbnail struct {
+	Concurrency       int     `json:"concurrency,omitempty"`       // 同時に行うリクエストの上限(1～16)
+	RequestsPerSecond float64 `json:"requestsPerSecond,omitempty"` // 1秒間に開始するリクエストの上限(0より大きく20以下)
+	// Cache 指定した場合はサムネイル画像をディスクへ保存し、/thumb/{contentId}で配信する
+	Cache *ThumbnailCache `json:"cache,omitempty"`
+}
+
+// ThumbnailCache サムネイル画像のキャッシュの設定。省略した項目はLoadConfigで既定値になる
+type ThumbnailCache struct {
+	Dir           string `json:"dir,omitempty"`           // 保存先。相対パスは設定ファイルのディレクトリから。LoadConfigで絶対パスにされる
+	PublicBaseURL string `json:"publicBaseURL,omitempty"` // 指定した場合はフィードのサムネイルのURLを{publicBaseURL}/thumb/{contentId}にする
+	MaxMegabytes  int    `json:"maxMegabytes,omitempty"`  // フィードから外れた動画のキャッシュを残す合計の大きさ
+	MaxAgeDays    int    `json:"maxAgeDays,omitempty"`    // フィードから外れた動画のキャッシュを残す日数
+}
+
+// MaxBytes MaxMegabytesをバイト数で返す
+func (c ThumbnailCache) MaxBytes() int64 {
+	return int64(c.MaxMegabytes) << 20
+}
+
+// MaxAge MaxAgeDaysを期間で返す
+func (c ThumbnailCache) MaxAge() time.Duration {
+	return time.Duration(c.MaxAgeDays) * 24 * time.Hour
+}
+
+// normalize 省略された項目を既定値にして検証する。baseDirは設定ファイルのディレクトリ
+func (c *ThumbnailCache) normalize(baseDir string) error {
+	if c.Dir == "" {
+		c.Dir = DefaultThumbnailCacheDir
+	}
+	if !filepath.IsAbs(c.Dir) {
+		c.Dir = filepath.Join(baseDir, c.Dir)
+	}
+	if c.MaxMegabytes == 0 {
+		c.MaxMegabytes = DefaultThumbnailCacheMaxMegabytes
+	}
+	if c.MaxAgeDays == 0 {
+		c.MaxAgeDays = DefaultThumbnailCacheMaxAgeDays
+	}
+	if c.MaxMegabytes < 0 {
+		return fmt.Errorf("thumbnail.cache.maxMegabytes: 0以上である必要があります(0で既定値%d): %d", DefaultThumbnailCacheMaxMegabytes, c.MaxMegabytes)
+	}
+	if c.MaxAgeDays < 0 {
+		return fmt.Errorf("thumbnail.cache.maxAgeDays: 0以上である必要があります(0で既定値%d): %d", DefaultThumbnailCacheMaxAgeDays, c.MaxAgeDays)
+	}
+
+	if c.PublicBaseURL != "" {
+		u, err := url.Parse(c.PublicBaseURL)
+		if err != nil {
+			return fmt.Errorf("thumbnail.cache.publicBaseURL: URLとして解釈できません: %w", err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("thumbnail.cache.publicBaseURL: http(s)://から始まる絶対URLである必要があります: %q", c.PublicBaseURL)
+		}
+		if u.RawQuery != "" || u.Fragment != "" {
+			return fmt.Errorf("thumbnail.cache.publicBaseURL: クエリ・フラグメントは指定できません: %q", c.PublicBaseURL)
+		}
+		c.PublicBaseURL = strings.TrimRight(c.PublicBaseURL, "/")
+	}
+	return nil
+}
+
+// MinInterval リクエストを開始してから次のリクエストを開始するまでの最低間隔を返す
+func (t Thumbnail) MinInterval() time.Duration {
+	if t.RequestsPerSecond <= 0 {
+		return 0
+	}
+	return time.Duration(float64(time.Second) / t.RequestsPerSecond)
+}
+
+// normalize 省略された項目を既定値にして検証する。baseDirは設定ファイルのディレクトリ
+func (t *Thumbnail) normalize(baseDir string) error {
+	if t.Concurrency == 0 {
+		t.Concurrency = DefaultThumbnailConcurrency
+	}
+	if t.RequestsPerSecond == 0 {
+		t.RequestsPerSecond = DefaultThumbnailRequestsPerSecond
+	}
+	if t.Concurrency < 1 || t.Concurrency > maxThumbnailConcurrency {
+		return fmt.Errorf("thumbnail.concurrency: 1～%dである必要があります: %d", maxThumbnailConcurrency, t.Concurrency)
+	}
+	if t.RequestsPerSecond < 0 || t.RequestsPerSecond > maxThumbnailRequestsPerSecond {
+		return fmt.Errorf("thumbnail.requestsPerSecond: 0より大きく%g以下である必要があります: %g", maxThumbnailRequestsPerSecond, t.RequestsPerSecond)
+	}
+	if t.Cache != nil {
+		return t.Cache.normalize(baseDir)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"nicovideoRSSDIY/internal/filter"
+	"strings"
+)
+
+// Expression whereの条件式。JSONでは文字列のほか、複数行に分けて書けるよう文字列の配列(1要素が1行)でも書ける
+type Expression string
+
+func (e *Expression) UnmarshalJSON(data []byte) error {
+	var lines []string
+	if err := json.Unmarshal(data, &lines); err == nil {
+		*e = Expression(strings.Join(lines, "\n"))
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("whereは文字列か文字列の配列である必要があります: %s", string(data))
+	}
+	*e = Expression(s)
+	return nil
+}
+
+// compileWhere whereの条件式を解析する。誤りは行・列付きで返す
+func (q *SearchQuery) compileWhere() error {
+	if strings.TrimSpace(string(q.Where)) == "" {
+		q.Where = ""
+		return nil
+	}
+	expr, err := filter.Compile(string(q.Where))
+	if err != nil {
+		return fmt.Errorf("where: %w", err)
+	}
+	q.where = expr
+	return nil
+}
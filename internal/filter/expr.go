@@ -0,0 +1,497 @@
+package filter
+
+import (
+	"fmt"
+	"nicovideoRSSDIY/internal/repository"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Expr 検索クエリのwhereに書く条件式。Compileで作成し、Matchで動画が条件を満たすかを判定する
+// 作成後は変更せず、複数のgoroutineから使ってよい
+//
+//	式     := 論理積 ("or" 論理積)*
+//	論理積 := 否定 ("and" 否定)*
+//	否定   := "not" 否定 | "(" 式 ")" | 比較
+//	比較   := フィールド 演算子 値
+//
+// 例: tags has "MMD" and lengthSeconds > 120 and not title matches "(?i)test"
+type Expr struct {
+	src      string
+	root     exprNode
+	volatile bool // Volatileのフィールドを参照する
+}
+
+// SyntaxError 条件式の誤り。位置は1から数えた行・列(文字数)
+type SyntaxError struct {
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%d行%d列: %s", e.Line, e.Column, e.Msg)
+}
+
+// fieldKind 条件式で使えるフィールドの種類
+type fieldKind int
+
+const (
+	kindString fieldKind = iota // 文字列: == != contains matches
+	kindNumber                  // 数値: == != < <= > >=
+	kindTags                    // タグの一覧: has contains matches(いずれかのタグが当てはまる)
+	kindTime                    // 日時: == != < <= > >=(値はRFC3339形式の文字列)
+)
+
+// exprField 条件式で使えるフィールド。値が分からない場合はfalseを返し、比較は常に偽になる
+type exprField struct {
+	kind   fieldKind
+	str    func(v *repository.Video) string
+	num    func(v *repository.Video) (int, bool)
+	time   func(v *repository.Video) (time.Time, bool)
+	fields func(v *repository.Video) []string
+}
+
+var exprFields = map[string]exprField{
+	"contentId":       {kind: kindString, str: func(v *repository.Video) string { return v.ID }},
+	"title":           {kind: kindString, str: func(v *repository.Video) string { return v.Title }},
+	"description":     {kind: kindString, str: func(v *repository.Video) string { return v.Description }},
+	"genre":           {kind: kindString, str: func(v *repository.Video) string { return v.Genre }},
+	"tags":            {kind: kindTags, fields: videoTags},
+	"viewCounter":     {kind: kindNumber, num: Counters["viewCounter"]},
+	"commentCounter":  {kind: kindNumber, num: Counters["commentCounter"]},
+	"mylistCounter":   {kind: kindNumber, num: Counters["mylistCounter"]},
+	"likeCounter":     {kind: kindNumber, num: Counters["likeCounter"]},
+	"lengthSeconds":   {kind: kindNumber, num: Counters["lengthSeconds"]},
+	"userId":          {kind: kindNumber, num: func(v *repository.Video) (int, bool) { return int(v.UserID), v.UserID > 0 }},
+	"channelId":       {kind: kindNumber, num: func(v *repository.Video) (int, bool) { return int(v.ChannelID), v.ChannelID > 0 }},
+	"startTime":       {kind: kindTime, time: func(v *repository.Video) (time.Time, bool) { return v.StartTime, !v.StartTime.IsZero() }},
+	"lastCommentTime": {kind: kindTime, time: func(v *repository.Video) (time.Time, bool) { return v.LastCommentTime, !v.LastCommentTime.IsZero() }},
+}
+
+func videoTags(v *repository.Video) []string {
+	if v.TagsConnectedStr == "" {
+		return nil
+	}
+	return v.Tags()
+}
+
+// kindOperators フィールドの種類ごとに使える演算子
+var kindOperators = map[fieldKind][]string{
+	kindString: {"==", "!=", "contains", "matches"},
+	kindNumber: {"==", "!=", "<", "<=", ">", ">="},
+	kindTags:   {"has", "contains", "matches"},
+	kindTime:   {"==", "!=", "<", "<=", ">", ">="},
+}
+
+// Compile 条件式を解析する。誤りがある場合は*SyntaxErrorを返す
+func Compile(src string) (*Expr, error) {
+	p := &exprParser{lexer: exprLexer{src: src, line: 1, col: 1}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	if p.tok.kind == tokEOF {
+		return nil, p.errorf(p.tok, "条件式が空です")
+	}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf(p.tok, "余分な%sがあります", p.tok)
+	}
+	return &Expr{src: src, root: root, volatile: p.volatile}, nil
+}
+
+// String 元の条件式を返す
+func (e *Expr) String() string {
+	return e.src
+}
+
+// Volatile 投稿後に変わる値(Volatile)を参照するかを返す。その場合、同じ動画でも取得した時期によって結果が変わる
+func (e *Expr) Volatile() bool {
+	return e.volatile
+}
+
+// Match 動画が条件を満たすかを返す
+func (e *Expr) Match(v *repository.Video) bool {
+	return e.root.eval(v)
+}
+
+// exprNode 条件式の構文木の1ノード
+type exprNode interface {
+	eval(v *repository.Video) bool
+}
+
+type andNode struct{ left, right exprNode }
+type orNode struct{ left, right exprNode }
+type notNode struct{ operand exprNode }
+
+func (n andNode) eval(v *repository.Video) bool { return n.left.eval(v) && n.right.eval(v) }
+func (n orNode) eval(v *repository.Video) bool  { return n.left.eval(v) || n.right.eval(v) }
+func (n notNode) eval(v *repository.Video) bool { return !n.operand.eval(v) }
+
+// compareNode フィールドと値の比較
+type compareNode struct {
+	field exprField
+	op    string
+	str   string // 文字列の値。hasの場合はNormalizeTagを通したもの
+	num   int
+	time  time.Time
+	re    *regexp.Regexp // matchesの場合のみ
+}
+
+func (n compareNode) eval(v *repository.Video) bool {
+	switch n.field.kind {
+	case kindString:
+		return n.matchString(n.field.str(v))
+	case kindTags:
+		return slices.ContainsFunc(n.field.fields(v), n.matchString)
+	case kindNumber:
+		value, ok := n.field.num(v)
+		return ok && compareOrdered(value, n.num, n.op)
+	case kindTime:
+		value, ok := n.field.time(v)
+		return ok && compareOrdered(value.Compare(n.time), 0, n.op)
+	default:
+		return false
+	}
+}
+
+func (n compareNode) matchString(s string) bool {
+	switch n.op {
+	case "==":
+		return s == n.str
+	case "!=":
+		return s != n.str
+	case "has":
+		return NormalizeTag(s) == n.str
+	case "contains":
+		return strings.Contains(s, n.str)
+	case "matches":
+		return n.re.MatchString(s)
+	default:
+		return false
+	}
+}
+
+func compareOrdered(a, b int, op string) bool {
+	switch op {
+	case "==":
+		return a == b
+	case "!=":
+		return a != b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	default:
+		return false
+	}
+}
+
+// exprParser 再帰下降で条件式を解析する
+type exprParser struct {
+	lexer    exprLexer
+	tok      exprToken // 次に読むトークン
+	volatile bool      // Volatileのフィールドを参照したか
+}
+
+func (p *exprParser) advance() error {
+	tok, err := p.lexer.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *exprParser) errorf(tok exprToken, format string, args ...any) error {
+	return &SyntaxError{Line: tok.line, Column: tok.col, Msg: fmt.Sprintf(format, args...)}
+}
+
+// keyword 次のトークンがキーワードwordかを返す
+func (p *exprParser) keyword(word string) bool {
+	return p.tok.kind == tokIdent && p.tok.text == word
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseNot() (exprNode, error) {
+	switch {
+	case p.keyword("not"):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{operand}, nil
+	case p.tok.kind == tokLParen:
+		open := p.tok
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokRParen {
+			return nil, p.errorf(p.tok, "%d行%d列の(に対応する)がありません", open.line, open.col)
+		}
+		return inner, p.advance()
+	default:
+		return p.parseCompare()
+	}
+}
+
+func (p *exprParser) parseCompare() (exprNode, error) {
+	fieldTok := p.tok
+	if fieldTok.kind != tokIdent || slices.Contains([]string{"and", "or", "not"}, fieldTok.text) {
+		return nil, p.errorf(fieldTok, "フィールド名が必要ですが%sがあります", fieldTok)
+	}
+	field, ok := exprFields[fieldTok.text]
+	if !ok {
+		names := make([]string, 0, len(exprFields))
+		for name := range exprFields {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return nil, p.errorf(fieldTok, "未対応のフィールドです: %q (%s)", fieldTok.text, strings.Join(names, "/"))
+	}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	opTok := p.tok
+	if opTok.kind != tokOperator && opTok.kind != tokIdent {
+		return nil, p.errorf(opTok, "%sの後に演算子が必要ですが%sがあります", fieldTok.text, opTok)
+	}
+	if !slices.Contains(kindOperators[field.kind], opTok.text) {
+		return nil, p.errorf(opTok, "%sには演算子%sを使えません(%s)", fieldTok.text, opTok.text, strings.Join(kindOperators[field.kind], " "))
+	}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	valueTok := p.tok
+	if _, ok := Volatile[fieldTok.text]; ok {
+		p.volatile = true
+	}
+	node := compareNode{field: field, op: opTok.text}
+	switch {
+	case field.kind == kindNumber:
+		if valueTok.kind != tokNumber {
+			return nil, p.errorf(valueTok, "%sと比べる値は整数である必要がありますが%sがあります", fieldTok.text, valueTok)
+		}
+		n, err := strconv.Atoi(valueTok.text)
+		if err != nil {
+			return nil, p.errorf(valueTok, "整数として読み取れません: %s", valueTok.text)
+		}
+		node.num = n
+	case valueTok.kind != tokString:
+		return nil, p.errorf(valueTok, "%sと比べる値は文字列(\"...\")である必要がありますが%sがあります", fieldTok.text, valueTok)
+	case field.kind == kindTime:
+		t, err := time.Parse(time.RFC3339, valueTok.text)
+		if err != nil {
+			return nil, p.errorf(valueTok, "日時はRFC3339形式(例: 2025-01-01T00:00:00+09:00)である必要があります: %q", valueTok.text)
+		}
+		node.time = t
+	case node.op == "matches":
+		re, err := regexp.Compile(valueTok.text)
+		if err != nil {
+			return nil, p.errorf(valueTok, "正規表現の誤りです: %v", err)
+		}
+		node.re = re
+	case node.op == "has":
+		node.str = NormalizeTag(valueTok.text)
+	default:
+		node.str = valueTok.text
+	}
+	return node, p.advance()
+}
+
+// tokenKind 字句の種類
+type tokenKind int
+
+const (
+	tokEOF      tokenKind = iota
+	tokIdent              // フィールド名・キーワード(and or not has contains matches)
+	tokString             // "..."または`...`。textは解釈後の値
+	tokNumber             // 整数
+	tokOperator           // == != < <= > >=
+	tokLParen
+	tokRParen
+)
+
+type exprToken struct {
+	kind      tokenKind
+	text      string
+	line, col int
+}
+
+// String エラー表示用の説明を返す
+func (t exprToken) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "式の終わり"
+	case tokString:
+		return strconv.Quote(t.text)
+	case tokLParen:
+		return "("
+	case tokRParen:
+		return ")"
+	default:
+		return t.text
+	}
+}
+
+// exprLexer 条件式を字句に分ける。位置は行・列(文字数)で数える
+type exprLexer struct {
+	src       string
+	pos       int
+	line, col int
+}
+
+func (l *exprLexer) peek() rune {
+	if l.pos >= len(l.src) {
+		return -1
+	}
+	r, _ := utf8.DecodeRuneInString(l.src[l.pos:])
+	return r
+}
+
+func (l *exprLexer) read() rune {
+	r, size := utf8.DecodeRuneInString(l.src[l.pos:])
+	l.pos += size
+	if r == '\n' {
+		l.line++
+		l.col = 1
+	} else {
+		l.col++
+	}
+	return r
+}
+
+func (l *exprLexer) next() (exprToken, error) {
+	for unicode.IsSpace(l.peek()) {
+		l.read()
+	}
+	tok := exprToken{line: l.line, col: l.col}
+	start := l.pos
+	r := l.peek()
+	switch {
+	case r == -1:
+		tok.kind = tokEOF
+	case r == '(':
+		l.read()
+		tok.kind = tokLParen
+	case r == ')':
+		l.read()
+		tok.kind = tokRParen
+	case r == '"' || r == '`':
+		text, err := l.readString(r)
+		if err != nil {
+			return tok, &SyntaxError{Line: tok.line, Column: tok.col, Msg: err.Error()}
+		}
+		tok.kind, tok.text = tokString, text
+	case r == '-' || ('0' <= r && r <= '9'):
+		l.read()
+		for '0' <= l.peek() && l.peek() <= '9' {
+			l.read()
+		}
+		tok.kind, tok.text = tokNumber, l.src[start:l.pos]
+		if tok.text == "-" {
+			return tok, &SyntaxError{Line: tok.line, Column: tok.col, Msg: "-の後に数字が必要です"}
+		}
+	case strings.ContainsRune("=!<>", r):
+		l.read()
+		if l.peek() == '=' {
+			l.read()
+		}
+		tok.kind, tok.text = tokOperator, l.src[start:l.pos]
+		if tok.text == "=" || tok.text == "!" {
+			return tok, &SyntaxError{Line: tok.line, Column: tok.col, Msg: fmt.Sprintf("未対応の演算子です: %q(==・!=・notを使ってください)", tok.text)}
+		}
+	case r == '_' || unicode.IsLetter(r):
+		for r := l.peek(); r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r); r = l.peek() {
+			l.read()
+		}
+		tok.kind, tok.text = tokIdent, l.src[start:l.pos]
+	default:
+		return tok, &SyntaxError{Line: tok.line, Column: tok.col, Msg: fmt.Sprintf("使えない文字です: %q", r)}
+	}
+	return tok, nil
+}
+
+// readString 引用符quoteで囲まれた文字列を読み、解釈後の値を返す
+// "..."はGoの文字列と同じエスケープが使え、`...`はエスケープを解釈しない(正規表現向け)
+func (l *exprLexer) readString(quote rune) (string, error) {
+	start := l.pos
+	l.read()
+	for {
+		r := l.peek()
+		switch {
+		case r == -1 || (r == '\n' && quote == '"'):
+			return "", fmt.Errorf("文字列が閉じられていません")
+		case r == '\\' && quote == '"':
+			l.read()
+			if l.peek() != -1 {
+				l.read()
+			}
+		case r == quote:
+			l.read()
+			text, err := strconv.Unquote(l.src[start:l.pos])
+			if err != nil {
+				return "", fmt.Errorf("文字列のエスケープの誤りです: %s", l.src[start:l.pos])
+			}
+			return text, nil
+		default:
+			l.read()
+		}
+	}
+}
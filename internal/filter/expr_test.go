@@ -0,0 +1,96 @@
+package filter
+
+import (
+	"errors"
+	"nicovideoRSSDIY/internal/repository"
+	"testing"
+	"time"
+)
+
+func TestCompile_Match(t *testing.T) {
+	views := 1500
+	v := &repository.Video{
+		ID:               "sm100000",
+		Title:            "【MMD】夜明けのエアロリズム",
+		Description:      "風が吹き抜ける都市の屋上で",
+		TagsConnectedStr: "VOCALOID MMD 初音ミク",
+		Genre:            "音楽・サウンド",
+		ViewCounter:      &views,
+		LengthSeconds:    185,
+		UserID:           123,
+		StartTime:        time.Date(2025, 10, 15, 22, 37, 4, 0, time.FixedZone("JST", 9*60*60)),
+	}
+
+	cases := []struct {
+		src  string
+		want bool
+	}{
+		{`tags has "MMD" and lengthSeconds > 120 and not title matches "(?i)test"`, true},
+		{`tags has "mmd"`, true},
+		{`tags has "MMD杯"`, false},
+		{`tags contains "ミク"`, true},
+		{`tags matches ` + "`^VOCA`", true},
+		{`title contains "MMD" or viewCounter < 100`, true},
+		{`viewCounter >= 1500 and viewCounter <= 1500 and viewCounter == 1500 and viewCounter != 1`, true},
+		{`genre == "音楽・サウンド" and contentId != "sm9"`, true},
+		{`userId == 123 and not (channelId > 0)`, true},
+		{"lengthSeconds < 60\n  or (description contains \"屋上\"\n      and startTime >= \"2025-10-15T00:00:00+09:00\")", true},
+		{`startTime < "2025-10-15T13:37:04Z"`, false},
+		// and は or より先に結合する
+		{`viewCounter < 0 and viewCounter < 0 or lengthSeconds == 185`, true},
+		{`lengthSeconds == 185 or viewCounter < 0 and viewCounter < 0`, true},
+		{`not not tags has "VOCALOID"`, true},
+		// 値が分からない場合、比較は偽になる
+		{`likeCounter >= 0`, false},
+		{`not likeCounter < 10`, true},
+		{`lastCommentTime > "2000-01-01T00:00:00Z"`, false},
+		{`title == "【MMD】夜明けのエアロリズム"`, true},
+	}
+	for _, tc := range cases {
+		expr, err := Compile(tc.src)
+		if err != nil {
+			t.Errorf("%q: Compile error: %v", tc.src, err)
+			continue
+		}
+		if got := expr.Match(v); got != tc.want {
+			t.Errorf("%q: expected %v, got %v", tc.src, tc.want, got)
+		}
+	}
+}
+
+func TestCompile_SyntaxError(t *testing.T) {
+	cases := []struct {
+		src          string
+		line, column int
+	}{
+		{``, 1, 1},
+		{`title`, 1, 6},
+		{`title == `, 1, 10},
+		{`unknown == 1`, 1, 1},
+		{`title > "a"`, 1, 7},
+		{`tags == "MMD"`, 1, 6},
+		{`viewCounter > "100"`, 1, 15},
+		{`title contains 1`, 1, 16},
+		{`title = "a"`, 1, 7},
+		{`title == "a" and`, 1, 17},
+		{`title == "a" title == "b"`, 1, 14},
+		{"tags has \"MMD\"\n  and (lengthSeconds > 120", 2, 27},
+		{"tags has \"MMD\" and\n  title matches \"(\"", 2, 17},
+		{"title == \"abc", 1, 10},
+		{`startTime > "2025-01-01"`, 1, 13},
+		{`title == "a" & title == "b"`, 1, 14},
+		{`and title == "a"`, 1, 1},
+		{`viewCounter > -`, 1, 15},
+	}
+	for _, tc := range cases {
+		_, err := Compile(tc.src)
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("%q: expected SyntaxError, got %v", tc.src, err)
+			continue
+		}
+		if syntaxErr.Line != tc.line || syntaxErr.Column != tc.column {
+			t.Errorf("%q: expected %d:%d, got %v", tc.src, tc.line, tc.column, err)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package filter
+
+import (
+	"fmt"
+	"maps"
+	"nicovideoRSSDIY/internal/repository"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Counters 下限を指定できる数値のフィールドと、その値の取り出し方。値が分からない場合はfalse
+var Counters = map[string]func(v *repository.Video) (int, bool){
+	"viewCounter":    func(v *repository.Video) (int, bool) { return intValue(v.ViewCounter) },
+	"commentCounter": func(v *repository.Video) (int, bool) { return intValue(v.CommentCounter) },
+	"mylistCounter":  func(v *repository.Video) (int, bool) { return intValue(v.MylistCounter) },
+	"likeCounter":    func(v *repository.Video) (int, bool) { return intValue(v.LikeCounter) },
+	"lengthSeconds":  func(v *repository.Video) (int, bool) { return v.LengthSeconds, v.LengthSeconds > 0 },
+}
+
+// Volatile 投稿後も増えていくフィールド。取得した時点の値でしか判定できないため、
+// これらで除外した動画は後で条件を満たす可能性がある
+var Volatile = map[string]struct{}{
+	"viewCounter":     {},
+	"commentCounter":  {},
+	"mylistCounter":   {},
+	"likeCounter":     {},
+	"lastCommentTime": {},
+}
+
+func intValue(p *int) (int, bool) {
+	if p == nil {
+		return 0, false
+	}
+	return *p, true
+}
+
+// Rules 取得後の動画を除外する条件。いずれかの条件に当てはまる動画を除外する
+// nilは何も除外しない。作成後は変更せず、複数のgoroutineから読み取ってよい
+type Rules struct {
+	Title       []*regexp.Regexp    // タイトルが一致したら除外する
+	Description []*regexp.Regexp    // 説明文が一致したら除外する
+	Tags        map[string]struct{} // いずれかのタグが付いていたら除外する。キーはNormalizeTagを通したもの
+	UserIDs     map[int64]struct{}  // 投稿者のユーザーID
+	ChannelIDs  map[int64]struct{}  // チャンネルID
+	Min         map[string]int      // Countersのフィールド -> 下限。値が分からない動画は除外しない
+	Where       []*Expr             // 全てを満たさない動画は除外する
+}
+
+// NormalizeTag タグを比較用に正規化する。タグの一致は大文字小文字を区別しない
+func NormalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+// Empty 除外する条件が1つも無いかを返す
+func (r *Rules) Empty() bool {
+	return r == nil || (len(r.Title) == 0 && len(r.Description) == 0 && len(r.Tags) == 0 &&
+		len(r.UserIDs) == 0 && len(r.ChannelIDs) == 0 && len(r.Min) == 0 && len(r.Where) == 0)
+}
+
+// Volatile 投稿後に変わる値(Volatile)で除外する条件を含むかを返す
+func (r *Rules) Volatile() bool {
+	if r == nil {
+		return false
+	}
+	for field := range r.Min {
+		if _, ok := Volatile[field]; ok {
+			return true
+		}
+	}
+	return slices.ContainsFunc(r.Where, (*Expr).Volatile)
+}
+
+// Merge rとotherの両方の条件を持つRulesを返す。下限が重なる場合は大きい方を使う。r・otherは変更しない
+func (r *Rules) Merge(other *Rules) *Rules {
+	if other.Empty() {
+		return r
+	}
+	if r.Empty() {
+		return other
+	}
+	merged := &Rules{
+		Title:       slices.Concat(r.Title, other.Title),
+		Description: slices.Concat(r.Description, other.Description),
+		Tags:        maps.Clone(r.Tags),
+		UserIDs:     maps.Clone(r.UserIDs),
+		ChannelIDs:  maps.Clone(r.ChannelIDs),
+		Min:         maps.Clone(r.Min),
+		Where:       slices.Concat(r.Where, other.Where),
+	}
+	merged.Tags = union(merged.Tags, other.Tags)
+	merged.UserIDs = union(merged.UserIDs, other.UserIDs)
+	merged.ChannelIDs = union(merged.ChannelIDs, other.ChannelIDs)
+	for field, threshold := range other.Min {
+		if current, ok := merged.Min[field]; !ok || threshold > current {
+			if merged.Min == nil {
+				merged.Min = make(map[string]int)
+			}
+			merged.Min[field] = threshold
+		}
+	}
+	return merged
+}
+
+func union[K comparable](dst, src map[K]struct{}) map[K]struct{} {
+	if len(src) == 0 {
+		return dst
+	}
+	if dst == nil {
+		dst = make(map[K]struct{}, len(src))
+	}
+	maps.Copy(dst, src)
+	return dst
+}
+
+// Excludes 動画が除外の条件に当てはまるかを返す。当てはまる場合はその理由も返す
+func (r *Rules) Excludes(v *repository.Video) (reason string, excluded bool) {
+	if r.Empty() {
+		return "", false
+	}
+	for _, re := range r.Title {
+		if re.MatchString(v.Title) {
+			return fmt.Sprintf("タイトルが%qに一致", re.String()), true
+		}
+	}
+	for _, re := range r.Description {
+		if re.MatchString(v.Description) {
+			return fmt.Sprintf("説明文が%qに一致", re.String()), true
+		}
+	}
+	if len(r.Tags) > 0 && v.TagsConnectedStr != "" {
+		for _, tag := range v.Tags() {
+			if _, ok := r.Tags[NormalizeTag(tag)]; ok {
+				return fmt.Sprintf("タグ%q", tag), true
+			}
+		}
+	}
+	if _, ok := r.UserIDs[v.UserID]; ok && v.UserID > 0 {
+		return "ユーザーID " + strconv.FormatInt(v.UserID, 10), true
+	}
+	if _, ok := r.ChannelIDs[v.ChannelID]; ok && v.ChannelID > 0 {
+		return "チャンネルID " + strconv.FormatInt(v.ChannelID, 10), true
+	}
+	for field, threshold := range r.Min {
+		get, ok := Counters[field]
+		if !ok {
+			continue
+		}
+		if value, known := get(v); known && value < threshold {
+			return fmt.Sprintf("%sが%d未満(%d)", field, threshold, value), true
+		}
+	}
+	for _, expr := range r.Where {
+		if !expr.Match(v) {
+			return fmt.Sprintf("条件%qを満たさない", expr.String()), true
+		}
+	}
+	return "", false
+}
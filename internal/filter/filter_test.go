@@ -0,0 +1,102 @@
+package filter
+
+import (
+	"nicovideoRSSDIY/internal/repository"
+	"regexp"
+	"testing"
+)
+
+func TestRules_Excludes(t *testing.T) {
+	views := func(n int) *int { return &n }
+	rules := &Rules{
+		Title:       []*regexp.Regexp{regexp.MustCompile(`日刊トップテン`)},
+		Description: []*regexp.Regexp{regexp.MustCompile(`(?i)reupload`)},
+		Tags:        map[string]struct{}{NormalizeTag("MMD"): {}},
+		UserIDs:     map[int64]struct{}{123: {}},
+		ChannelIDs:  map[int64]struct{}{2600000: {}},
+		Min:         map[string]int{"viewCounter": 100, "lengthSeconds": 60},
+	}
+
+	cases := []struct {
+		name string
+		v    repository.Video
+		want bool
+	}{
+		{name: "ranking", v: repository.Video{Title: "日刊トップテン！VOCALOID＆something【日刊ぼかさん2025.10.30】"}, want: true},
+		{name: "description", v: repository.Video{Title: "a", Description: "ReUpload of sm9"}, want: true},
+		{name: "tag_case_insensitive", v: repository.Video{TagsConnectedStr: "VOCALOID mmd"}, want: true},
+		{name: "user", v: repository.Video{UserID: 123}, want: true},
+		{name: "channel", v: repository.Video{ChannelID: 2600000}, want: true},
+		{name: "few_views", v: repository.Video{ViewCounter: views(99)}, want: true},
+		{name: "short", v: repository.Video{LengthSeconds: 30}, want: true},
+		{name: "enough_views", v: repository.Video{ViewCounter: views(100), LengthSeconds: 60, TagsConnectedStr: "VOCALOID"}, want: false},
+		// 値が分からない場合は除外しない
+		{name: "unknown_counters", v: repository.Video{Title: "夜明けのエアロリズム"}, want: false},
+	}
+	for _, tc := range cases {
+		if reason, got := rules.Excludes(&tc.v); got != tc.want {
+			t.Errorf("%s: expected %v, got %v (%s)", tc.name, tc.want, got, reason)
+		}
+	}
+
+	var empty *Rules
+	if _, got := empty.Excludes(&repository.Video{Title: "日刊トップテン"}); got {
+		t.Fatalf("nil rules should not exclude")
+	}
+}
+
+func TestRules_Merge(t *testing.T) {
+	global := &Rules{
+		Tags: map[string]struct{}{"転載": {}},
+		Min:  map[string]int{"viewCounter": 100},
+	}
+	query := &Rules{
+		Title:   []*regexp.Regexp{regexp.MustCompile(`test`)},
+		UserIDs: map[int64]struct{}{1: {}},
+		Min:     map[string]int{"viewCounter": 50, "likeCounter": 5},
+	}
+
+	merged := global.Merge(query)
+	if len(merged.Title) != 1 || len(merged.Tags) != 1 || len(merged.UserIDs) != 1 {
+		t.Fatalf("unexpected merged rules: %+v", merged)
+	}
+	if merged.Min["viewCounter"] != 100 || merged.Min["likeCounter"] != 5 {
+		t.Fatalf("expected the larger threshold, got %v", merged.Min)
+	}
+	// 元の条件は変更しない
+	if len(global.UserIDs) != 0 || len(global.Min) != 1 || query.Min["viewCounter"] != 50 {
+		t.Fatalf("merge modified its inputs: %+v, %+v", global, query)
+	}
+
+	if global.Merge(nil) != global || (*Rules)(nil).Merge(query) != query {
+		t.Fatalf("merging with nil should return the other rules")
+	}
+}
+
+func TestRules_Volatile(t *testing.T) {
+	mustCompile := func(src string) *Expr {
+		expr, err := Compile(src)
+		if err != nil {
+			t.Fatalf("Compile error: %v", err)
+		}
+		return expr
+	}
+	cases := []struct {
+		name  string
+		rules *Rules
+		want  bool
+	}{
+		{name: "nil", rules: nil, want: false},
+		{name: "tags", rules: &Rules{Tags: map[string]struct{}{"mmd": {}}}, want: false},
+		{name: "min_length", rules: &Rules{Min: map[string]int{"lengthSeconds": 60}}, want: false},
+		{name: "min_views", rules: &Rules{Min: map[string]int{"lengthSeconds": 60, "viewCounter": 100}}, want: true},
+		{name: "where_static", rules: &Rules{Where: []*Expr{mustCompile(`tags has "MMD" and lengthSeconds > 60`)}}, want: false},
+		{name: "where_counter", rules: &Rules{Where: []*Expr{mustCompile(`tags has "MMD" or not likeCounter < 5`)}}, want: true},
+		{name: "where_comment_time", rules: &Rules{Where: []*Expr{mustCompile(`lastCommentTime > "2025-01-01T00:00:00Z"`)}}, want: true},
+	}
+	for _, tc := range cases {
+		if got := tc.rules.Volatile(); got != tc.want {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, got)
+		}
+	}
+}
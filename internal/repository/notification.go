@@ -1,7 +1,14 @@
 package repository
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -23,57 +30,351 @@ func (n NotificationLevel) String() string {
 	}
 }
 
+// ParseNotificationLevel "info"/"error"をNotificationLevelにする
+func ParseNotificationLevel(s string) (NotificationLevel, error) {
+	switch strings.ToLower(s) {
+	case "info":
+		return NotificationInfo, nil
+	case "error":
+		return NotificationError, nil
+	default:
+		return NotificationInfo, fmt.Errorf("通知レベルはinfo/errorのいずれかである必要があります: %q", s)
+	}
+}
+
+// NotificationKind 通知の発生元の種類。通知の振り分け設定に使われる
+type NotificationKind string
+
+const (
+	NotificationKindStartup     NotificationKind = "startup"     // 起動中表示
+	NotificationKindSearch      NotificationKind = "search"      // 動画検索
+	NotificationKindThumbnail   NotificationKind = "thumbnail"   // サムネイル情報取得
+	NotificationKindPaused      NotificationKind = "paused"      // データ切り替え待ちによる更新の一時停止
+	NotificationKindConfig      NotificationKind = "config"      // 設定ファイルの再読込
+	NotificationKindMaintenance NotificationKind = "maintenance" // APIのメンテナンスによる更新の一時停止
+)
+
+// NotificationKinds 全ての通知の種類
+var NotificationKinds = []NotificationKind{
+	NotificationKindStartup,
+	NotificationKindSearch,
+	NotificationKindThumbnail,
+	NotificationKindPaused,
+	NotificationKindConfig,
+	NotificationKindMaintenance,
+}
+
+// NotificationRoute 通知の送り先
+type NotificationRoute int
+
+const (
+	RouteFeed          NotificationRoute = iota // 各フィードと通知フィード
+	RouteLog                                    // ログのみ
+	RouteNotifications                          // 通知フィード(/notifications)のみ
+	RouteDrop                                   // 捨てる
+)
+
+func (r NotificationRoute) String() string {
+	switch r {
+	case RouteFeed:
+		return "feed"
+	case RouteLog:
+		return "log"
+	case RouteNotifications:
+		return "notifications"
+	case RouteDrop:
+		return "drop"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseNotificationRoute "feed"/"log"/"notifications"/"drop"をNotificationRouteにする
+func ParseNotificationRoute(s string) (NotificationRoute, error) {
+	for _, r := range []NotificationRoute{RouteFeed, RouteLog, RouteNotifications, RouteDrop} {
+		if strings.ToLower(s) == r.String() {
+			return r, nil
+		}
+	}
+	return RouteFeed, fmt.Errorf("通知の送り先はfeed/log/notifications/dropのいずれかである必要があります: %q", s)
+}
+
+// NotificationRules 通知の振り分け規則。
+// MinLevel未満の通知はログのみとし、それ以外は種類ごとの指定、レベルごとの指定、Defaultの順に送り先を決める
+type NotificationRules struct {
+	MinLevel NotificationLevel
+	Default  NotificationRoute
+	Levels   map[NotificationLevel]NotificationRoute
+	Kinds    map[NotificationKind]NotificationRoute
+}
+
+// Route 通知の送り先を決める
+func (r NotificationRules) Route(level NotificationLevel, kind NotificationKind) NotificationRoute {
+	if level < r.MinLevel {
+		return RouteLog
+	}
+	if route, ok := r.Kinds[kind]; ok {
+		return route
+	}
+	if route, ok := r.Levels[level]; ok {
+		return route
+	}
+	return r.Default
+}
+
+// Notification フィードに載せる通知。
+// 同じKeyの通知が繰り返し追加された場合はFirstSeenを維持したままLastSeenなどを更新し、原因が解消されResolveされるまで同じ項目として扱う
 type Notification struct {
+	Key              string // 安定した識別子。notificationKeyで決まる
+	Kind             NotificationKind
 	Level            NotificationLevel
 	Title            string
 	Description      error
-	Date             time.Time
+	FirstSeen        time.Time // 最初に発生した日時
+	LastSeen         time.Time // 最後に発生した日時
 	AllowDuplication bool
-	DuplicateCount   int
+	DuplicateCount   int               // FirstSeen以降に重ねて発生した回数
+	Route            NotificationRoute // RouteFeedかRouteNotificationsのいずれか
+}
+
+// ID フィード項目のGUIDなどに使う識別子を返す。解消されるまで変わらず、解消後に再発した場合は別の値になる
+func (n Notification) ID() string {
+	return fmt.Sprintf("%s-%d-%08x", n.Kind, n.FirstSeen.Unix(), crc32.ChecksumIEEE([]byte(n.Key)))
+}
+
+// notificationKey 通知の識別子を決める。
+// allowDuplicationがtrueの場合は種類とエラーの根本原因(Unwrapを辿った最も内側のエラー)のメッセージから決めるため、
+// 毎回fmt.Errorfで作り直されたエラーやURLなど可変部分を含むエラーでも同じ原因なら同じ識別子になる
+// falseの場合は種類・タイトル・説明全体から決める
+func notificationKey(kind NotificationKind, title string, description error, allowDuplication bool) string {
+	if allowDuplication {
+		return string(kind) + "|" + rootErrorMessage(description)
+	}
+	desc := ""
+	if description != nil {
+		desc = description.Error()
+	}
+	return string(kind) + "|" + title + "|" + desc
+}
+
+// rootErrorMessage Unwrapを辿った最も内側のエラーのメッセージを返す
+func rootErrorMessage(err error) string {
+	if err == nil {
+		return ""
+	}
+	for {
+		var next error
+		switch e := err.(type) {
+		case interface{ Unwrap() error }:
+			next = e.Unwrap()
+		case interface{ Unwrap() []error }:
+			if wrapped := e.Unwrap(); len(wrapped) > 0 {
+				next = wrapped[0]
+			}
+		}
+		if next == nil {
+			return err.Error()
+		}
+		err = next
+	}
+}
+
+// notificationJSON 状態ファイルへ保存する際の形式。Descriptionはerrorのため文字列にする
+type notificationJSON struct {
+	Key              string            `json:"key,omitempty"`
+	Kind             NotificationKind  `json:"kind,omitempty"`
+	Level            NotificationLevel `json:"level"`
+	Title            string            `json:"title"`
+	Description      string            `json:"description"`
+	FirstSeen        time.Time         `json:"firstSeen,omitzero"`
+	LastSeen         time.Time         `json:"lastSeen,omitzero"`
+	Date             time.Time         `json:"date,omitzero"` // 旧形式。FirstSeen・LastSeenが無い場合に使う
+	AllowDuplication bool              `json:"allowDuplication"`
+	DuplicateCount   int               `json:"duplicateCount"`
+	Route            NotificationRoute `json:"route,omitempty"`
+}
+
+func (n Notification) MarshalJSON() ([]byte, error) {
+	desc := ""
+	if n.Description != nil {
+		desc = n.Description.Error()
+	}
+	return json.Marshal(notificationJSON{
+		Key:              n.Key,
+		Kind:             n.Kind,
+		Level:            n.Level,
+		Title:            n.Title,
+		Description:      desc,
+		FirstSeen:        n.FirstSeen,
+		LastSeen:         n.LastSeen,
+		AllowDuplication: n.AllowDuplication,
+		DuplicateCount:   n.DuplicateCount,
+		Route:            n.Route,
+	})
+}
+
+func (n *Notification) UnmarshalJSON(data []byte) error {
+	var j notificationJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	*n = Notification{
+		Key:              j.Key,
+		Kind:             j.Kind,
+		Level:            j.Level,
+		Title:            j.Title,
+		Description:      errors.New(j.Description),
+		FirstSeen:        j.FirstSeen,
+		LastSeen:         j.LastSeen,
+		AllowDuplication: j.AllowDuplication,
+		DuplicateCount:   j.DuplicateCount,
+		Route:            j.Route,
+	}
+	if n.FirstSeen.IsZero() {
+		n.FirstSeen = j.Date
+	}
+	if n.LastSeen.IsZero() {
+		n.LastSeen = n.FirstSeen
+	}
+	if n.Key == "" {
+		n.Key = notificationKey(n.Kind, n.Title, n.Description, n.AllowDuplication)
+	}
+	return nil
 }
 
 // NotificationRepository RSSフィード上で通知したい項目を保持する
+// 保持するのはRouteFeedかRouteNotificationsに振り分けられたもののみ
+// 通知は原因が解消したときにResolveKindなどで明示的に取り除く
+// 複数のgoroutineから使えるよう、読み書きは全てメソッドを通して行う
 type NotificationRepository struct {
-	Notifications []Notification
+	mu            sync.RWMutex
+	notifications []Notification
+	rules         NotificationRules
 }
 
 func NewNotificationRepository() *NotificationRepository {
 	return &NotificationRepository{
-		Notifications: make([]Notification, 0, 10),
+		notifications: make([]Notification, 0, 10),
 	}
 }
 
-// AddNotification 通知項目を追加する。
-// allowDuplicationがtrueの場合、同じdescriptionの通知が存在する場合かつ既存の通知もDuplicationを許可している場合は引数の方のもので上書きする。
+// SetRules 振り分け規則を変更する。既に保持している通知には影響しない
+func (r *NotificationRepository) SetRules(rules NotificationRules) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rules = rules
+}
+
+// Notifications 保持している全ての通知を返す。返したスライスは以降の変更の影響を受けない
+func (r *NotificationRepository) Notifications() []Notification {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return slices.Clone(r.notifications)
+}
+
+// AddNotification 通知項目を振り分け規則に従って追加する。
+// 同じ識別子(notificationKey)の通知が既に存在する場合は新しく追加せず、FirstSeenを維持したまま内容とLastSeenを更新しDuplicateCountを増やす。
+// allowDuplicationがtrueの場合、タイトルが違っても同じ種類・同じ原因のエラーであれば同じ通知として扱う。
 func (r *NotificationRepository) AddNotification(
+	kind NotificationKind,
 	level NotificationLevel,
 	title string,
 	description error,
 	allowDuplication bool,
 ) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	route := r.rules.Route(level, kind)
+	switch route {
+	case RouteDrop:
+		return
+	case RouteLog:
+		msg := fmt.Sprintf("[%s] %s: %v", level.String(), title, description)
+		if level >= NotificationError {
+			slog.Error(msg, slog.String("kind", string(kind)))
+		} else {
+			slog.Info(msg, slog.String("kind", string(kind)))
+		}
+		return
+	}
 
+	now := time.Now()
 	new := Notification{
+		Key:              notificationKey(kind, title, description, allowDuplication),
+		Kind:             kind,
 		Level:            level,
 		Title:            title,
 		Description:      description,
+		FirstSeen:        now,
+		LastSeen:         now,
 		AllowDuplication: allowDuplication,
-		Date:             time.Now(),
 		DuplicateCount:   0,
+		Route:            route,
 	}
 
-	if allowDuplication {
-		for i, n := range r.Notifications {
-			if errors.Is(n.Description, description) && n.AllowDuplication {
-				new.DuplicateCount = n.DuplicateCount + 1
-				r.Notifications[i] = new
-				return
-			}
+	for i, n := range r.notifications {
+		if n.Key == new.Key {
+			new.FirstSeen = n.FirstSeen
+			new.DuplicateCount = n.DuplicateCount + 1
+			r.notifications[i] = new
+			return
 		}
 	}
 
-	r.Notifications = append(r.Notifications, new)
+	r.notifications = append(r.notifications, new)
+}
+
+// ResolveKind 原因が解消したとしてその種類の通知を全て取り除き、その数を返す
+func (r *NotificationRepository) ResolveKind(kind NotificationKind) int {
+	return r.resolve(func(n Notification) bool {
+		return n.Kind == kind
+	})
+}
+
+// ResolveUnseenSince その種類の通知のうちsince以降に発生していないものを解消したとして取り除き、その数を返す
+// 処理の開始時刻を渡すことで、今回の処理で再発しなかった通知のみを取り除ける
+func (r *NotificationRepository) ResolveUnseenSince(kind NotificationKind, since time.Time) int {
+	return r.resolve(func(n Notification) bool {
+		return n.Kind == kind && n.LastSeen.Before(since)
+	})
+}
+
+func (r *NotificationRepository) resolve(match func(n Notification) bool) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	kept := make([]Notification, 0, len(r.notifications))
+	for _, n := range r.notifications {
+		if !match(n) {
+			kept = append(kept, n)
+		}
+	}
+	resolved := len(r.notifications) - len(kept)
+	r.notifications = kept
+	return resolved
+}
+
+// FeedNotifications 各フィードに載せる通知を返す
+func (r *NotificationRepository) FeedNotifications() []Notification {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	result := make([]Notification, 0, len(r.notifications))
+	for _, n := range r.notifications {
+		if n.Route == RouteFeed {
+			result = append(result, n)
+		}
+	}
+	return result
+}
+
+// RestoreNotifications 状態ファイルから読み込んだ通知をそのまま戻す
+func (r *NotificationRepository) RestoreNotifications(notifications []Notification) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.notifications = append(r.notifications, notifications...)
 }
 
 func (r *NotificationRepository) ClearNotifications() {
-	r.Notifications = make([]Notification, 0, 10)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.notifications = make([]Notification, 0, 10)
 }
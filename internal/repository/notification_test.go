@@ -1,17 +1,20 @@
 package repository
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestAddNotification(t *testing.T) {
 
 	repo := NewNotificationRepository()
 
-	if len(repo.Notifications) != 0 {
-		t.Fatalf("expected 0 notifications initially, got %d", len(repo.Notifications))
+	if len(repo.Notifications()) != 0 {
+		t.Fatalf("expected 0 notifications initially, got %d", len(repo.Notifications()))
 	}
 
 	desc := errors.New("TestError")
@@ -27,6 +30,7 @@ func TestAddNotification(t *testing.T) {
 		}
 
 		repo.AddNotification(
+			NotificationKindSearch,
 			lv,
 			fmt.Sprintf("Test%d", i),
 			desc,
@@ -34,26 +38,158 @@ func TestAddNotification(t *testing.T) {
 		)
 	}
 
-	for i, n := range repo.Notifications {
+	for i, n := range repo.Notifications() {
 		t.Logf("#%d [%s] %s, %s | dup:%t(%d)", i, n.Level.String(), n.Title, n.Description.Error(), n.AllowDuplication, n.DuplicateCount)
 	}
 
 	// 重複動作チェック
-	if len(repo.Notifications) != 2 {
-		t.Fatalf("expected 2 notifications, got %d", len(repo.Notifications))
+	if len(repo.Notifications()) != 2 {
+		t.Fatalf("expected 2 notifications, got %d", len(repo.Notifications()))
 	}
 
 	// DuplicateCountチェック
-	if repo.Notifications[1].DuplicateCount != 2 {
-		t.Fatalf("expected DuplicateCount 2 for second notification, got %d", repo.Notifications[1].DuplicateCount)
+	if repo.Notifications()[1].DuplicateCount != 2 {
+		t.Fatalf("expected DuplicateCount 2 for second notification, got %d", repo.Notifications()[1].DuplicateCount)
 	}
 
 	// Levelチェック・上書きチェック
-	if repo.Notifications[0].Level != NotificationInfo {
-		t.Fatalf("expected Level NotificationInfo for first notification, got %s", repo.Notifications[0].Level.String())
+	if repo.Notifications()[0].Level != NotificationInfo {
+		t.Fatalf("expected Level NotificationInfo for first notification, got %s", repo.Notifications()[0].Level.String())
 	}
 
-	if repo.Notifications[1].Level != NotificationError {
-		t.Fatalf("expected Level NotificationError for second notification, got %s", repo.Notifications[1].Level.String())
+	if repo.Notifications()[1].Level != NotificationError {
+		t.Fatalf("expected Level NotificationError for second notification, got %s", repo.Notifications()[1].Level.String())
 	}
 }
+
+func TestAddNotification_Routing(t *testing.T) {
+	repo := NewNotificationRepository()
+	repo.SetRules(NotificationRules{
+		MinLevel: NotificationInfo,
+		Default:  RouteFeed,
+		Levels:   map[NotificationLevel]NotificationRoute{NotificationInfo: RouteLog},
+		Kinds: map[NotificationKind]NotificationRoute{
+			NotificationKindThumbnail: RouteNotifications,
+			NotificationKindConfig:    RouteDrop,
+			NotificationKindStartup:   RouteFeed,
+		},
+	})
+
+	repo.AddNotification(NotificationKindPaused, NotificationInfo, "paused", errors.New("paused"), true)     // levels: log
+	repo.AddNotification(NotificationKindStartup, NotificationInfo, "startup", errors.New("startup"), false) // kinds: feed
+	repo.AddNotification(NotificationKindSearch, NotificationError, "search", errors.New("search"), true)    // default: feed
+	repo.AddNotification(NotificationKindThumbnail, NotificationError, "thumb", errors.New("thumb"), true)   // kinds: notifications
+	repo.AddNotification(NotificationKindConfig, NotificationError, "config", errors.New("config"), true)    // kinds: drop
+
+	if len(repo.Notifications()) != 3 {
+		t.Fatalf("expected 3 stored notifications, got %d", len(repo.Notifications()))
+	}
+	feed := repo.FeedNotifications()
+	if len(feed) != 2 || feed[0].Title != "startup" || feed[1].Title != "search" {
+		t.Fatalf("unexpected feed notifications: %+v", feed)
+	}
+
+	// MinLevelは種類ごとの指定より優先する
+	repo.ClearNotifications()
+	repo.SetRules(NotificationRules{
+		MinLevel: NotificationError,
+		Kinds:    map[NotificationKind]NotificationRoute{NotificationKindStartup: RouteFeed},
+	})
+	repo.AddNotification(NotificationKindStartup, NotificationInfo, "startup", errors.New("startup"), false)
+	if len(repo.Notifications()) != 0 {
+		t.Fatalf("expected info notification below minLevel to be log only, got %d", len(repo.Notifications()))
+	}
+}
+
+func TestAddNotification_StableIdentity(t *testing.T) {
+	repo := NewNotificationRepository()
+
+	cause := errors.New("connection refused")
+	repo.AddNotification(NotificationKindSearch, NotificationError, "search", fmt.Errorf("request https://example.com/?q=a: %w", cause), true)
+	first := repo.Notifications()[0]
+
+	time.Sleep(10 * time.Millisecond)
+	// 包み方が違っても根本原因が同じなら同じ通知
+	repo.AddNotification(NotificationKindSearch, NotificationError, "search", fmt.Errorf("request https://example.com/?q=b: %w", cause), true)
+	if len(repo.Notifications()) != 1 {
+		t.Fatalf("expected 1 notification, got %d", len(repo.Notifications()))
+	}
+	n := repo.Notifications()[0]
+	if n.Key != first.Key || n.ID() != first.ID() {
+		t.Fatalf("expected stable identity, got %q -> %q", first.ID(), n.ID())
+	}
+	if !n.FirstSeen.Equal(first.FirstSeen) || !n.LastSeen.After(first.LastSeen) || n.DuplicateCount != 1 {
+		t.Fatalf("unexpected lifecycle fields: %+v", n)
+	}
+
+	// 種類が違えば別の通知
+	repo.AddNotification(NotificationKindThumbnail, NotificationError, "thumb", cause, true)
+	if len(repo.Notifications()) != 2 {
+		t.Fatalf("expected 2 notifications, got %d", len(repo.Notifications()))
+	}
+}
+
+func TestResolveNotifications(t *testing.T) {
+	repo := NewNotificationRepository()
+	repo.AddNotification(NotificationKindSearch, NotificationError, "stale", errors.New("stale"), true)
+	repo.AddNotification(NotificationKindThumbnail, NotificationError, "thumb", errors.New("thumb"), true)
+
+	time.Sleep(10 * time.Millisecond)
+	since := time.Now()
+	repo.AddNotification(NotificationKindSearch, NotificationError, "again", errors.New("again"), true)
+
+	if resolved := repo.ResolveUnseenSince(NotificationKindSearch, since); resolved != 1 {
+		t.Fatalf("expected 1 resolved, got %d", resolved)
+	}
+	if len(repo.Notifications()) != 2 || repo.Notifications()[0].Title != "thumb" || repo.Notifications()[1].Title != "again" {
+		t.Fatalf("unexpected notifications: %+v", repo.Notifications())
+	}
+
+	if resolved := repo.ResolveKind(NotificationKindThumbnail); resolved != 1 {
+		t.Fatalf("expected 1 resolved, got %d", resolved)
+	}
+
+	// 解消後に再発した場合は別の識別子になる
+	before := repo.Notifications()[0]
+	repo.ResolveKind(NotificationKindSearch)
+	time.Sleep(1100 * time.Millisecond)
+	repo.AddNotification(NotificationKindSearch, NotificationError, "again", errors.New("again"), true)
+	if repo.Notifications()[0].ID() == before.ID() || repo.Notifications()[0].DuplicateCount != 0 {
+		t.Fatalf("expected new identity after resolution, got %+v", repo.Notifications()[0])
+	}
+}
+
+func TestNotification_UnmarshalLegacyDate(t *testing.T) {
+	var n Notification
+	data := `{"kind":"search","level":1,"title":"t","description":"d","date":"2025-11-10T07:02:00+09:00","allowDuplication":true,"duplicateCount":0}`
+	if err := json.Unmarshal([]byte(data), &n); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if n.FirstSeen.IsZero() || !n.LastSeen.Equal(n.FirstSeen) || n.Key != "search|d" {
+		t.Fatalf("legacy notification not converted: %+v", n)
+	}
+}
+
+func TestNotifications_ConcurrentAccess(t *testing.T) {
+	repo := NewNotificationRepository()
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		for i := range 100 {
+			repo.AddNotification(NotificationKindSearch, NotificationError, "search", fmt.Errorf("error %d", i%3), false)
+			if i%10 == 0 {
+				repo.ResolveKind(NotificationKindSearch)
+			}
+		}
+	})
+	for range 4 {
+		wg.Go(func() {
+			for range 100 {
+				for _, n := range repo.FeedNotifications() {
+					_ = n.ID()
+				}
+				_ = len(repo.Notifications())
+			}
+		})
+	}
+	wg.Wait()
+}
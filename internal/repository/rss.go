@@ -5,36 +5,53 @@ import (
 	"fmt"
 	"hash/crc32"
 	"io"
-	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// FeedSnapshot ある時点で生成したフィードと、そのETag・更新日時の組。生成後は変更されない
+type FeedSnapshot struct {
+	Data       []byte
+	Etag       string
+	ModifiedAt time.Time
+}
+
+// Reader フィードの内容を読むReadSeekerを返す
+func (s *FeedSnapshot) Reader() io.ReadSeeker {
+	return bytes.NewReader(s.Data)
+}
+
 // RSSRepository RSSフィードをメモリに保持する。
-// 生成と読取りは別goroutineで行われるためMutexを使う必要があり、dataプロパティを直接読むことは許可されない。
+// 生成と読取りは別goroutineで行われるため、生成したフィードはFeedSnapshotごと差し替え、読取りはSnapshot()で行う。
+// フィードの内容とETag・更新日時は必ず同じ時点のものが得られる
 type RSSRepository struct {
-	data       []byte
-	ModifiedAt time.Time
-	Etag       string
-	mu         sync.RWMutex
+	current atomic.Pointer[FeedSnapshot]
 }
 
 func NewRSSRepository() *RSSRepository {
-	return &RSSRepository{
-		data:       []byte{},
+	r := &RSSRepository{}
+	r.current.Store(&FeedSnapshot{
+		Data:       []byte{},
 		ModifiedAt: time.Now(),
-	}
+	})
+	return r
 }
 
-func (r *RSSRepository) Feed() io.ReadSeeker {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
-	return bytes.NewReader(r.data)
+// Snapshot 現在のフィードを返す。返した値は以降のSetFeedの影響を受けない
+func (r *RSSRepository) Snapshot() *FeedSnapshot {
+	return r.current.Load()
 }
 
+// SetFeed フィードを差し替える。dataは以降変更してはならない
+// 内容が前回と同じ場合は前回のFeedSnapshotを残し、Last-Modifiedによる条件付きリクエストが更新の無いまま外れないようにする
 func (r *RSSRepository) SetFeed(data []byte) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	r.data = data
-	r.ModifiedAt = time.Now()
-	r.Etag = fmt.Sprintf("W/%d-%x", len(data), crc32.ChecksumIEEE(data))
+	etag := fmt.Sprintf(`W/"%d-%x"`, len(data), crc32.ChecksumIEEE(data))
+	if prev := r.current.Load(); prev.Etag == etag && bytes.Equal(prev.Data, data) {
+		return
+	}
+	r.current.Store(&FeedSnapshot{
+		Data:       data,
+		Etag:       etag,
+		ModifiedAt: time.Now(),
+	})
 }
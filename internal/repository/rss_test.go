@@ -0,0 +1,91 @@
+package repository
+
+import (
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSetFeed_EtagUsableForConditionalRequest(t *testing.T) {
+	repo := NewRSSRepository()
+	repo.SetFeed([]byte(`{"version":"https://jsonfeed.org/version/1.1"}`))
+
+	first := repo.Snapshot().Etag
+	if first == "" {
+		t.Fatalf("expected non-empty etag")
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		snapshot := repo.Snapshot()
+		w.Header().Set("ETag", snapshot.Etag)
+		http.ServeContent(w, r, "feed.json", snapshot.ModifiedAt, snapshot.Reader())
+	})
+
+	req := httptest.NewRequest("GET", "/feed.json", nil)
+	req.Header.Set("If-None-Match", first)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("expected 304 for matching etag %s, got %d", first, rec.Code)
+	}
+
+	repo.SetFeed([]byte(`{"version":"https://jsonfeed.org/version/1.1","items":[]}`))
+	if repo.Snapshot().Etag == first {
+		t.Fatalf("expected etag to change after SetFeed")
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 for stale etag, got %d", rec.Code)
+	}
+}
+
+func TestSnapshot_ConsistentWhileSetFeed(t *testing.T) {
+	repo := NewRSSRepository()
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		for i := range 200 {
+			repo.SetFeed([]byte(fmt.Sprintf(`{"items":%d}`, i)))
+		}
+	})
+	for range 4 {
+		wg.Go(func() {
+			for range 200 {
+				snapshot := repo.Snapshot()
+				if len(snapshot.Data) == 0 {
+					continue
+				}
+				// 内容とETagは同じ時点のものである
+				want := fmt.Sprintf(`W/"%d-%x"`, len(snapshot.Data), crc32.ChecksumIEEE(snapshot.Data))
+				if snapshot.Etag != want {
+					t.Errorf("etag %s does not match data %s", snapshot.Etag, snapshot.Data)
+					return
+				}
+			}
+		})
+	}
+	wg.Wait()
+}
+
+func TestSetFeed_KeepsSnapshotWhenUnchanged(t *testing.T) {
+	repo := NewRSSRepository()
+	repo.SetFeed([]byte("<rss></rss>"))
+	first := repo.Snapshot()
+
+	time.Sleep(10 * time.Millisecond)
+	// 同じ内容を別のスライスで渡しても更新日時は変わらない
+	repo.SetFeed([]byte("<rss></rss>"))
+	if got := repo.Snapshot(); got != first || !got.ModifiedAt.Equal(first.ModifiedAt) {
+		t.Fatalf("expected the previous snapshot to be kept, got %+v (was %+v)", got, first)
+	}
+
+	repo.SetFeed([]byte("<rss><channel/></rss>"))
+	if got := repo.Snapshot(); got == first || !got.ModifiedAt.After(first.ModifiedAt) {
+		t.Fatalf("expected a new snapshot after the content changed, got %+v", got)
+	}
+}
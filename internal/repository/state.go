@@ -0,0 +1,109 @@
+package repository
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// StateVersion 状態ファイルの形式のバージョン。互換性のない変更をした場合に上げる
+const StateVersion = 1
+
+// State 再起動後に引き継ぐ状態。設定ディレクトリ内のファイルに保存される
+type State struct {
+	Version       int                  `json:"version"`
+	SavedAt       time.Time            `json:"savedAt"`
+	Videos        []*Video             `json:"videos"`               // 全フィードの動画(重複なし)
+	Feeds         map[string][]string  `json:"feeds"`                // フィード名("": 統合フィード) -> 動画ID(新しい順)
+	Notifications []Notification       `json:"notifications"`        // フィード上の通知
+	QueryMarks    map[string]time.Time `json:"queryMarks,omitempty"` // 検索クエリのキー -> 取り込み済みの最新の投稿日時
+	Retention     map[string]Retention `json:"retention,omitempty"`  // フィード名 -> 保存時の残す動画の指定
+	LastModified  time.Time            `json:"lastModified,omitzero"`
+}
+
+// FeedVideos フィードに載っていた動画を保存時の順で返す
+func (s *State) FeedVideos(name string) []*Video {
+	byID := make(map[string]*Video, len(s.Videos))
+	for _, v := range s.Videos {
+		byID[v.ID] = v
+	}
+
+	ids := s.Feeds[name]
+	result := make([]*Video, 0, len(ids))
+	for _, id := range ids {
+		if v, ok := byID[id]; ok {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// LoadState 状態ファイルを読み込む。ファイルが存在しない場合はnil, nilを返す
+func LoadState(path string) (*State, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("状態ファイルの読み込みに失敗しました: %w", err)
+	}
+
+	var state State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("状態ファイルの解析に失敗しました: %w", err)
+	}
+	if state.Version != StateVersion {
+		return nil, fmt.Errorf("状態ファイルのバージョン(%d)に対応していません", state.Version)
+	}
+	return &state, nil
+}
+
+// SaveState 状態ファイルを書き込む。
+// 同じディレクトリの一時ファイルへ書き込んでからリネームするため、途中で落ちても既存のファイルが壊れることはない
+func SaveState(path string, state *State) error {
+	state.Version = StateVersion
+	state.SavedAt = time.Now()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("状態のエンコードに失敗しました: %w", err)
+	}
+
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("一時ファイルを作成できません: %w", err)
+	}
+	tmpPath := tmp.Name()
+	cleanup := func() {
+		tmp.Close()
+		os.Remove(tmpPath)
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		cleanup()
+		return fmt.Errorf("一時ファイルへの書き込みに失敗しました: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		cleanup()
+		return fmt.Errorf("一時ファイルの同期に失敗しました: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("一時ファイルを閉じられません: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("状態ファイルを置き換えられません: %w", err)
+	}
+
+	// リネームを確実に永続化する。ディレクトリのSyncに対応しない環境もあるので失敗は無視する
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package repository
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSaveState_LoadState_RoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	videos := loadVideosFromFile(t, "res2.json")
+	videos[0].ThumbnailType = "image/jpeg"
+	videos[0].ThumbnailLength = 6337
+	views := 12345
+	videos[0].ViewCounter = &views
+	videos[0].LengthSeconds = 3725
+	videos[0].Genre = "音楽・サウンド"
+	videos[0].UserID = 123456
+	videos[0].LastCommentTime = time.Date(2025, 11, 10, 8, 0, 0, 0, time.FixedZone("JST", 9*60*60))
+
+	lastModified := time.Date(2025, 11, 10, 7, 2, 0, 0, time.FixedZone("JST", 9*60*60))
+	state := &State{
+		Videos: videos,
+		Feeds: map[string][]string{
+			"":     {videos[0].ID, videos[1].ID},
+			"talk": {videos[1].ID},
+		},
+		Notifications: []Notification{
+			{Key: "search|TestError", Kind: NotificationKindSearch, Level: NotificationError, Title: "Test", Description: errors.New("TestError"), FirstSeen: lastModified, LastSeen: lastModified.Add(time.Hour), AllowDuplication: true, DuplicateCount: 2},
+		},
+		QueryMarks:   map[string]time.Time{"VOCALOID": videos[0].StartTime},
+		LastModified: lastModified,
+	}
+	if err := SaveState(path, state); err != nil {
+		t.Fatalf("SaveState error: %v", err)
+	}
+
+	loaded, err := LoadState(path)
+	if err != nil {
+		t.Fatalf("LoadState error: %v", err)
+	}
+
+	if !loaded.LastModified.Equal(lastModified) {
+		t.Fatalf("expected lastModified %v, got %v", lastModified, loaded.LastModified)
+	}
+
+	merged := loaded.FeedVideos("")
+	if len(merged) != 2 || merged[0].ID != videos[0].ID {
+		t.Fatalf("unexpected merged feed videos: %d", len(merged))
+	}
+	if merged[0].ThumbnailType != "image/jpeg" || merged[0].ThumbnailLength != 6337 {
+		t.Fatalf("thumbnail metadata not restored: %q %d", merged[0].ThumbnailType, merged[0].ThumbnailLength)
+	}
+	if m := merged[0]; m.ViewCounter == nil || *m.ViewCounter != views || m.CommentCounter != nil || m.LengthSeconds != 3725 ||
+		m.Genre != "音楽・サウンド" || m.UserID != 123456 || !m.LastCommentTime.Equal(videos[0].LastCommentTime) {
+		t.Fatalf("video fields not restored: %+v", m)
+	}
+	if merged[1].ViewCounter != nil || !merged[1].LastCommentTime.IsZero() {
+		t.Fatalf("unexpected video fields on second video: %+v", merged[1])
+	}
+	if !merged[0].StartTime.Equal(videos[0].StartTime) {
+		t.Fatalf("expected startTime %v, got %v", videos[0].StartTime, merged[0].StartTime)
+	}
+	if len(loaded.FeedVideos("talk")) != 1 || len(loaded.FeedVideos("removed")) != 0 {
+		t.Fatalf("unexpected named feed videos")
+	}
+
+	if mark, ok := loaded.QueryMarks["VOCALOID"]; !ok || !mark.Equal(videos[0].StartTime) {
+		t.Fatalf("query marks not restored: %v", loaded.QueryMarks)
+	}
+
+	if len(loaded.Notifications) != 1 {
+		t.Fatalf("expected 1 notification, got %d", len(loaded.Notifications))
+	}
+	n := loaded.Notifications[0]
+	if n.Level != NotificationError || n.Description.Error() != "TestError" || n.DuplicateCount != 2 || !n.AllowDuplication {
+		t.Fatalf("notification not restored: %+v", n)
+	}
+	if !n.FirstSeen.Equal(lastModified) || !n.LastSeen.Equal(lastModified.Add(time.Hour)) || n.ID() != state.Notifications[0].ID() {
+		t.Fatalf("notification identity not restored: %+v", n)
+	}
+
+	// 一時ファイルが残っていないこと
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatalf("read dir: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected only state file in dir, got %d entries", len(entries))
+	}
+}
+
+func TestLoadState_NotExist(t *testing.T) {
+	state, err := LoadState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatalf("expected no error for missing file, got %v", err)
+	}
+	if state != nil {
+		t.Fatalf("expected nil state for missing file")
+	}
+}
+
+func TestLoadState_Broken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(path, []byte(`{"version": 1, "videos": [`), 0o600); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	if _, err := LoadState(path); err == nil {
+		t.Fatalf("expected error for broken state file")
+	}
+}
+
+func TestSaveState_OmitsZeroLastModified(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := SaveState(path, &State{}); err != nil {
+		t.Fatalf("SaveState error: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read file: %v", err)
+	}
+	if strings.Contains(string(data), "lastModified") {
+		t.Fatalf("expected zero lastModified to be omitted, got %s", data)
+	}
+}
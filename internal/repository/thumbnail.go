@@ -0,0 +1,273 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// thumbnailExtensions キャッシュできる画像の種類と保存時の拡張子
+var thumbnailExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// cacheKeyPattern キャッシュのファイル名に使えるキー。動画ID、または大きさ違いのサムネイルの"{contentId}.M"など
+var cacheKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+(\.[A-Z])?$`)
+
+// contentIDOf キャッシュのキーから動画IDを返す
+func contentIDOf(key string) string {
+	id, _, _ := strings.Cut(key, ".")
+	return id
+}
+
+// ErrThumbnailType キャッシュできない種類の画像
+var ErrThumbnailType = errors.New("キャッシュできない画像の種類です")
+
+// ThumbnailEntry キャッシュ済みのサムネイル画像1つ分
+type ThumbnailEntry struct {
+	ID       string // 動画ID(contentId)。大きさ違いのサムネイルは"{contentId}.M"など
+	Path     string
+	Type     string // MIMEタイプ
+	Size     int64
+	CachedAt time.Time
+}
+
+// ThumbnailCache サムネイル画像を動画IDごとにディスクへ保存する。ファイル名は"{contentId}{拡張子}"
+// 大きさ違いのサムネイルは"{contentId}.M"などのキーで保存でき、元の動画と同じ扱いで削除される
+// 複数のgoroutine(ワーカー・HTTPハンドラ)から同時に使える
+type ThumbnailCache struct {
+	dir string
+
+	mu       sync.RWMutex
+	entries  map[string]ThumbnailEntry
+	total    int64
+	maxBytes int64
+	maxAge   time.Duration
+	sources  map[string]string // 動画ID -> CDNのサムネイルのURL
+	sizes    map[string]imageSize
+}
+
+// imageSize SetImageSizeで記録した画像の幅と高さ
+type imageSize struct {
+	width, height int
+}
+
+// OpenThumbnailCache dirをキャッシュとして開く。無ければ作成し、既にあるファイルは読み込む
+// maxBytes・maxAgeはEvictで使われる。0以下の場合はその制限を設けない
+func OpenThumbnailCache(dir string, maxBytes int64, maxAge time.Duration) (*ThumbnailCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("サムネイルのキャッシュディレクトリを作成できません: %w", err)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("サムネイルのキャッシュディレクトリを読み込めません: %w", err)
+	}
+
+	c := &ThumbnailCache{
+		dir:      dir,
+		entries:  make(map[string]ThumbnailEntry, len(files)),
+		sizes:    make(map[string]imageSize),
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, file.Name())
+		if strings.HasPrefix(file.Name(), ".tmp-") {
+			// 書き込み途中で落ちた一時ファイル
+			os.Remove(path)
+			continue
+		}
+		ext := filepath.Ext(file.Name())
+		id := strings.TrimSuffix(file.Name(), ext)
+		mimeType, ok := thumbnailTypeOf(ext)
+		if !file.Type().IsRegular() || !ok || !cacheKeyPattern.MatchString(id) {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		c.entries[id] = ThumbnailEntry{ID: id, Path: path, Type: mimeType, Size: info.Size(), CachedAt: info.ModTime()}
+		c.total += info.Size()
+	}
+	return c, nil
+}
+
+func thumbnailTypeOf(ext string) (string, bool) {
+	for mimeType, e := range thumbnailExtensions {
+		if e == ext {
+			return mimeType, true
+		}
+	}
+	return "", false
+}
+
+// SetLimits Evictで使う制限を変更する
+func (c *ThumbnailCache) SetLimits(maxBytes int64, maxAge time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxBytes = maxBytes
+	c.maxAge = maxAge
+}
+
+// Dir キャッシュのディレクトリを返す
+func (c *ThumbnailCache) Dir() string {
+	return c.dir
+}
+
+// SetSources フィードに載っている動画のサムネイルのURL(動画ID -> URL)を記録する。大きさ違いのサムネイルをCDNから取得する際に使う
+func (c *ThumbnailCache) SetSources(sources map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sources = sources
+}
+
+// Source 動画IDのサムネイルのURLを返す。フィードに載っていない動画の場合はfalse
+func (c *ThumbnailCache) Source(id string) (string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	u, ok := c.sources[id]
+	return u, ok
+}
+
+// Get 動画IDのキャッシュを返す
+func (c *ThumbnailCache) Get(id string) (ThumbnailEntry, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	e, ok := c.entries[id]
+	return e, ok
+}
+
+// Has 動画IDのキャッシュがあるかを返す
+func (c *ThumbnailCache) Has(id string) bool {
+	_, ok := c.Get(id)
+	return ok
+}
+
+// SetImageSize キー(動画ID、または"{contentId}.M"など)で配信する画像の幅と高さを記録する
+// 大きさ違いのサムネイルがCDNに無く元の画像から作った場合など、キャッシュに無いキーも記録できる。Put・Evictで元の画像が変わると消える
+func (c *ThumbnailCache) SetImageSize(key string, width, height int) {
+	if width <= 0 || height <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sizes[key] = imageSize{width, height}
+}
+
+// ImageSize SetImageSizeで記録した画像の幅と高さを返す
+func (c *ThumbnailCache) ImageSize(key string) (width, height int, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	size, ok := c.sizes[key]
+	return size.width, size.height, ok
+}
+
+// forgetSizes 置き換え・削除したキャッシュのキーに関わる記録済みの大きさを消す。元の画像の場合はそこから作った大きさ違いの分も消す
+// 呼び出し元でc.muをロックしておくこと
+func (c *ThumbnailCache) forgetSizes(key string) {
+	for k := range c.sizes {
+		if k == key || (contentIDOf(key) == key && contentIDOf(k) == key) {
+			delete(c.sizes, k)
+		}
+	}
+}
+
+// Size キャッシュの件数と合計の大きさを返す
+func (c *ThumbnailCache) Size() (count int, bytes int64) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.entries), c.total
+}
+
+// Put 動画IDのサムネイル画像を保存する。既にある場合は置き換える
+// 一時ファイルへ書いてから置き換えるため、読み込み中のHTTPハンドラが途中までの内容を返すことはない
+func (c *ThumbnailCache) Put(id string, mimeType string, data []byte) error {
+	if !cacheKeyPattern.MatchString(id) {
+		return fmt.Errorf("キャッシュできない動画IDです: %q", id)
+	}
+	ext, ok := thumbnailExtensions[mimeType]
+	if !ok {
+		return fmt.Errorf("%s: %w", mimeType, ErrThumbnailType)
+	}
+
+	tmp, err := os.CreateTemp(c.dir, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("一時ファイルを作成できません: %w", err)
+	}
+	tmpPath := tmp.Name()
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("一時ファイルへの書き込みに失敗しました: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("一時ファイルを閉じられません: %w", err)
+	}
+
+	path := filepath.Join(c.dir, id+ext)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("サムネイルのキャッシュを置き換えられません: %w", err)
+	}
+	if old, ok := c.entries[id]; ok {
+		c.total -= old.Size
+		if old.Path != path {
+			// 画像の種類が変わった
+			os.Remove(old.Path)
+		}
+	}
+	c.forgetSizes(id)
+	c.entries[id] = ThumbnailEntry{ID: id, Path: path, Type: mimeType, Size: int64(len(data)), CachedAt: time.Now()}
+	c.total += int64(len(data))
+	return nil
+}
+
+// Evict フィードに載っていない動画(keepに無いもの。大きさ違いのサムネイルは元の動画IDで判断する)のキャッシュを、保存してからmaxAgeを過ぎたもの・合計がmaxBytesを超えた分(古い順)だけ削除し、その数を返す
+// フィードに載っている動画のキャッシュは、フィードから参照されているため制限を超えていても削除しない
+func (c *ThumbnailCache) Evict(keep map[string]struct{}, now time.Time) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	candidates := make([]ThumbnailEntry, 0, len(c.entries))
+	for id, e := range c.entries {
+		if _, ok := keep[contentIDOf(id)]; !ok {
+			candidates = append(candidates, e)
+		}
+	}
+	slices.SortFunc(candidates, func(a, b ThumbnailEntry) int { return a.CachedAt.Compare(b.CachedAt) })
+
+	var errs []error
+	removed := 0
+	for _, e := range candidates {
+		expired := c.maxAge > 0 && now.Sub(e.CachedAt) > c.maxAge
+		oversized := c.maxBytes > 0 && c.total > c.maxBytes
+		if !expired && !oversized {
+			continue
+		}
+		if err := os.Remove(e.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+			continue
+		}
+		delete(c.entries, e.ID)
+		c.forgetSizes(e.ID)
+		c.total -= e.Size
+		removed++
+	}
+	if len(errs) > 0 {
+		return removed, fmt.Errorf("サムネイルのキャッシュを削除できません: %w", errors.Join(errs...))
+	}
+	return removed, nil
+}
@@ -0,0 +1,115 @@
+package repository
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestThumbnailCache_PutAndReopen(t *testing.T) {
+	dir := t.TempDir()
+	c, err := OpenThumbnailCache(dir, 0, 0)
+	if err != nil {
+		t.Fatalf("OpenThumbnailCache error: %v", err)
+	}
+
+	if err := c.Put("sm9", "image/jpeg", []byte("jpeg")); err != nil {
+		t.Fatalf("Put error: %v", err)
+	}
+	// 種類が変わった場合は古いファイルを消す
+	if err := c.Put("sm9", "image/png", []byte("png!!")); err != nil {
+		t.Fatalf("Put error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sm9.jpg")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected old file to be removed, got %v", err)
+	}
+	if err := c.Put("sm9.M", "image/png", []byte("m")); err != nil {
+		t.Fatalf("Put variant error: %v", err)
+	}
+	if err := c.Put("../sm10", "image/png", nil); err == nil {
+		t.Fatalf("expected error for invalid id")
+	}
+	if err := c.Put("sm10", "text/html", nil); !errors.Is(err, ErrThumbnailType) {
+		t.Fatalf("expected ErrThumbnailType, got %v", err)
+	}
+
+	// 一時ファイルの残骸は開き直したときに消える
+	if err := os.WriteFile(filepath.Join(dir, ".tmp-123"), []byte("x"), 0o644); err != nil {
+		t.Fatalf("write tmp: %v", err)
+	}
+	reopened, err := OpenThumbnailCache(dir, 0, 0)
+	if err != nil {
+		t.Fatalf("OpenThumbnailCache error: %v", err)
+	}
+	e, ok := reopened.Get("sm9")
+	if !ok || e.Type != "image/png" || e.Size != 5 {
+		t.Fatalf("unexpected entry: %+v, %v", e, ok)
+	}
+	if !reopened.Has("sm9.M") {
+		t.Fatalf("expected variant to be reopened")
+	}
+	if count, bytes := reopened.Size(); count != 2 || bytes != 6 {
+		t.Fatalf("unexpected size: %d entries, %d bytes", count, bytes)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".tmp-123")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected tmp file to be removed, got %v", err)
+	}
+}
+
+func TestThumbnailCache_Evict(t *testing.T) {
+	c, err := OpenThumbnailCache(t.TempDir(), 10, time.Hour)
+	if err != nil {
+		t.Fatalf("OpenThumbnailCache error: %v", err)
+	}
+	for _, id := range []string{"sm1", "sm1.M", "sm2", "sm3", "sm4"} {
+		if err := c.Put(id, "image/jpeg", []byte("1234")); err != nil {
+			t.Fatalf("Put error: %v", err)
+		}
+	}
+	keep := map[string]struct{}{"sm1": {}, "sm4": {}}
+
+	// 合計20バイト > 10バイト。フィードに無いものを古い順に消す。sm1.Mはsm1と同じ扱い
+	removed, err := c.Evict(keep, time.Now())
+	if err != nil {
+		t.Fatalf("Evict error: %v", err)
+	}
+	if removed != 2 || c.Has("sm2") || c.Has("sm3") || !c.Has("sm1") || !c.Has("sm1.M") || !c.Has("sm4") {
+		t.Fatalf("unexpected eviction: removed %d", removed)
+	}
+
+	// フィードに載っている動画は期限を過ぎても消さない
+	c.SetLimits(0, time.Hour)
+	removed, _ = c.Evict(map[string]struct{}{"sm1": {}}, time.Now().Add(2*time.Hour))
+	if removed != 1 || !c.Has("sm1") || !c.Has("sm1.M") || c.Has("sm4") {
+		t.Fatalf("unexpected eviction by age: removed %d", removed)
+	}
+}
+
+func TestThumbnailCache_ImageSize(t *testing.T) {
+	c, err := OpenThumbnailCache(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatalf("OpenThumbnailCache error: %v", err)
+	}
+	if err := c.Put("sm9", "image/png", []byte("png")); err != nil {
+		t.Fatalf("Put error: %v", err)
+	}
+	c.SetImageSize("sm9.M", 320, 246)
+	c.SetImageSize("sm9.L", 640, 360)
+	c.SetImageSize("sm10.M", 320, 180)
+	if w, h, ok := c.ImageSize("sm9.M"); !ok || w != 320 || h != 246 {
+		t.Fatalf("unexpected size: %dx%d, %v", w, h, ok)
+	}
+
+	// 元の画像を置き換えると、そこから作った大きさ違いの記録も消える
+	if err := c.Put("sm9", "image/png", []byte("new png")); err != nil {
+		t.Fatalf("Put error: %v", err)
+	}
+	if _, _, ok := c.ImageSize("sm9.M"); ok {
+		t.Fatalf("expected size of sm9.M to be forgotten")
+	}
+	if _, _, ok := c.ImageSize("sm10.M"); !ok {
+		t.Fatalf("expected size of another video to be kept")
+	}
+}
@@ -2,7 +2,11 @@ package repository
 
 import (
 	"net/url"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -12,17 +16,68 @@ type Video struct {
 	Description      string    `json:"description"`
 	StartTime        time.Time `json:"startTime"`
 	ThumbnailURL     string    `json:"thumbnailUrl"`
-	ThumbnailType    string    `json:"-"`
-	ThumbnailLength  int64     `json:"-"`
+	ThumbnailType    string    `json:"thumbnailType,omitempty"`   // APIからは得られない。状態ファイルへの保存用
+	ThumbnailLength  int64     `json:"thumbnailLength,omitempty"` // 同上
 	TagsConnectedStr string    `json:"tags"`
+	Sources          []string  `json:"sources,omitempty"` // この動画を返した検索クエリのキー。APIからは得られない
+
+	// ThumbnailWidth, ThumbnailHeight サムネイル画像の幅と高さ。分からない場合は0
+	ThumbnailWidth  int `json:"thumbnailWidth,omitempty"`
+	ThumbnailHeight int `json:"thumbnailHeight,omitempty"`
+	// ThumbnailUnavailable サムネイル情報の取得に恒久的に失敗した(削除済み・画像でないなど)。以降は取得しない
+	ThumbnailUnavailable bool `json:"thumbnailUnavailable,omitempty"`
+
+	// 取得時点の統計。古い状態ファイルから読み込んだものなど、取得していない場合はnil
+	ViewCounter    *int `json:"viewCounter,omitempty"`    // 再生数
+	CommentCounter *int `json:"commentCounter,omitempty"` // コメント数
+	MylistCounter  *int `json:"mylistCounter,omitempty"`  // マイリスト数
+	LikeCounter    *int `json:"likeCounter,omitempty"`    // いいね数
+
+	LengthSeconds   int       `json:"lengthSeconds,omitempty"`  // 再生時間(秒)。分からない場合は0
+	Genre           string    `json:"genre,omitempty"`          // ジャンル
+	UserID          int64     `json:"userId,omitempty"`         // 投稿者のユーザーID。チャンネル動画などでは0
+	ChannelID       int64     `json:"channelId,omitempty"`      // チャンネルID。ユーザー投稿動画では0
+	LastCommentTime time.Time `json:"lastCommentTime,omitzero"` // 最終コメント日時
 }
 
 // VideoRepository 動画情報をメモリに保持する
-// 基本的にAddSortedVideos()で追加を行うことを想定、その際Capacity超過分のTrimも行われる。
+// 基本的にAddSortedVideos()で追加を行うことを想定、その際規定数・件数の指定の超過分のTrimも行われる。
+// 複数のgoroutineから使えるよう、変更は全てメソッドを通して行う。格納した*Videoは変更せず、
+// 変更する場合(UpdateVideoなど)は複製を変更して差し替えるため、Videos()で得た動画はロック無しで読める
 type VideoRepository struct {
-	Videos   []*Video
-	seenIDs  map[string]struct{}
-	Capacity int
+	mu       sync.RWMutex
+	videos   []*Video
+	seenIDs  map[string]*Video
+	capacity int
+	quotas   map[string]Quota // 検索クエリのキー(Video.Sources) -> 件数の指定
+	maxAge   time.Duration    // 投稿からこの期間を過ぎた動画は削除する。0は無期限
+	minItems int              // maxAgeを過ぎても新しい順にこの件数は残す
+}
+
+// Retention フィードに残す動画の指定。状態ファイルにも保存し、再起動の間に残す範囲が広がったかを判定するのに使う
+type Retention struct {
+	Capacity int           `json:"capacity"`           // 規定数
+	MaxAge   time.Duration `json:"maxAge,omitempty"`   // 投稿からこの期間を過ぎた動画は削除する。0は無期限
+	MinItems int           `json:"minItems,omitempty"` // MaxAgeを過ぎても新しい順にこの件数は残す
+}
+
+// Widens oldよりも古い動画まで残しうるかを返す。その場合、取り込み済みの動画より前の分を検索し直す必要がある
+func (r Retention) Widens(old Retention) bool {
+	if r.Capacity > old.Capacity {
+		return true
+	}
+	if old.MaxAge == 0 {
+		return false
+	}
+	return r.MaxAge == 0 || r.MaxAge > old.MaxAge || r.MinItems > old.MinItems
+}
+
+// Quota 検索クエリごとの件数の指定。0は指定なし
+type Quota struct {
+	// Min 規定数の範囲で、このクエリから来た動画を新しい順に少なくともこの件数残す。その分だけ他のクエリの古い動画が減る
+	Min int
+	// Max このクエリから来た動画はこの件数まで残す。ただし上限の無い(または上限に達していない)他のクエリからも来た動画は残す
+	Max int
 }
 
 // URL 動画視聴URLを返す
@@ -30,11 +85,74 @@ func (v Video) URL() string {
 	return "https://nico.ms/" + v.ID
 }
 
+// UploaderURL 投稿者(ユーザーまたはチャンネル)のページのURLを返す。分からない場合は空文字
+func (v Video) UploaderURL() string {
+	switch {
+	case v.ChannelID > 0:
+		return "https://ch.nicovideo.jp/channel/ch" + strconv.FormatInt(v.ChannelID, 10)
+	case v.UserID > 0:
+		return "https://www.nicovideo.jp/user/" + strconv.FormatInt(v.UserID, 10)
+	default:
+		return ""
+	}
+}
+
 // TagSearchURL タグ検索用のURLを返す
 func TagSearchURL(tag string) string {
 	return "https://www.nicovideo.jp/tag/" + url.PathEscape(tag)
 }
 
+// NeedsThumbnailMeta サムネイルのType, Lengthを取得する必要があるかを返す
+// 大きさが分からなかった(-1)ものも取得し直す。恒久的に失敗したものは取得しない
+func (v Video) NeedsThumbnailMeta() bool {
+	return !v.ThumbnailUnavailable && (v.ThumbnailType == "" || v.ThumbnailLength <= 0)
+}
+
+// HasSourceIn 動画を返した検索クエリのいずれかがkeysに含まれるかを返す
+func (v Video) HasSourceIn(keys map[string]struct{}) bool {
+	for _, s := range v.Sources {
+		if _, ok := keys[s]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// clone 差し替え用の複製を返す。Sourcesは複製側で追加しても元に影響しないよう複製する
+func (v *Video) clone() *Video {
+	c := *v
+	c.Sources = slices.Clone(v.Sources)
+	return &c
+}
+
+// addSources 検索クエリのキーを重複なしで追加する
+func (v *Video) addSources(sources []string) {
+	for _, s := range sources {
+		if !slices.Contains(v.Sources, s) {
+			v.Sources = append(v.Sources, s)
+		}
+	}
+}
+
+// updateStats 同じ動画を取得し直した際に、変わりうる統計(再生数など)を新しい値で置き換える。取得していない項目は残す
+func (v *Video) updateStats(latest *Video) {
+	if latest.ViewCounter != nil {
+		v.ViewCounter = latest.ViewCounter
+	}
+	if latest.CommentCounter != nil {
+		v.CommentCounter = latest.CommentCounter
+	}
+	if latest.MylistCounter != nil {
+		v.MylistCounter = latest.MylistCounter
+	}
+	if latest.LikeCounter != nil {
+		v.LikeCounter = latest.LikeCounter
+	}
+	if latest.LastCommentTime.After(v.LastCommentTime) {
+		v.LastCommentTime = latest.LastCommentTime
+	}
+}
+
 // Tags タグをスライス形式で返す
 func (v Video) Tags() []string {
 	return strings.Split(v.TagsConnectedStr, " ")
@@ -42,36 +160,112 @@ func (v Video) Tags() []string {
 
 func NewVideoRepository(capacity int) *VideoRepository {
 	return &VideoRepository{
-		Videos:   make([]*Video, 0, capacity),
-		seenIDs:  make(map[string]struct{}),
-		Capacity: capacity,
+		videos:   make([]*Video, 0, capacity),
+		seenIDs:  make(map[string]*Video),
+		capacity: capacity,
 	}
 }
 
-// AddSortedVideos ソート済み動画スライスをマージし、重複を排除して格納する。重複を省いた後の追加数を返す。
-// ソート済みであることを前提としている。APIから-startTimeで取ったデータを入れるなら問題なし
+// Videos 格納している動画を投稿日時の新しい順で返す。返したスライスと動画は以降の変更の影響を受けない
+func (r *VideoRepository) Videos() []*Video {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return slices.Clone(r.videos)
+}
+
+// Capacity 規定数を返す
+func (r *VideoRepository) Capacity() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.capacity
+}
+
+// Retention 残す動画の指定を返す
+func (r *VideoRepository) Retention() Retention {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return Retention{Capacity: r.capacity, MaxAge: r.maxAge, MinItems: r.minItems}
+}
+
+// AddSortedVideos 動画スライスをマージし、重複を排除して格納する。重複を省いた後の追加数を返す。
+// 格納順は投稿日時の新しい順である。APIから-startTime以外の並び順で取ったデータは投稿日時順に並べ直してからマージする
+// 既に格納済みの動画が別の検索クエリから来た場合は、格納済みの方にSourcesを追加したものに差し替える
+// 渡した動画は格納後に変更してはならない
 func (r *VideoRepository) AddSortedVideos(newVideos []*Video) int {
 	if len(newVideos) == 0 {
 		return 0
 	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
 	toMerge := make([]*Video, 0, len(newVideos))
 	for _, v := range newVideos {
-		if _, exists := r.seenIDs[v.ID]; !exists {
-			toMerge = append(toMerge, v)
-			r.seenIDs[v.ID] = struct{}{}
+		if existing, exists := r.seenIDs[v.ID]; exists {
+			if existing != v {
+				updated := existing.clone()
+				updated.addSources(v.Sources)
+				updated.updateStats(v)
+				r.replace(existing, updated)
+				// 同じ呼び出しの中で先に来たものはまだtoMergeにある
+				if i := slices.Index(toMerge, existing); i >= 0 {
+					toMerge[i] = updated
+				}
+			}
+			continue
 		}
+		toMerge = append(toMerge, v)
+		r.seenIDs[v.ID] = v
 	}
 	if len(toMerge) == 0 {
 		return 0
 	}
 
-	r.Videos = mergeSortedVideos(r.Videos, toMerge)
+	// 呼び出し元のスライスの順序は変えない。toMergeは新たに確保したものなので並べ替えてよい
+	if !sortedByStartTime(toMerge) {
+		sort.SliceStable(toMerge, func(i, j int) bool {
+			return toMerge[i].StartTime.After(toMerge[j].StartTime)
+		})
+	}
 
-	r.TrimToCapacity()
+	r.videos = mergeSortedVideos(r.videos, toMerge)
+
+	r.trim(time.Now())
 	return len(toMerge)
 }
 
+// UpdateVideo IDの動画の複製にupdateを適用して差し替える。格納していない場合はfalseを返す
+// updateでは投稿日時(並び順)を変更してはならない
+func (r *VideoRepository) UpdateVideo(id string, update func(v *Video)) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	existing, ok := r.seenIDs[id]
+	if !ok {
+		return false
+	}
+	updated := existing.clone()
+	update(updated)
+	r.replace(existing, updated)
+	return true
+}
+
+// replace 格納している動画oldをnewに差し替える。videosは読み出し側と共有しないため、その場で書き換えてよい
+func (r *VideoRepository) replace(old, new *Video) {
+	if i := slices.Index(r.videos, old); i >= 0 {
+		r.videos[i] = new
+	}
+	r.seenIDs[new.ID] = new
+}
+
+// sortedByStartTime 投稿日時の新しい順に並んでいるかを返す
+func sortedByStartTime(videos []*Video) bool {
+	for i := 0; i+1 < len(videos); i++ {
+		if videos[i].StartTime.Before(videos[i+1].StartTime) {
+			return false
+		}
+	}
+	return true
+}
+
 func mergeSortedVideos(existing, newVideos []*Video) []*Video {
 	result := make([]*Video, 0, len(existing)+len(newVideos))
 	i, j := 0, 0
@@ -91,17 +285,134 @@ func mergeSortedVideos(existing, newVideos []*Video) []*Video {
 	return result
 }
 
-// TrimToCapacity 規定数を超えた動画を削除しその数を返す
+// TrimToCapacity 規定数・保持期間・クエリごとの件数の指定を超えた動画を削除しその数を返す
+// 新しい順に規定数まで残すが、Quota.Maxを超えた動画と保持期間を過ぎた動画(新しい順にminItems件を除く)は除き、
+// 残りの中でQuota.Minの件数までは古くても残す
 func (r *VideoRepository) TrimToCapacity() int {
-	if len(r.Videos) <= r.Capacity {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.trim(time.Now())
+}
+
+// trim TrimToCapacityの本体。呼び出し元でロックを取る
+func (r *VideoRepository) trim(now time.Time) int {
+	// クエリごとの上限を超えた動画と、保持期間を過ぎた動画を除く
+	counts := make(map[string]int, len(r.quotas))
+	candidates := make([]*Video, 0, len(r.videos))
+	for _, v := range r.videos {
+		if r.overQuota(v, counts) {
+			continue
+		}
+		// minItemsは期間によらず新しい順に数える
+		if r.maxAge > 0 && now.Sub(v.StartTime) > r.maxAge && len(candidates) >= r.minItems {
+			continue
+		}
+		for _, s := range v.Sources {
+			counts[s]++
+		}
+		candidates = append(candidates, v)
+	}
+
+	// 下限の件数に達するまで、各クエリの新しい動画を残すことを保証する
+	guaranteed := make(map[*Video]struct{})
+	clear(counts)
+	for _, v := range candidates {
+		if !r.underMin(v, counts) {
+			continue
+		}
+		guaranteed[v] = struct{}{}
+		for _, s := range v.Sources {
+			counts[s]++
+		}
+	}
+
+	// 保証した動画以外は、残りの枠に新しい順に入る
+	free := max(r.capacity-len(guaranteed), 0)
+	kept := make([]*Video, 0, min(len(candidates), r.capacity))
+	for _, v := range candidates {
+		if _, ok := guaranteed[v]; ok {
+			kept = append(kept, v)
+		} else if free > 0 {
+			kept = append(kept, v)
+			free--
+		}
+	}
+	return r.keepOnly(kept[:min(len(kept), r.capacity)])
+}
+
+// overQuota 動画を残すとその全ての取得元のクエリが上限を超えるかを返す。countsはクエリごとの残した件数
+func (r *VideoRepository) overQuota(v *Video, counts map[string]int) bool {
+	if len(v.Sources) == 0 {
+		return false
+	}
+	for _, s := range v.Sources {
+		if q := r.quotas[s]; q.Max == 0 || counts[s] < q.Max {
+			return false
+		}
+	}
+	return true
+}
+
+// underMin 動画の取得元のクエリのいずれかが、残すことを保証した件数(counts)が下限に達していないかを返す
+func (r *VideoRepository) underMin(v *Video, counts map[string]int) bool {
+	for _, s := range v.Sources {
+		if counts[s] < r.quotas[s].Min {
+			return true
+		}
+	}
+	return false
+}
+
+// keepOnly videosをkept(videosの部分列)に置き換え、除いた動画の数を返す
+func (r *VideoRepository) keepOnly(kept []*Video) int {
+	removed := len(r.videos) - len(kept)
+	if removed == 0 {
 		return 0
 	}
+	keep := make(map[*Video]struct{}, len(kept))
+	for _, v := range kept {
+		keep[v] = struct{}{}
+	}
+	for _, v := range r.videos {
+		if _, ok := keep[v]; !ok {
+			delete(r.seenIDs, v.ID)
+		}
+	}
+	r.videos = kept
+	return removed
+}
 
-	removed := r.Videos[r.Capacity:]
-	r.Videos = r.Videos[:r.Capacity]
-	for _, v := range removed {
-		delete(r.seenIDs, v.ID)
+// RemoveVideos 条件に一致する動画を削除しその数を返す。matchでは動画を変更してはならない
+func (r *VideoRepository) RemoveVideos(match func(v *Video) bool) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	kept := make([]*Video, 0, len(r.videos))
+	for _, v := range r.videos {
+		if match(v) {
+			delete(r.seenIDs, v.ID)
+			continue
+		}
+		kept = append(kept, v)
 	}
+	removed := len(r.videos) - len(kept)
+	r.videos = kept
+	return removed
+}
+
+// SetQuotas クエリごとの件数の指定を変更し、超過分を削除してその数を返す
+func (r *VideoRepository) SetQuotas(quotas map[string]Quota) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.quotas = quotas
+	return r.trim(time.Now())
+}
 
-	return len(removed)
+// SetRetention 残す動画の指定を変更し、超過分を削除してその数を返す
+func (r *VideoRepository) SetRetention(retention Retention) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.capacity = retention.Capacity
+	r.maxAge = retention.MaxAge
+	r.minItems = retention.MinItems
+	return r.trim(time.Now())
 }
@@ -2,9 +2,13 @@ package repository
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func loadVideosFromFile(t *testing.T, relPath string) []*Video {
@@ -37,8 +41,8 @@ func TestAddSortedVideos_Basic(t *testing.T) {
 	if added != len(v2) {
 		t.Fatalf("expected %d added from res2, got %d", len(v2), added)
 	}
-	if len(repo.Videos) != len(v2) {
-		t.Fatalf("expected repo.Videos length %d after first add, got %d", len(v2), len(repo.Videos))
+	if len(repo.Videos()) != len(v2) {
+		t.Fatalf("expected repo.Videos length %d after first add, got %d", len(v2), len(repo.Videos()))
 	}
 
 	v3 := loadVideosFromFile(t, "res3.json")
@@ -48,21 +52,22 @@ func TestAddSortedVideos_Basic(t *testing.T) {
 	}
 
 	// total should be sum of both files (no duplicates in fixtures)
-	if len(repo.Videos) != len(v2)+len(v3) {
-		t.Fatalf("expected total videos %d, got %d", len(v2)+len(v3), len(repo.Videos))
+	if len(repo.Videos()) != len(v2)+len(v3) {
+		t.Fatalf("expected total videos %d, got %d", len(v2)+len(v3), len(repo.Videos()))
 	}
 
 	// verify videos are ordered newest (latest) first by StartTime
-	for i := 0; i+1 < len(repo.Videos); i++ {
-		if repo.Videos[i].StartTime.Before(repo.Videos[i+1].StartTime) {
-			t.Fatalf("videos not in newest-first order at index %d: %v before %v", i, repo.Videos[i].StartTime, repo.Videos[i+1].StartTime)
+	videos := repo.Videos()
+	for i := 0; i+1 < len(videos); i++ {
+		if videos[i].StartTime.Before(videos[i+1].StartTime) {
+			t.Fatalf("videos not in newest-first order at index %d: %v before %v", i, videos[i].StartTime, videos[i+1].StartTime)
 		}
-		// fmt.Printf("%s: %s\n", repo.Videos[i].StartTime.Format("01-02 15:04:05"), repo.Videos[i].Title[:15])
+		// fmt.Printf("%s: %s\n", videos[i].StartTime.Format("01-02 15:04:05"), videos[i].Title[:15])
 	}
 
 	// seenIDs should contain all IDs
-	if len(repo.seenIDs) != len(repo.Videos) {
-		t.Fatalf("seenIDs size %d does not match videos length %d", len(repo.seenIDs), len(repo.Videos))
+	if len(repo.seenIDs) != len(repo.Videos()) {
+		t.Fatalf("seenIDs size %d does not match videos length %d", len(repo.seenIDs), len(repo.Videos()))
 	}
 }
 
@@ -76,21 +81,329 @@ func TestAddSortedVideos_TrimToCapacity(t *testing.T) {
 	v3 := loadVideosFromFile(t, "res3.json")
 	repo.AddSortedVideos(v3)
 
-	if len(repo.Videos) > repo.Capacity {
-		t.Fatalf("repo.Videos length %d exceeds capacity %d", len(repo.Videos), repo.Capacity)
+	if len(repo.Videos()) > repo.Capacity() {
+		t.Fatalf("repo.Videos length %d exceeds capacity %d", len(repo.Videos()), repo.Capacity())
 	}
 
 	// seenIDs should match the kept videos count
-	if len(repo.seenIDs) != len(repo.Videos) {
-		t.Fatalf("after trim, seenIDs size %d does not match videos length %d", len(repo.seenIDs), len(repo.Videos))
+	if len(repo.seenIDs) != len(repo.Videos()) {
+		t.Fatalf("after trim, seenIDs size %d does not match videos length %d", len(repo.seenIDs), len(repo.Videos()))
 	}
 
 	// ensure no duplicate IDs
 	seen := make(map[string]struct{})
-	for _, v := range repo.Videos {
+	for _, v := range repo.Videos() {
 		if _, ok := seen[v.ID]; ok {
 			t.Fatalf("duplicate id %s in repo.Videos", v.ID)
 		}
 		seen[v.ID] = struct{}{}
 	}
 }
+
+func TestAddSortedVideos_UnsortedInput(t *testing.T) {
+	repo := NewVideoRepository(100)
+
+	// -viewCounterなど投稿日時以外で並んだ結果を想定して逆順にする
+	v2 := loadVideosFromFile(t, "res2.json")
+	reversed := make([]*Video, 0, len(v2))
+	for i := len(v2) - 1; i >= 0; i-- {
+		reversed = append(reversed, v2[i])
+	}
+	firstID := reversed[0].ID
+
+	repo.AddSortedVideos(reversed)
+	repo.AddSortedVideos(loadVideosFromFile(t, "res3.json"))
+
+	videos := repo.Videos()
+	for i := 0; i+1 < len(videos); i++ {
+		if videos[i].StartTime.Before(videos[i+1].StartTime) {
+			t.Fatalf("videos not in newest-first order at index %d: %v before %v", i, videos[i].StartTime, videos[i+1].StartTime)
+		}
+	}
+
+	// 呼び出し元のスライスは並べ替えない
+	if reversed[0].ID != firstID {
+		t.Fatalf("input slice was reordered")
+	}
+}
+
+func TestAddSortedVideos_MergesSources(t *testing.T) {
+	repo := NewVideoRepository(100)
+
+	first := loadVideosFromFile(t, "res2.json")
+	for _, v := range first {
+		v.Sources = []string{"VOCALOID"}
+	}
+	repo.AddSortedVideos(first)
+
+	// 同じ動画が別のクエリからも返ってきた
+	second := loadVideosFromFile(t, "res2.json")[:1]
+	second[0].Sources = []string{"VoiSona"}
+	if added := repo.AddSortedVideos(second); added != 0 {
+		t.Fatalf("expected 0 added for duplicate, got %d", added)
+	}
+
+	got := repo.Videos()[0]
+	if got.ID != second[0].ID {
+		t.Fatalf("unexpected first video %s", got.ID)
+	}
+	if len(got.Sources) != 2 || !got.HasSourceIn(map[string]struct{}{"VoiSona": {}}) {
+		t.Fatalf("expected merged sources, got %v", got.Sources)
+	}
+
+	// VoiSonaだけが残ったとき、VOCALOIDからのみ来た動画が消える
+	removed := repo.RemoveVideos(func(v *Video) bool {
+		return !v.HasSourceIn(map[string]struct{}{"VoiSona": {}})
+	})
+	if removed != len(first)-1 || len(repo.Videos()) != 1 {
+		t.Fatalf("expected %d removed and 1 kept, got %d removed and %d kept", len(first)-1, removed, len(repo.Videos()))
+	}
+	if len(repo.seenIDs) != len(repo.Videos()) {
+		t.Fatalf("seenIDs size %d does not match videos length %d", len(repo.seenIDs), len(repo.Videos()))
+	}
+
+	// 削除した動画は再び追加できる
+	if added := repo.AddSortedVideos(loadVideosFromFile(t, "res2.json")); added != len(first)-1 {
+		t.Fatalf("expected %d re-added, got %d", len(first)-1, added)
+	}
+}
+
+func TestVideo_NeedsThumbnailMeta(t *testing.T) {
+	cases := []struct {
+		name string
+		v    Video
+		want bool
+	}{
+		{name: "not_fetched", v: Video{}, want: true},
+		{name: "fetched", v: Video{ThumbnailType: "image/jpeg", ThumbnailLength: 6337}, want: false},
+		{name: "unknown_length", v: Video{ThumbnailType: "image/jpeg", ThumbnailLength: -1}, want: true},
+		{name: "unavailable", v: Video{ThumbnailUnavailable: true}, want: false},
+	}
+	for _, tc := range cases {
+		if got := tc.v.NeedsThumbnailMeta(); got != tc.want {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestAddSortedVideos_UpdatesStats(t *testing.T) {
+	repo := NewVideoRepository(100)
+	intPtr := func(n int) *int { return &n }
+	commented := time.Date(2025, 11, 10, 7, 0, 0, 0, time.UTC)
+
+	repo.AddSortedVideos([]*Video{{ID: "sm1", ViewCounter: intPtr(10), LikeCounter: intPtr(1), LastCommentTime: commented}})
+
+	// 取得し直した値で置き換える。取得していない項目(nil)は残す
+	repo.AddSortedVideos([]*Video{{ID: "sm1", ViewCounter: intPtr(25), CommentCounter: intPtr(3)}})
+	got := repo.Videos()[0]
+	if *got.ViewCounter != 25 || *got.CommentCounter != 3 || *got.LikeCounter != 1 || got.MylistCounter != nil {
+		t.Fatalf("unexpected counters: view %d, comment %d, like %d, mylist %v", *got.ViewCounter, *got.CommentCounter, *got.LikeCounter, got.MylistCounter)
+	}
+	if !got.LastCommentTime.Equal(commented) {
+		t.Fatalf("expected lastCommentTime %v, got %v", commented, got.LastCommentTime)
+	}
+}
+
+func TestVideo_UploaderURL(t *testing.T) {
+	cases := []struct {
+		name string
+		v    Video
+		want string
+	}{
+		{name: "user", v: Video{UserID: 123456}, want: "https://www.nicovideo.jp/user/123456"},
+		{name: "channel", v: Video{ChannelID: 2600000}, want: "https://ch.nicovideo.jp/channel/ch2600000"},
+		{name: "unknown", v: Video{}, want: ""},
+	}
+	for _, tc := range cases {
+		if got := tc.v.UploaderURL(); got != tc.want {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestTrimToCapacity_Quotas(t *testing.T) {
+	base := time.Date(2025, 11, 10, 0, 0, 0, 0, time.UTC)
+	// 新しい順に、VOCALOIDの動画10件の後にソフトウェアトーク旅行の動画3件
+	newVideos := func() []*Video {
+		videos := make([]*Video, 0, 13)
+		for i := range 10 {
+			videos = append(videos, &Video{ID: fmt.Sprintf("sm%d", 100-i), StartTime: base.Add(-time.Duration(i) * time.Hour), Sources: []string{"VOCALOID"}})
+		}
+		for i := range 3 {
+			videos = append(videos, &Video{ID: fmt.Sprintf("sm%d", 50-i), StartTime: base.Add(-time.Duration(20+i) * time.Hour), Sources: []string{"talk"}})
+		}
+		return videos
+	}
+	ids := func(videos []*Video) string {
+		result := make([]string, 0, len(videos))
+		for _, v := range videos {
+			result = append(result, v.ID)
+		}
+		return strings.Join(result, ",")
+	}
+
+	cases := []struct {
+		name   string
+		quotas map[string]Quota
+		want   string
+	}{
+		{name: "none", quotas: nil, want: "sm100,sm99,sm98,sm97,sm96"},
+		{name: "min", quotas: map[string]Quota{"talk": {Min: 2}}, want: "sm100,sm99,sm98,sm50,sm49"},
+		{name: "max", quotas: map[string]Quota{"VOCALOID": {Max: 2}}, want: "sm100,sm99,sm50,sm49,sm48"},
+		{name: "min_and_max", quotas: map[string]Quota{"VOCALOID": {Min: 1, Max: 3}, "talk": {Min: 1}}, want: "sm100,sm99,sm98,sm50,sm49"},
+	}
+	for _, tc := range cases {
+		repo := NewVideoRepository(5)
+		repo.SetQuotas(tc.quotas)
+		repo.AddSortedVideos(newVideos())
+		if got := ids(repo.Videos()); got != tc.want {
+			t.Errorf("%s: expected %s, got %s", tc.name, tc.want, got)
+		}
+		if len(repo.seenIDs) != len(repo.Videos()) {
+			t.Errorf("%s: seenIDs size %d does not match videos length %d", tc.name, len(repo.seenIDs), len(repo.Videos()))
+		}
+	}
+
+	// 上限のあるクエリの動画でも、上限の無いクエリからも来ていれば残す
+	repo := NewVideoRepository(5)
+	repo.SetQuotas(map[string]Quota{"VOCALOID": {Max: 1}})
+	videos := newVideos()
+	videos[1].Sources = append(videos[1].Sources, "talk")
+	repo.AddSortedVideos(videos)
+	if got := ids(repo.Videos()); got != "sm100,sm99,sm50,sm49,sm48" {
+		t.Fatalf("unexpected videos with shared source: %s", got)
+	}
+
+	// 指定を外すと規定数の範囲で新しい順に戻る。一度削除した動画は戻らない
+	if removed := repo.SetQuotas(nil); removed != 0 || len(repo.Videos()) != 5 {
+		t.Fatalf("unexpected removal after clearing quotas: %d", removed)
+	}
+	if removed := repo.SetQuotas(map[string]Quota{"talk": {Max: 1}}); removed != 3 || ids(repo.Videos()) != "sm100,sm99" {
+		t.Fatalf("unexpected videos after SetQuotas: %d, %s", removed, ids(repo.Videos()))
+	}
+}
+
+func TestTrimToCapacity_Retention(t *testing.T) {
+	now := time.Date(2025, 11, 10, 0, 0, 0, 0, time.UTC)
+	// 1日おきに新しい順で10件
+	newRepo := func(capacity int, maxAge time.Duration, minItems int) *VideoRepository {
+		repo := NewVideoRepository(capacity)
+		repo.maxAge = maxAge
+		repo.minItems = minItems
+		for i := range 10 {
+			v := &Video{ID: fmt.Sprintf("sm%d", 100-i), StartTime: now.Add(-time.Duration(i) * 24 * time.Hour)}
+			repo.videos = append(repo.videos, v)
+			repo.seenIDs[v.ID] = v
+		}
+		return repo
+	}
+
+	cases := []struct {
+		name     string
+		capacity int
+		maxAge   time.Duration
+		minItems int
+		want     int
+	}{
+		{name: "capacity_only", capacity: 5, want: 5},
+		{name: "max_age", capacity: 10, maxAge: 72 * time.Hour, want: 4},
+		{name: "capacity_before_age", capacity: 2, maxAge: 72 * time.Hour, want: 2},
+		{name: "min_items", capacity: 10, maxAge: 24 * time.Hour, minItems: 6, want: 6},
+		{name: "min_items_within_age", capacity: 10, maxAge: 72 * time.Hour, minItems: 3, want: 4},
+		{name: "min_items_capped", capacity: 5, maxAge: 24 * time.Hour, minItems: 8, want: 5},
+	}
+	for _, tc := range cases {
+		repo := newRepo(tc.capacity, tc.maxAge, tc.minItems)
+		removed := repo.trim(now)
+		if len(repo.Videos()) != tc.want || removed != 10-tc.want {
+			t.Errorf("%s: expected %d videos, got %d (removed %d)", tc.name, tc.want, len(repo.Videos()), removed)
+		}
+		if repo.Videos()[0].ID != "sm100" {
+			t.Errorf("%s: expected the newest video to be kept, got %s", tc.name, repo.Videos()[0].ID)
+		}
+		if len(repo.seenIDs) != len(repo.Videos()) {
+			t.Errorf("%s: seenIDs size %d does not match videos length %d", tc.name, len(repo.seenIDs), len(repo.Videos()))
+		}
+	}
+
+	// SetRetentionは現在時刻で判定する
+	repo := NewVideoRepository(10)
+	for i := range 5 {
+		repo.AddSortedVideos([]*Video{{ID: fmt.Sprintf("sm%d", 10-i), StartTime: time.Now().Add(-time.Duration(i) * 24 * time.Hour)}})
+	}
+	if removed := repo.SetRetention(Retention{Capacity: 10, MaxAge: 36 * time.Hour}); removed != 3 || len(repo.Videos()) != 2 {
+		t.Fatalf("unexpected videos after SetRetention: removed %d, kept %d", removed, len(repo.Videos()))
+	}
+	if removed := repo.SetRetention(Retention{Capacity: 1}); removed != 1 || repo.Videos()[0].ID != "sm10" {
+		t.Fatalf("unexpected videos after shrinking capacity: removed %d, kept %d", removed, len(repo.Videos()))
+	}
+}
+
+func TestVideos_Snapshot(t *testing.T) {
+	repo := NewVideoRepository(100)
+	repo.AddSortedVideos([]*Video{{ID: "sm1", Sources: []string{"VOCALOID"}}})
+	before := repo.Videos()
+
+	// 変更は複製に対して行われ、以前に得た動画は変わらない
+	if !repo.UpdateVideo("sm1", func(v *Video) { v.ThumbnailType = "image/jpeg" }) {
+		t.Fatalf("expected sm1 to be updated")
+	}
+	repo.AddSortedVideos([]*Video{{ID: "sm1", Sources: []string{"VoiSona"}}})
+	if before[0].ThumbnailType != "" || len(before[0].Sources) != 1 {
+		t.Fatalf("snapshot was modified: %+v", before[0])
+	}
+	after := repo.Videos()[0]
+	if after.ThumbnailType != "image/jpeg" || len(after.Sources) != 2 {
+		t.Fatalf("unexpected updated video: %+v", after)
+	}
+	if repo.UpdateVideo("sm2", func(v *Video) {}) {
+		t.Fatalf("expected missing video not to be updated")
+	}
+
+	// 読み出しと変更が並行しても競合しない(-raceで確認する)
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		for i := range 100 {
+			repo.AddSortedVideos([]*Video{{ID: fmt.Sprintf("sm%d", i+2), StartTime: time.Unix(int64(i), 0), Sources: []string{"VOCALOID"}}})
+			repo.UpdateVideo("sm1", func(v *Video) { v.ThumbnailLength = int64(i) })
+			repo.TrimToCapacity()
+		}
+	})
+	for range 4 {
+		wg.Go(func() {
+			for range 100 {
+				for _, v := range repo.Videos() {
+					_ = v.ThumbnailLength + int64(len(v.Sources))
+				}
+			}
+		})
+	}
+	wg.Wait()
+}
+
+func TestRetention_Widens(t *testing.T) {
+	day := 24 * time.Hour
+	old := Retention{Capacity: 100, MaxAge: 30 * day, MinItems: 10}
+	cases := []struct {
+		name string
+		r    Retention
+		want bool
+	}{
+		{name: "same", r: old, want: false},
+		{name: "more_items", r: Retention{Capacity: 150, MaxAge: 30 * day, MinItems: 10}, want: true},
+		{name: "fewer_items", r: Retention{Capacity: 50, MaxAge: 30 * day, MinItems: 10}, want: false},
+		{name: "longer", r: Retention{Capacity: 100, MaxAge: 60 * day, MinItems: 10}, want: true},
+		{name: "unlimited", r: Retention{Capacity: 100}, want: true},
+		{name: "shorter", r: Retention{Capacity: 100, MaxAge: 7 * day, MinItems: 10}, want: false},
+		{name: "more_min_items", r: Retention{Capacity: 100, MaxAge: 30 * day, MinItems: 20}, want: true},
+	}
+	for _, tc := range cases {
+		if got := tc.r.Widens(old); got != tc.want {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, got)
+		}
+	}
+	// 無期限からは規定数のみで判定する
+	if (Retention{Capacity: 100, MaxAge: day}).Widens(Retention{Capacity: 100}) {
+		t.Fatalf("limiting the age should not widen")
+	}
+}
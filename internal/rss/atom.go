@@ -0,0 +1,144 @@
+package rss
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"nicovideoRSSDIY/internal/repository"
+	"time"
+)
+
+type AtomFeed struct {
+	XMLName  xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID       string      `xml:"id"`
+	Title    string      `xml:"title"`
+	Subtitle string      `xml:"subtitle,omitempty"`
+	Updated  string      `xml:"updated"`
+	Author   AtomPerson  `xml:"author"`
+	Links    []AtomLink  `xml:"link"`
+	Entries  []AtomEntry `xml:"entry"`
+}
+type AtomEntry struct {
+	ID         string         `xml:"id"`
+	Title      string         `xml:"title"`
+	Updated    string         `xml:"updated"`
+	Published  string         `xml:"published,omitempty"`
+	Author     *AtomPerson    `xml:"author,omitempty"`
+	Summary    *AtomText      `xml:"summary,omitempty"`
+	Links      []AtomLink     `xml:"link,omitempty"`
+	Categories []AtomCategory `xml:"category,omitempty"`
+}
+type AtomPerson struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+type AtomLink struct {
+	Href   string `xml:"href,attr"`
+	Rel    string `xml:"rel,attr,omitempty"`
+	Type   string `xml:"type,attr,omitempty"`
+	Length int64  `xml:"length,attr,omitempty"`
+}
+type AtomText struct {
+	Type  string `xml:"type,attr,omitempty"`
+	Value string `xml:",chardata"`
+}
+type AtomCategory struct {
+	Term   string `xml:"term,attr"`
+	Scheme string `xml:"scheme,attr,omitempty"`
+}
+
+// GenerateAtom GenerateRSSと同じデータからAtom 1.0フィードを生成する
+func GenerateAtom(
+	notifications []repository.Notification,
+	videos []*repository.Video,
+	opts Options,
+) ([]byte, error) {
+	opts = opts.withDefaults()
+
+	// フィードのupdatedは最も新しい項目の日時とする。項目がなければ生成日時
+	var updated time.Time
+	touch := func(t time.Time) {
+		if t.After(updated) {
+			updated = t
+		}
+	}
+
+	entries := make([]AtomEntry, 0, len(notifications)+len(videos))
+	for _, n := range notifications {
+		title, desc := notificationText(n)
+		entries = append(entries, AtomEntry{
+			ID:        "urn:nicovideo-rss-diy:notification:" + url.PathEscape(notificationID(n)),
+			Title:     title,
+			Updated:   n.LastSeen.Format(time.RFC3339),
+			Published: n.FirstSeen.Format(time.RFC3339),
+			Summary:   &AtomText{Type: "text", Value: desc},
+		})
+		touch(n.LastSeen)
+	}
+
+	for _, v := range videos {
+		entry := AtomEntry{
+			ID:        v.URL(),
+			Title:     v.Title,
+			Updated:   v.StartTime.Format(time.RFC3339),
+			Published: v.StartTime.Format(time.RFC3339),
+			Links: []AtomLink{
+				{Href: v.URL(), Rel: "alternate", Type: "text/html"},
+			},
+		}
+		if content := videoContentHTML(v); content != "" {
+			// 動画説明文はHTMLを含む
+			entry.Summary = &AtomText{Type: "html", Value: content}
+		}
+		if name, uri := uploader(v); uri != "" {
+			entry.Author = &AtomPerson{Name: name, URI: uri}
+		}
+
+		// あればサムネイルを付与
+		if v.ThumbnailURL != "" && v.ThumbnailType != "" && v.ThumbnailLength > 0 {
+			entry.Links = append(entry.Links, AtomLink{
+				Href:   opts.thumbnailURL(v),
+				Rel:    "enclosure",
+				Type:   v.ThumbnailType,
+				Length: v.ThumbnailLength,
+			})
+		}
+
+		// あればタグをcategoryとして付与
+		if v.TagsConnectedStr != "" {
+			tags := v.Tags()
+			categories := make([]AtomCategory, 0, len(tags))
+			for _, tag := range tags {
+				categories = append(categories, AtomCategory{
+					Term:   tag,
+					Scheme: repository.TagSearchURL(tag),
+				})
+			}
+			entry.Categories = categories
+		}
+		entries = append(entries, entry)
+		touch(v.StartTime)
+	}
+
+	if updated.IsZero() {
+		updated = time.Now()
+	}
+
+	feed := AtomFeed{
+		ID:       opts.ID,
+		Title:    opts.Title,
+		Subtitle: opts.Description,
+		Updated:  updated.Format(time.RFC3339),
+		Author:   AtomPerson{Name: "Nicovideo RSS DIY"},
+		Links: []AtomLink{
+			{Href: opts.Link, Rel: "alternate", Type: "text/html"},
+		},
+		Entries: entries,
+	}
+
+	result, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("Atomの生成に失敗しました: %w", err)
+	}
+	return append([]byte(xml.Header), result...), nil
+}
@@ -0,0 +1,108 @@
+package rss
+
+import (
+	"encoding/xml"
+	"errors"
+	"nicovideoRSSDIY/internal/repository"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerateAtom_RoundTrip(t *testing.T) {
+	newest := time.Date(2025, 11, 10, 12, 0, 0, 0, time.UTC)
+	notifications := []repository.Notification{{
+		Kind:        repository.NotificationKindSearch,
+		Level:       repository.NotificationError,
+		Title:       "動画検索の際にエラーが発生しました。",
+		Description: errors.New("timeout"),
+		FirstSeen:   newest.Add(-2 * time.Hour),
+		LastSeen:    newest.Add(-time.Hour),
+	}}
+	videos := []*repository.Video{
+		{ID: "sm2", Title: "新しい動画", StartTime: newest},
+		{ID: "sm1", Title: "古い動画", StartTime: newest.Add(-24 * time.Hour)},
+	}
+
+	data, err := GenerateAtom(notifications, videos, Options{
+		ID:    "urn:nicovideo-rss-diy:feed:talk",
+		Title: "talk",
+		Link:  "http://localhost:8080/feeds/talk",
+	})
+	if err != nil {
+		t.Fatalf("GenerateAtom error: %v", err)
+	}
+
+	var feed AtomFeed
+	if err := xml.Unmarshal(data, &feed); err != nil {
+		t.Fatalf("failed to unmarshal generated Atom: %v", err)
+	}
+	if feed.XMLName.Space != "http://www.w3.org/2005/Atom" || feed.XMLName.Local != "feed" {
+		t.Fatalf("unexpected root element: %v", feed.XMLName)
+	}
+	if feed.ID != "urn:nicovideo-rss-diy:feed:talk" {
+		t.Fatalf("unexpected feed id: %q", feed.ID)
+	}
+	// フィードのupdatedは最も新しい項目の日時
+	if updated, err := time.Parse(time.RFC3339, feed.Updated); err != nil || !updated.Equal(newest) {
+		t.Fatalf("expected feed updated %s, got %q (%v)", newest.Format(time.RFC3339), feed.Updated, err)
+	}
+	if !hasAlternate(feed.Links, "http://localhost:8080/feeds/talk") {
+		t.Fatalf("expected alternate link to the feed, got %+v", feed.Links)
+	}
+
+	if len(feed.Entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(feed.Entries))
+	}
+	notice := feed.Entries[0]
+	if !strings.HasPrefix(notice.ID, "urn:nicovideo-rss-diy:notification:") {
+		t.Fatalf("unexpected notification entry id: %q", notice.ID)
+	}
+	if notice.Updated != newest.Add(-time.Hour).Format(time.RFC3339) {
+		t.Fatalf("expected notification updated to be LastSeen, got %q", notice.Updated)
+	}
+	for i, v := range videos {
+		entry := feed.Entries[i+1]
+		if entry.ID != v.URL() {
+			t.Fatalf("expected entry id %q, got %q", v.URL(), entry.ID)
+		}
+		if updated, err := time.Parse(time.RFC3339, entry.Updated); err != nil || !updated.Equal(v.StartTime) {
+			t.Fatalf("expected entry updated %s, got %q (%v)", v.StartTime.Format(time.RFC3339), entry.Updated, err)
+		}
+		if !hasAlternate(entry.Links, v.URL()) {
+			t.Fatalf("expected alternate link to %s, got %+v", v.URL(), entry.Links)
+		}
+	}
+}
+
+func TestGenerateAtom_Defaults(t *testing.T) {
+	before := time.Now().Truncate(time.Second)
+	data, err := GenerateAtom(nil, nil, Options{})
+	if err != nil {
+		t.Fatalf("GenerateAtom error: %v", err)
+	}
+
+	var feed AtomFeed
+	if err := xml.Unmarshal(data, &feed); err != nil {
+		t.Fatalf("failed to unmarshal generated Atom: %v", err)
+	}
+	if feed.ID != "urn:nicovideo-rss-diy:feed" {
+		t.Fatalf("unexpected default feed id: %q", feed.ID)
+	}
+	// 項目がなければ生成日時
+	if updated, err := time.Parse(time.RFC3339, feed.Updated); err != nil || updated.Before(before) {
+		t.Fatalf("expected feed updated to be the generation time, got %q (%v)", feed.Updated, err)
+	}
+	if !hasAlternate(feed.Links, "https://www.nicovideo.jp/") {
+		t.Fatalf("expected default alternate link, got %+v", feed.Links)
+	}
+}
+
+func hasAlternate(links []AtomLink, href string) bool {
+	for _, l := range links {
+		if l.Rel == "alternate" && l.Href == href {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package rss
+
+import (
+	"fmt"
+	"html"
+	"nicovideoRSSDIY/internal/repository"
+	"strconv"
+	"strings"
+)
+
+// formatDuration 再生時間を"h:mm:ss"または"m:ss"の形式にする
+func formatDuration(seconds int) string {
+	h, m, s := seconds/3600, seconds/60%60, seconds%60
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, s)
+	}
+	return fmt.Sprintf("%d:%02d", m, s)
+}
+
+// formatCount 数を3桁ごとにカンマで区切る
+func formatCount(n int) string {
+	if n < 0 {
+		return "-" + formatCount(-n)
+	}
+	s := strconv.Itoa(n)
+	var b strings.Builder
+	for i, c := range s {
+		if i > 0 && (len(s)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// uploader 投稿者の表示名とページのURLを返す。分からない場合は空文字
+func uploader(v *repository.Video) (name string, uri string) {
+	uri = v.UploaderURL()
+	switch {
+	case uri == "":
+		return "", ""
+	case v.ChannelID > 0:
+		return "ch" + strconv.FormatInt(v.ChannelID, 10), uri
+	default:
+		return "ユーザー " + strconv.FormatInt(v.UserID, 10), uri
+	}
+}
+
+// videoDetailsHTML 再生時間・統計・ジャンル・投稿者へのリンクを項目の本文に付け足すHTMLにする。何も分からない場合は空文字
+func videoDetailsHTML(v *repository.Video) string {
+	var stats []string
+	if v.LengthSeconds > 0 {
+		stats = append(stats, "再生時間 "+formatDuration(v.LengthSeconds))
+	}
+	for _, c := range []struct {
+		label string
+		value *int
+	}{
+		{"再生", v.ViewCounter},
+		{"コメント", v.CommentCounter},
+		{"マイリスト", v.MylistCounter},
+		{"いいね", v.LikeCounter},
+	} {
+		if c.value != nil {
+			stats = append(stats, c.label+" "+formatCount(*c.value))
+		}
+	}
+
+	var lines []string
+	if len(stats) > 0 {
+		lines = append(lines, strings.Join(stats, " / "))
+	}
+	if v.Genre != "" {
+		lines = append(lines, "ジャンル: "+html.EscapeString(v.Genre))
+	}
+	if !v.LastCommentTime.IsZero() {
+		lines = append(lines, "最終コメント: "+v.LastCommentTime.Format("2006-01-02 15:04"))
+	}
+	if name, uri := uploader(v); uri != "" {
+		lines = append(lines, fmt.Sprintf(`投稿者: <a href="%s">%s</a>`, html.EscapeString(uri), html.EscapeString(name)))
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return "<p>" + strings.Join(lines, "<br>") + "</p>"
+}
+
+// videoContentHTML 動画説明文に videoDetailsHTML を付け足した、項目の本文を返す
+func videoContentHTML(v *repository.Video) string {
+	details := videoDetailsHTML(v)
+	if details == "" || v.Description == "" {
+		return v.Description + details
+	}
+	return v.Description + "<hr>" + details
+}
@@ -0,0 +1,111 @@
+package rss
+
+import (
+	"encoding/json"
+	"fmt"
+	"nicovideoRSSDIY/internal/repository"
+	"time"
+)
+
+type JSONFeed struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	HomePageURL string         `json:"home_page_url,omitempty"`
+	Description string         `json:"description,omitempty"`
+	Authors     []JSONAuthor   `json:"authors,omitempty"`
+	Language    string         `json:"language,omitempty"`
+	Items       []JSONFeedItem `json:"items"`
+}
+type JSONFeedItem struct {
+	ID            string           `json:"id"`
+	URL           string           `json:"url,omitempty"`
+	Title         string           `json:"title,omitempty"`
+	ContentHTML   string           `json:"content_html,omitempty"`
+	ContentText   string           `json:"content_text,omitempty"`
+	Image         string           `json:"image,omitempty"`
+	DatePublished string           `json:"date_published,omitempty"`
+	DateModified  string           `json:"date_modified,omitempty"`
+	Tags          []string         `json:"tags,omitempty"`
+	Authors       []JSONAuthor     `json:"authors,omitempty"`
+	Attachments   []JSONAttachment `json:"attachments,omitempty"`
+}
+type JSONAuthor struct {
+	Name string `json:"name,omitempty"`
+	URL  string `json:"url,omitempty"`
+}
+type JSONAttachment struct {
+	URL         string `json:"url"`
+	MimeType    string `json:"mime_type"`
+	SizeInBytes int64  `json:"size_in_bytes,omitempty"`
+}
+
+// GenerateJSONFeed GenerateRSSと同じデータからJSON Feed 1.1を生成する
+// 動画項目のidには動画ID(contentId)を用いる
+func GenerateJSONFeed(
+	notifications []repository.Notification,
+	videos []*repository.Video,
+	opts Options,
+) ([]byte, error) {
+	opts = opts.withDefaults()
+
+	items := make([]JSONFeedItem, 0, len(notifications)+len(videos))
+	for _, n := range notifications {
+		title, desc := notificationText(n)
+		items = append(items, JSONFeedItem{
+			ID:            "notification:" + notificationID(n),
+			Title:         title,
+			ContentText:   desc,
+			DatePublished: n.FirstSeen.Format(time.RFC3339),
+			DateModified:  n.LastSeen.Format(time.RFC3339),
+		})
+	}
+
+	for _, v := range videos {
+		item := JSONFeedItem{
+			ID:            v.ID,
+			URL:           v.URL(),
+			Title:         v.Title,
+			ContentHTML:   videoContentHTML(v),
+			DatePublished: v.StartTime.Format(time.RFC3339),
+		}
+		// 取得に恒久的に失敗したサムネイルは載せない。RSSのmedia:thumbnailと同じ条件
+		if thumbnailURL := opts.thumbnailURL(v); thumbnailURL != "" && !v.ThumbnailUnavailable {
+			item.Image = thumbnailURL
+		}
+
+		// あればサムネイルを付与
+		if v.ThumbnailURL != "" && v.ThumbnailType != "" && v.ThumbnailLength > 0 {
+			item.Attachments = []JSONAttachment{
+				{
+					URL:         opts.thumbnailURL(v),
+					MimeType:    v.ThumbnailType,
+					SizeInBytes: v.ThumbnailLength,
+				},
+			}
+		}
+
+		if v.TagsConnectedStr != "" {
+			item.Tags = v.Tags()
+		}
+		if name, uri := uploader(v); uri != "" {
+			item.Authors = []JSONAuthor{{Name: name, URL: uri}}
+		}
+		items = append(items, item)
+	}
+
+	feed := JSONFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       opts.Title,
+		HomePageURL: opts.Link,
+		Description: opts.Description,
+		Authors:     []JSONAuthor{{Name: "Nicovideo RSS DIY"}},
+		Language:    "ja",
+		Items:       items,
+	}
+
+	result, err := json.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("JSON Feedの生成に失敗しました: %w", err)
+	}
+	return result, nil
+}
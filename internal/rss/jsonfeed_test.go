@@ -0,0 +1,40 @@
+package rss
+
+import (
+	"encoding/json"
+	"nicovideoRSSDIY/internal/repository"
+	"testing"
+	"time"
+)
+
+func TestGenerateJSONFeed_Image(t *testing.T) {
+	start := time.Date(2025, 11, 10, 12, 0, 0, 0, time.UTC)
+	videos := []*repository.Video{
+		{ID: "sm1", StartTime: start, ThumbnailURL: "https://example.com/sm1.jpg", ThumbnailType: "image/jpeg", ThumbnailLength: 1000},
+		{ID: "sm2", StartTime: start, ThumbnailURL: "https://example.com/sm2.jpg", ThumbnailUnavailable: true},
+		{ID: "sm3", StartTime: start},
+	}
+	data, err := GenerateJSONFeed(nil, videos, Options{})
+	if err != nil {
+		t.Fatalf("GenerateJSONFeed error: %v", err)
+	}
+
+	var feed struct {
+		Items []map[string]any `json:"items"`
+	}
+	if err := json.Unmarshal(data, &feed); err != nil {
+		t.Fatalf("failed to unmarshal generated JSON Feed: %v", err)
+	}
+	if len(feed.Items) != 3 {
+		t.Fatalf("expected 3 items, got %d", len(feed.Items))
+	}
+	if image := feed.Items[0]["image"]; image != "https://example.com/sm1.jpg" {
+		t.Fatalf("expected image for sm1, got %v", image)
+	}
+	// 取得に恒久的に失敗したサムネイル・URLの無い動画にはimageを付けない
+	for _, item := range feed.Items[1:] {
+		if image, ok := item["image"]; ok {
+			t.Fatalf("expected no image for %v, got %v", item["id"], image)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package rss
+
+import (
+	"nicovideoRSSDIY/internal/repository"
+	"strings"
+)
+
+// MediaNamespace Media RSS(https://www.rssboard.org/media-rss)の名前空間
+const MediaNamespace = "http://search.yahoo.com/mrss/"
+
+// embedPlayerURL 埋め込みプレイヤーのURLの接頭辞
+const embedPlayerURL = "https://embed.nicovideo.jp/watch/"
+
+// Media RSSの要素。encoding/xmlは接頭辞付きの名前をそのまま出力するため、rss要素でxmlns:mediaを宣言して使う
+type MediaThumbnail struct {
+	URL    string `xml:"url,attr"`
+	Width  int    `xml:"width,attr,omitempty"`
+	Height int    `xml:"height,attr,omitempty"`
+}
+type MediaContent struct {
+	URL      string `xml:"url,attr"`
+	Type     string `xml:"type,attr,omitempty"`
+	Medium   string `xml:"medium,attr,omitempty"`
+	FileSize int64  `xml:"fileSize,attr,omitempty"`
+	Width    int    `xml:"width,attr,omitempty"`
+	Height   int    `xml:"height,attr,omitempty"`
+}
+type MediaPlayer struct {
+	URL string `xml:"url,attr"`
+}
+type MediaCommunity struct {
+	Statistics *MediaStatistics `xml:"media:statistics,omitempty"`
+}
+type MediaStatistics struct {
+	Views     *int `xml:"views,attr,omitempty"`
+	Favorites *int `xml:"favorites,attr,omitempty"`
+}
+
+// setMedia 動画のサムネイル(variantsは大きさ違い)・タグ・統計・埋め込みプレイヤーをMedia RSSの要素として付与する
+// サムネイルの取得に恒久的に失敗した動画(ThumbnailUnavailable)には、表示できない画像を載せないようサムネイルを付けない
+func (item *Item) setMedia(v *repository.Video, thumbnailURL string, variants []MediaThumbnail) {
+	if thumbnailURL != "" && !v.ThumbnailUnavailable {
+		item.MediaThumbnails = append([]MediaThumbnail{{
+			URL:    thumbnailURL,
+			Width:  v.ThumbnailWidth,
+			Height: v.ThumbnailHeight,
+		}}, variants...)
+		// 種類と大きさが分かっている場合のみ。enclosureと同じ条件
+		if v.ThumbnailType != "" && v.ThumbnailLength > 0 {
+			item.MediaContent = &MediaContent{
+				URL:      thumbnailURL,
+				Type:     v.ThumbnailType,
+				Medium:   "image",
+				FileSize: v.ThumbnailLength,
+				Width:    v.ThumbnailWidth,
+				Height:   v.ThumbnailHeight,
+			}
+		}
+	}
+
+	if v.TagsConnectedStr != "" {
+		item.MediaKeywords = strings.Join(v.Tags(), ", ")
+	}
+
+	// 統計を取得している場合のみ
+	if v.ViewCounter != nil || v.LikeCounter != nil {
+		item.MediaCommunity = &MediaCommunity{
+			Statistics: &MediaStatistics{Views: v.ViewCounter, Favorites: v.LikeCounter},
+		}
+	}
+
+	item.MediaPlayer = &MediaPlayer{URL: embedPlayerURL + v.ID}
+}
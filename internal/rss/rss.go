@@ -10,9 +10,10 @@ import (
 // todo: interfaceを使えば、videoとnotificationで構造体を分けることも可能かもしれない?
 
 type RSS struct {
-	XMLName xml.Name `xml:"rss"`
-	Version string   `xml:"version,attr"`
-	Channel Channel  `xml:"channel"`
+	XMLName    xml.Name `xml:"rss"`
+	Version    string   `xml:"version,attr"`
+	XMLNSMedia string   `xml:"xmlns:media,attr,omitempty"` // Media RSS(media.go)
+	Channel    Channel  `xml:"channel"`
 }
 type Channel struct {
 	Title       string `xml:"title"`
@@ -28,6 +29,13 @@ type Item struct {
 	GUID        GUID       `xml:"guid"`
 	Enclosure   *Enclosure `xml:"enclosure,omitempty"`
 	Category    []Category `xml:"category,omitempty"`
+
+	// Media RSS(media.go)
+	MediaThumbnails []MediaThumbnail `xml:"media:thumbnail,omitempty"` // 先頭がThumbnailURL、以降は大きさ違い
+	MediaContent    *MediaContent    `xml:"media:content,omitempty"`
+	MediaKeywords   string           `xml:"media:keywords,omitempty"`
+	MediaCommunity  *MediaCommunity  `xml:"media:community,omitempty"`
+	MediaPlayer     *MediaPlayer     `xml:"media:player,omitempty"`
 }
 type GUID struct {
 	Value       string `xml:",chardata"`
@@ -43,31 +51,85 @@ type Category struct {
 	Domain string `xml:"domain,attr,omitempty"`
 }
 
+// Options フィードごとに変わるチャンネル情報。空の項目は既定値が使われる
+type Options struct {
+	ID          string // Atomのfeed idなど、フィードを一意に識別する値
+	Title       string
+	Link        string
+	Description string
+	// ThumbnailURL 動画のサムネイルとして載せるURLを返す。nilの場合はThumbnailURLをそのまま載せる
+	ThumbnailURL func(v *repository.Video) string
+	// ThumbnailVariants 動画の大きさ違いのサムネイルを返す。RSSのmedia:thumbnailとして追加で載せる。nilの場合は載せない
+	ThumbnailVariants func(v *repository.Video) []MediaThumbnail
+}
+
+// thumbnailURL 動画のサムネイルとして載せるURLを返す
+func (o Options) thumbnailURL(v *repository.Video) string {
+	if o.ThumbnailURL == nil {
+		return v.ThumbnailURL
+	}
+	return o.ThumbnailURL(v)
+}
+
+// thumbnailVariants 動画の大きさ違いのサムネイルを返す
+func (o Options) thumbnailVariants(v *repository.Video) []MediaThumbnail {
+	if o.ThumbnailVariants == nil {
+		return nil
+	}
+	return o.ThumbnailVariants(v)
+}
+
+func (o Options) withDefaults() Options {
+	if o.ID == "" {
+		o.ID = "urn:nicovideo-rss-diy:feed"
+	}
+	if o.Title == "" {
+		o.Title = "Nicovideo RSS DIY"
+	}
+	if o.Link == "" {
+		o.Link = "https://www.nicovideo.jp/"
+	}
+	if o.Description == "" {
+		o.Description = "ニコニコ動画新着RSS(自作)"
+	}
+	return o
+}
+
+// notificationText 通知をフィード項目のタイトルと本文にする
+func notificationText(n repository.Notification) (title string, desc string) {
+	desc = n.Description.Error()
+	if n.DuplicateCount > 0 {
+		desc += fmt.Sprintf("(重複: %d件)", n.DuplicateCount+1)
+	}
+	title = fmt.Sprintf("[%s] %s", n.Level.String(), n.Title)
+	return title, desc
+}
+
+// notificationID 通知項目の識別子を返す。同じ通知が繰り返し発生している間は変わらない
+func notificationID(n repository.Notification) string {
+	return n.ID()
+}
+
 func GenerateRSS(
 	notifications []repository.Notification,
 	videos []*repository.Video,
+	opts Options,
 ) ([]byte, error) {
+	opts = opts.withDefaults()
+
 	items := make([]Item, 0, len(notifications)+len(videos))
 	for _, n := range notifications {
-		desc := n.Description.Error()
-		if n.AllowDuplication && n.DuplicateCount > 0 {
-			desc += fmt.Sprintf("(重複: %d件)", n.DuplicateCount+1)
-		}
-
-		title := fmt.Sprintf("[%s] %s", n.Level.String(), n.Title)
-
-		guid := GUID{
-			Value:       fmt.Sprintf("%d-%s", n.Date.Unix(), title),
-			IsPermaLink: false,
-		}
-
+		title, desc := notificationText(n)
 		items = append(items, Item{
 			Title:       title,
 			Description: desc,
-			PubDate:     n.Date.Format(time.RFC822),
-			GUID:        guid,
-			Enclosure:   nil,
-			Category:    nil,
+			PubDate:     n.FirstSeen.Format(time.RFC822),
+			GUID: GUID{
+				Value:       notificationID(n),
+				IsPermaLink: false,
+			},
+			Enclosure: nil,
+			Category:  nil,
 		})
 	}
 
@@ -75,7 +137,7 @@ func GenerateRSS(
 		item := Item{
 			Title:       v.Title,
 			Link:        v.URL(),
-			Description: v.Description,
+			Description: videoContentHTML(v),
 			PubDate:     v.StartTime.Format(time.RFC822),
 			GUID: GUID{
 				Value:       v.URL(),
@@ -87,7 +149,7 @@ func GenerateRSS(
 		// あればサムネイルを付与
 		if v.ThumbnailURL != "" && v.ThumbnailType != "" && v.ThumbnailLength > 0 {
 			item.Enclosure = &Enclosure{
-				URL:    v.ThumbnailURL,
+				URL:    opts.thumbnailURL(v),
 				Type:   v.ThumbnailType,
 				Length: v.ThumbnailLength,
 			}
@@ -105,15 +167,18 @@ func GenerateRSS(
 			}
 			item.Category = categories
 		}
+
+		item.setMedia(v, opts.thumbnailURL(v), opts.thumbnailVariants(v))
 		items = append(items, item)
 	}
 
 	rss := RSS{
-		Version: "2.0",
+		Version:    "2.0",
+		XMLNSMedia: MediaNamespace,
 		Channel: Channel{
-			Title:       "Nicovideo RSS DIY",
-			Link:        "https://www.nicovideo.jp/",
-			Description: "ニコニコ動画新着RSS(自作)",
+			Title:       opts.Title,
+			Link:        opts.Link,
+			Description: opts.Description,
 			Items:       items,
 		},
 	}
@@ -0,0 +1,80 @@
+package rss
+
+import (
+	"encoding/xml"
+	"nicovideoRSSDIY/internal/repository"
+	"testing"
+	"time"
+)
+
+// parsedRSS 生成したRSSを名前空間を解決して読み込む。Media RSSの要素は宣言された名前空間でのみ一致する
+type parsedRSS struct {
+	Attrs []xml.Attr `xml:",any,attr"`
+	Items []struct {
+		GUID      string `xml:"guid"`
+		Thumbnail *struct {
+			URL    string `xml:"url,attr"`
+			Width  string `xml:"width,attr"`
+			Height string `xml:"height,attr"`
+		} `xml:"http://search.yahoo.com/mrss/ thumbnail"`
+		Content *struct {
+			URL    string `xml:"url,attr"`
+			Width  string `xml:"width,attr"`
+			Height string `xml:"height,attr"`
+		} `xml:"http://search.yahoo.com/mrss/ content"`
+	} `xml:"channel>item"`
+}
+
+func TestGenerateRSS_MediaThumbnail(t *testing.T) {
+	start := time.Date(2025, 11, 10, 12, 0, 0, 0, time.UTC)
+	videos := []*repository.Video{
+		{ID: "sm1", StartTime: start, ThumbnailURL: "https://example.com/sm1.jpg", ThumbnailType: "image/jpeg", ThumbnailLength: 1000, ThumbnailWidth: 320, ThumbnailHeight: 180},
+		{ID: "sm2", StartTime: start, ThumbnailURL: "https://example.com/sm2.jpg", ThumbnailType: "image/jpeg", ThumbnailLength: 1000},
+		{ID: "sm3", StartTime: start, ThumbnailURL: "https://example.com/sm3.jpg", ThumbnailWidth: 320, ThumbnailHeight: 180, ThumbnailUnavailable: true},
+	}
+	data, err := GenerateRSS(nil, videos, Options{})
+	if err != nil {
+		t.Fatalf("GenerateRSS error: %v", err)
+	}
+
+	var feed parsedRSS
+	if err := xml.Unmarshal(data, &feed); err != nil {
+		t.Fatalf("failed to unmarshal generated RSS: %v", err)
+	}
+	declared := false
+	for _, a := range feed.Attrs {
+		if a.Name.Space == "xmlns" && a.Name.Local == "media" && a.Value == MediaNamespace {
+			declared = true
+		}
+	}
+	if !declared {
+		t.Fatalf("expected xmlns:media to be declared, got %v", feed.Attrs)
+	}
+	if len(feed.Items) != 3 {
+		t.Fatalf("expected 3 items, got %d", len(feed.Items))
+	}
+
+	// 大きさが分かっている場合はwidth・heightを付ける
+	sm1 := feed.Items[0]
+	if sm1.Thumbnail == nil || sm1.Thumbnail.URL != "https://example.com/sm1.jpg" || sm1.Thumbnail.Width != "320" || sm1.Thumbnail.Height != "180" {
+		t.Fatalf("unexpected media:thumbnail for sm1: %+v", sm1.Thumbnail)
+	}
+	if sm1.Content == nil || sm1.Content.Width != "320" || sm1.Content.Height != "180" {
+		t.Fatalf("unexpected media:content for sm1: %+v", sm1.Content)
+	}
+
+	// 大きさが分からない場合はwidth・heightを付けない
+	sm2 := feed.Items[1]
+	if sm2.Thumbnail == nil || sm2.Thumbnail.Width != "" || sm2.Thumbnail.Height != "" {
+		t.Fatalf("expected media:thumbnail without size for sm2, got %+v", sm2.Thumbnail)
+	}
+	if sm2.Content == nil || sm2.Content.Width != "" || sm2.Content.Height != "" {
+		t.Fatalf("expected media:content without size for sm2, got %+v", sm2.Content)
+	}
+
+	// 取得に恒久的に失敗したサムネイルは載せない
+	sm3 := feed.Items[2]
+	if sm3.Thumbnail != nil || sm3.Content != nil {
+		t.Fatalf("expected no thumbnail for unavailable sm3, got %+v / %+v", sm3.Thumbnail, sm3.Content)
+	}
+}
@@ -0,0 +1,146 @@
+package thumbnail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif" // image.Decodeで読めるよう登録する
+	"image/jpeg"
+	"image/png"
+)
+
+// MaxWidth 縮小・拡大後の幅の上限
+const MaxWidth = 1280
+
+// MinWidth 縮小・拡大後の幅の下限
+const MinWidth = 16
+
+// VariantWidths CDNが提供する大きさ違いのサムネイル("{URL}.M"など)と、その幅
+// CDNに無い場合は元の画像をこの幅に拡大して代わりにする
+var VariantWidths = map[string]int{
+	"M": 320,
+	"L": 640,
+}
+
+// MaxPixels 変換前・変換後の画像の画素数の上限。デコード・変換で大量のメモリを使う画像を弾く
+const MaxPixels = 4096 * 4096
+
+// ErrWidth 指定できない幅
+var ErrWidth = fmt.Errorf("幅は%d～%dである必要があります", MinWidth, MaxWidth)
+
+// ErrTooLarge 画素数がMaxPixelsを超える画像
+var ErrTooLarge = fmt.Errorf("画像が大きすぎます(%d画素まで)", MaxPixels)
+
+// Size 画像の幅と高さ(ピクセル)
+type Size struct {
+	Width  int
+	Height int
+}
+
+// DecodeSize 画像の先頭を読み、幅と高さを返す。JPEG・PNG・GIFに対応する
+func DecodeSize(data []byte) (Size, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return Size{}, fmt.Errorf("画像の大きさを読み取れません: %w", err)
+	}
+	return Size{Width: cfg.Width, Height: cfg.Height}, nil
+}
+
+// FitWidth 縦横比を保ったまま幅をwidthにした大きさを返す
+func (s Size) FitWidth(width int) Size {
+	if s.Width <= 0 {
+		return Size{}
+	}
+	height := max((s.Height*width+s.Width/2)/s.Width, 1)
+	return Size{Width: width, Height: height}
+}
+
+// Resize 画像を縦横比を保ったまま幅widthに変換し、エンコードした内容・MIMEタイプ・大きさを返す
+// JPEGはJPEGのまま、PNG・GIFはPNGにする(GIFのアニメーションは最初のコマのみ)
+// 変換前・変換後の画素数がMaxPixelsを超える場合は、デコードする前にErrTooLargeを返す
+func Resize(data []byte, width int) ([]byte, string, Size, error) {
+	if width < MinWidth || width > MaxWidth {
+		return nil, "", Size{}, ErrWidth
+	}
+	original, err := DecodeSize(data)
+	if err != nil {
+		return nil, "", Size{}, err
+	}
+	if original.Width <= 0 || original.Height <= 0 {
+		return nil, "", Size{}, errors.New("画像が空です")
+	}
+	size := original.FitWidth(width)
+	if tooLarge(original) || tooLarge(size) {
+		return nil, "", Size{}, fmt.Errorf("%dx%dから%dx%dへ変換できません: %w", original.Width, original.Height, size.Width, size.Height, ErrTooLarge)
+	}
+
+	src, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", Size{}, fmt.Errorf("画像をデコードできません: %w", err)
+	}
+	b := src.Bounds()
+	size = Size{Width: b.Dx(), Height: b.Dy()}.FitWidth(width)
+	if size.Width == 0 {
+		return nil, "", Size{}, errors.New("画像が空です")
+	}
+	dst := scale(src, size)
+
+	var buf bytes.Buffer
+	mimeType := "image/png"
+	if format == "jpeg" {
+		mimeType = "image/jpeg"
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buf, dst)
+	}
+	if err != nil {
+		return nil, "", Size{}, fmt.Errorf("画像をエンコードできません: %w", err)
+	}
+	return buf.Bytes(), mimeType, size, nil
+}
+
+// tooLarge 画素数がMaxPixelsを超えるかを返す。掛け算があふれないよう割り算で比べる
+func tooLarge(s Size) bool {
+	return s.Width > 0 && s.Height > MaxPixels/s.Width
+}
+
+// scale 画像をsizeに拡大・縮小する
+// 縮小は変換先の1ピクセルに対応する元の範囲の平均(面積平均)、拡大は最も近いピクセルを使う
+func scale(src image.Image, size Size) *image.RGBA {
+	// 色の形式によらず同じ処理にするためRGBAへ変換しておく
+	b := src.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+
+	sw, sh := b.Dx(), b.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, size.Width, size.Height))
+	for y := range size.Height {
+		y0 := y * sh / size.Height
+		y1 := max((y+1)*sh/size.Height, y0+1)
+		for x := range size.Width {
+			x0 := x * sw / size.Width
+			x1 := max((x+1)*sw/size.Width, x0+1)
+
+			var r, g, bl, a, n int
+			for sy := y0; sy < y1; sy++ {
+				row := rgba.Pix[sy*rgba.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r += int(p[0])
+					g += int(p[1])
+					bl += int(p[2])
+					a += int(p[3])
+					n++
+				}
+			}
+			d := dst.Pix[y*dst.Stride+x*4:]
+			d[0] = uint8(r / n)
+			d[1] = uint8(g / n)
+			d[2] = uint8(bl / n)
+			d[3] = uint8(a / n)
+		}
+	}
+	return dst
+}
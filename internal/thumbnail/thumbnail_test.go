@@ -0,0 +1,124 @@
+package thumbnail
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// testImage 左半分が赤、右半分が青の画像
+func testImage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			c := color.RGBA{R: 255, A: 255}
+			if x >= width/2 {
+				c = color.RGBA{B: 255, A: 255}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestResize(t *testing.T) {
+	var pngData bytes.Buffer
+	if err := png.Encode(&pngData, testImage(130, 100)); err != nil {
+		t.Fatalf("png encode: %v", err)
+	}
+
+	out, mimeType, size, err := Resize(pngData.Bytes(), 65)
+	if err != nil {
+		t.Fatalf("Resize error: %v", err)
+	}
+	if mimeType != "image/png" || size != (Size{Width: 65, Height: 50}) {
+		t.Fatalf("unexpected result: %s %+v", mimeType, size)
+	}
+	img, err := png.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("png decode: %v", err)
+	}
+	if got := img.Bounds().Size(); got != image.Pt(65, 50) {
+		t.Fatalf("unexpected bounds %v", got)
+	}
+	if r, _, b, _ := img.At(10, 10).RGBA(); r>>8 != 255 || b != 0 {
+		t.Fatalf("expected red on the left, got r=%d b=%d", r>>8, b>>8)
+	}
+	if r, _, b, _ := img.At(60, 10).RGBA(); r != 0 || b>>8 != 255 {
+		t.Fatalf("expected blue on the right, got r=%d b=%d", r>>8, b>>8)
+	}
+
+	// JPEGはJPEGのまま。拡大もできる
+	var jpegData bytes.Buffer
+	if err := jpeg.Encode(&jpegData, testImage(130, 100), nil); err != nil {
+		t.Fatalf("jpeg encode: %v", err)
+	}
+	_, mimeType, size, err = Resize(jpegData.Bytes(), VariantWidths["M"])
+	if err != nil {
+		t.Fatalf("Resize error: %v", err)
+	}
+	if mimeType != "image/jpeg" || size != (Size{Width: 320, Height: 246}) {
+		t.Fatalf("unexpected result: %s %+v", mimeType, size)
+	}
+
+	if _, _, _, err := Resize(pngData.Bytes(), 5000); !errors.Is(err, ErrWidth) {
+		t.Fatalf("expected ErrWidth, got %v", err)
+	}
+	if _, _, _, err := Resize([]byte("not an image"), 100); err == nil {
+		t.Fatalf("expected decode error")
+	}
+}
+
+func TestResize_TooLarge(t *testing.T) {
+	// IHDRの幅・高さを書き換え、画素データを読む前に弾かれることを確かめる
+	var data bytes.Buffer
+	if err := png.Encode(&data, testImage(16, 16)); err != nil {
+		t.Fatalf("png encode: %v", err)
+	}
+	huge := bytes.Clone(data.Bytes())
+	binary.BigEndian.PutUint32(huge[16:], 100000)
+	binary.BigEndian.PutUint32(huge[20:], 100000)
+	binary.BigEndian.PutUint32(huge[29:], crc32.ChecksumIEEE(huge[12:29]))
+	if size, err := DecodeSize(huge); err != nil || size != (Size{Width: 100000, Height: 100000}) {
+		t.Fatalf("expected patched size, got %+v (%v)", size, err)
+	}
+	if _, _, _, err := Resize(huge, 320); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("expected ErrTooLarge, got %v", err)
+	}
+
+	// 元の画像は小さくても、縦長で変換後が大きすぎる場合
+	data.Reset()
+	if err := png.Encode(&data, testImage(16, 4000)); err != nil {
+		t.Fatalf("png encode: %v", err)
+	}
+	if _, _, _, err := Resize(data.Bytes(), MaxWidth); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("expected ErrTooLarge, got %v", err)
+	}
+	if _, _, size, err := Resize(data.Bytes(), MinWidth); err != nil || size != (Size{Width: 16, Height: 4000}) {
+		t.Fatalf("expected resize within the limit, got %+v (%v)", size, err)
+	}
+}
+
+func TestDecodeSize(t *testing.T) {
+	var data bytes.Buffer
+	if err := png.Encode(&data, testImage(130, 100)); err != nil {
+		t.Fatalf("png encode: %v", err)
+	}
+	// 先頭だけでも読める
+	size, err := DecodeSize(data.Bytes()[:64])
+	if err != nil {
+		t.Fatalf("DecodeSize error: %v", err)
+	}
+	if size != (Size{Width: 130, Height: 100}) {
+		t.Fatalf("unexpected size %+v", size)
+	}
+	if _, err := DecodeSize([]byte("xxxx")); err == nil {
+		t.Fatalf("expected error")
+	}
+}
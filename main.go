@@ -9,11 +9,12 @@ import (
 	"nicovideoRSSDIY/internal/client"
 	"nicovideoRSSDIY/internal/config"
 	"nicovideoRSSDIY/internal/repository"
-	"nicovideoRSSDIY/internal/rss"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -29,67 +30,85 @@ func main() {
 		configDirPath = os.Args[1]
 	}
 
-	cfg, err := config.LoadConfig(filepath.Join(configDirPath, "config.json"))
+	configPath := filepath.Join(configDirPath, "config.json")
+	cfg, err := config.LoadConfig(configPath)
 	if err != nil {
 		panic(fmt.Sprintf("設定ファイルの読込・解析に失敗しました: %v", err))
 	}
 
-	level := func(levelStr string) slog.Level {
-		switch levelStr {
-		case "debug":
-			return slog.LevelDebug
-		case "error":
-			return slog.LevelError
-		default:
-			return slog.LevelInfo
-		}
-	}(cfg.Log)
+	// 設定ファイルの再読込で変更できるようLevelVarを使う
+	logLevel := new(slog.LevelVar)
+	logLevel.Set(parseLogLevel(cfg.Log))
 
-	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: level}))
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel}))
 	slog.SetDefault(logger)
 	slog.Info(fmt.Sprintf("Nicovideo RSS DIY v%s", cfg.System.Version))
 	slog.Info("ログレベル: " + strings.ToUpper(cfg.Log))
 
-	slog.Info(fmt.Sprintf("検索クエリ: %d件", len(cfg.SearchQueries)))
+	feeds := newFeedSet(cfg)
+	slog.Info(fmt.Sprintf("検索クエリ: %d件", len(feeds.queries)))
+	slog.Info(fmt.Sprintf("名前付きフィード: %d件", len(cfg.Feeds)))
+	if err := feeds.setThumbnailCache(cfg.Thumbnail.Cache); err != nil {
+		slog.Error(fmt.Sprintf("サムネイルのキャッシュを利用できません。キャッシュせずに動作します: %v", err))
+	} else if feeds.thumbs != nil {
+		count, size := feeds.thumbs.Size()
+		slog.Info(fmt.Sprintf("サムネイルのキャッシュ: %s (%d件, %dKB)", feeds.thumbs.Dir(), count, size>>10))
+	}
 
-	vRepo := repository.NewVideoRepository(200)
 	nRepo := repository.NewNotificationRepository()
-	rRepo := repository.NewRSSRepository()
+	nRepo.SetRules(cfg.Notifications.Rules())
 
-	// 起動中表示
-	nRepo.AddNotification(
-		repository.NotificationInfo,
-		"起動中...",
-		errors.New("データを集めています。しばらくお待ちください。(クエリ数 + 3 分程度)"),
-		false,
-	)
-	vRepo.AddSortedVideos([]*repository.Video{
-		{
-			ID:               "sm9",
-			Title:            "新・豪血寺一族 -煩悩解放 - レッツゴー！陰陽師",
-			Description:      "レッツゴー！陰陽師（フルコーラスバージョン）",
-			StartTime:        time.Date(2007, 3, 6, 0, 33, 0, 0, time.FixedZone("JST", 9*60*60)),
-			ThumbnailURL:     "https://nicovideo.cdn.nimg.jp/thumbnails/9/9",
-			ThumbnailType:    "image/jpeg",
-			ThumbnailLength:  6337,
-			TagsConnectedStr: "陰陽師 レッツゴー！陰陽師 公式 音楽 ゲーム 弾幕動画 伝説 最古の動画 3月6日投稿動画 重要ニコニコ文化財 sm9",
-		},
-	})
-
-	rssBytes, err := rss.GenerateRSS(nRepo.Notifications, vRepo.Videos)
+	// 前回終了時の状態を読み込む。読めない場合は最初から集め直す
+	statePath := filepath.Join(configDirPath, "state.json")
+	state, err := repository.LoadState(statePath)
 	if err != nil {
+		slog.Error(fmt.Sprintf("状態ファイルを利用できません。最初からデータを集めます: %v", err))
+		state = nil
+	}
+
+	if state != nil && feeds.restore(state) {
+		slog.Info(fmt.Sprintf("状態ファイルを読み込みました(%s時点, 動画%d件)", state.SavedAt.Format(time.RFC3339), len(state.Videos)))
+		nRepo.RestoreNotifications(state.Notifications)
+	} else {
+		// 起動中表示
+		nRepo.AddNotification(
+			repository.NotificationKindStartup,
+			repository.NotificationInfo,
+			"起動中...",
+			errors.New("データを集めています。しばらくお待ちください。(数分程度)"),
+			false,
+		)
+		for _, f := range feeds.all() {
+			f.vRepo.AddSortedVideos([]*repository.Video{
+				{
+					ID:               "sm9",
+					Title:            "新・豪血寺一族 -煩悩解放 - レッツゴー！陰陽師",
+					Description:      "レッツゴー！陰陽師（フルコーラスバージョン）",
+					StartTime:        time.Date(2007, 3, 6, 0, 33, 0, 0, time.FixedZone("JST", 9*60*60)),
+					ThumbnailURL:     "https://nicovideo.cdn.nimg.jp/thumbnails/9/9",
+					ThumbnailType:    "image/jpeg",
+					ThumbnailLength:  6337,
+					TagsConnectedStr: "陰陽師 レッツゴー！陰陽師 公式 音楽 ゲーム 弾幕動画 伝説 最古の動画 3月6日投稿動画 重要ニコニコ文化財 sm9",
+				},
+			})
+		}
+	}
+
+	if _, err := feeds.syncThumbnailCache(time.Now()); err != nil {
+		slog.Error(err.Error())
+	}
+	if err := feeds.publish(nRepo); err != nil {
 		panic(fmt.Sprintf("RSSの生成に失敗しました: %v", err))
 	}
-	rRepo.SetFeed(rssBytes)
+
+	// HTTPハンドラとワーカーはここから参照する。設定ファイルの再読込時にワーカーが差し替える
+	var currentFeeds atomic.Pointer[feedSet]
+	currentFeeds.Store(feeds)
 
 	// HTTP server
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		// これでいいのか?
-		slog.Info("HTTP_REQUEST", slog.String("method", r.Method), slog.String("path", r.URL.Path), slog.String("user-agent", r.UserAgent()))
-		w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
-		w.Header().Set("ETag", rRepo.Etag)
-		http.ServeContent(w, r, "feed.xml", rRepo.ModifiedAt, rRepo.Feed())
-	})
+	// 大きさ違いのサムネイルをCDNから取得するために使う。RateLimiterはワーカーのクライアントと共有する
+	tClient := client.NewThumbnailClient(fmt.Sprintf("nicovideo-rss-diy/%s service", cfg.System.Version))
+	registerHandlers(http.DefaultServeMux, &currentFeeds, tClient)
 	server := http.Server{
 		Addr:    ":8080",
 		Handler: nil,
@@ -101,7 +120,12 @@ func main() {
 		}
 	}()
 
-	go worker(ctx, vRepo, nRepo, rRepo, cfg.SearchQueries, cfg.System)
+	var lastModified time.Time
+	if state != nil {
+		lastModified = state.LastModified
+	}
+	reloads := watchConfig(ctx, configPath, cfg.WatchedFiles(), 30*time.Second)
+	go worker(ctx, &currentFeeds, nRepo, statePath, lastModified, reloads, logLevel, cfg.Thumbnail, cfg.System)
 
 	// シャットダウン
 	<-ctx.Done()
@@ -115,47 +139,96 @@ func main() {
 	slog.Info("exiting")
 }
 
+// parseLogLevel 設定ファイルのlogの値をslog.Levelにする
+func parseLogLevel(levelStr string) slog.Level {
+	switch levelStr {
+	case "debug":
+		return slog.LevelDebug
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
 // worker 動画・サムネイル情報収集及びRSS生成貯蓄する
+// 設定ファイルの再読込結果はreloadsから受け取り、次の周回の開始時にcurrentFeedsを差し替える
 func worker(
 	ctx context.Context,
-	vRepo *repository.VideoRepository,
+	currentFeeds *atomic.Pointer[feedSet],
 	nRepo *repository.NotificationRepository,
-	rRepo *repository.RSSRepository,
-	queries []config.SearchQuery,
+	statePath string,
+	lastModified time.Time,
+	reloads <-chan reloadResult,
+	logLevel *slog.LevelVar,
+	thumbnail config.Thumbnail,
 	system config.System,
 ) {
 	vClient := client.NewVideoClient("https://snapshot.search.nicovideo.jp/api/v2/snapshot", fmt.Sprintf("nicovideo-rss-diy/%s service", system.Version))
 	tClient := client.NewThumbnailClient(fmt.Sprintf("nicovideo-rss-diy/%s service", system.Version))
+	tClient.SetLimit(thumbnail.Concurrency, thumbnail.MinInterval())
 
-	// queriesに基づき動画検索を行いvRepoに追加する。クエリとクエリの間に1分待機する
+	// queriesに基づき動画検索を行い、そのクエリを含む各フィードに追加する。リクエストの間隔はクライアントのRateLimiterが空ける
+	// 前回までに取り込んだクエリは、取り込み済みの最新の投稿日時以降のみを検索する。初回のみフィードの保持期間(feeds.searchEnd)まで遡る
+	// 全クエリを検索し終えた場合、今回再発しなかった検索の通知は解消したものとして取り除く
+	// 途中で検索を打ち切った場合はその原因のエラーを返す
 	doVideo := func(
 		ctx context.Context,
-		vRepo *repository.VideoRepository,
+		feeds *feedSet,
 		nRepo *repository.NotificationRepository,
 		vClient *client.VideoClient,
 		queries []config.SearchQuery,
 		rangeStart time.Time,
-		rangeEnd time.Time,
-	) {
-		// todo: そもそもクエリごとに知る限りの最新動画を覚えておけばもっと最適なAPIリクエストが可能。ただそれを誰に持たせるのかは考える必要がある
-
+	) error {
+		searchBeginAt := time.Now()
 		slog.Debug(fmt.Sprintf("=== search start (%d queries)", len(queries)))
 		slog.Debug(fmt.Sprintf("search startTime: %s", rangeStart.Format(time.RFC3339)))
-	LOOP:
 		for i, q := range queries {
-			slog.Debug(fmt.Sprintf("  #%d q:%s", i, q.Query))
-			searchCtx, cancel := context.WithTimeout(ctx, 20*time.Second)
-			reqBeginAt := time.Now()
-			resp, err := vClient.SearchVideo(searchCtx, q.Query, []string{
+			if ctx.Err() != nil {
+				slog.Debug("worker(query): context done")
+				return ctx.Err()
+			}
+			slog.Debug(fmt.Sprintf("  #%d q:%s", i, q.Key()))
+			rangeEnd := feeds.searchEnd(q, rangeStart)
+			lower := fmt.Sprintf("[startTime][gt]=%s", rangeEnd.Format(time.RFC3339))
+			if from, ok := feeds.searchFrom(q, rangeEnd); ok {
+				// 取り込み済みの最新と同時刻の動画を取りこぼさないよう、その日時を含める。重複はAddSortedVideosで除かれる
+				lower = fmt.Sprintf("[startTime][gte]=%s", from.Format(time.RFC3339))
+				slog.Debug(fmt.Sprintf("    incremental from %s", from.Format(time.RFC3339)))
+			}
+			filters := append([]string{
 				fmt.Sprintf("[startTime][lte]=%s", rangeStart.Format(time.RFC3339)),
-				fmt.Sprintf("[startTime][gt]=%s", rangeEnd.Format(time.RFC3339))})
-			reqEndAt := time.Now()
-			cancel()
+				lower},
+				q.FilterStrings()...)
+			// 新しい順の検索はフィードに載り得る件数まで、複数回に分けて全て取得する
+			// それ以外の並び順はlimitの件数のみ(人気順の上位など)を取得する
+			maxResults := feeds.capacityFor(q)
+			if !q.NewestFirst() {
+				maxResults = q.Limit
+				if maxResults == 0 {
+					maxResults = client.DefaultSearchLimit
+				}
+			}
+			resp, err := vClient.SearchAllVideos(ctx, q.Query, filters, client.SearchOptions{
+				JSONFilter: q.JSONFilter,
+				Targets:    q.Targets,
+				Sort:       q.Sort,
+				Limit:      q.Limit,
+				Fields:     q.Fields,
+				MaxResults: maxResults,
+			})
 			if err != nil {
 				slog.Error(err.Error())
 
-				if errors.Is(err, client.ErrFiltersFormat) || errors.Is(err, client.ErrRespQueryParse) {
+				apiErr, _ := client.AsAPIError(err)
+				if apiErr != nil && apiErr.Maintenance() {
+					// 呼び出し元で全体を一時停止し通知する
+					slog.Debug("=== search aborted (maintenance)")
+					return err
+				} else if apiErr != nil && apiErr.Permanent() {
+					// このクエリの誤りなので他のクエリは続ける
 					nRepo.AddNotification(
+						repository.NotificationKindSearch,
 						repository.NotificationError,
 						"動画検索の際にエラーが発生しました。",
 						err,
@@ -164,177 +237,391 @@ func worker(
 					continue
 				} else {
 					nRepo.AddNotification(
+						repository.NotificationKindSearch,
 						repository.NotificationError,
 						"動画検索の際にエラーが発生しました。次回検索はクールダウン後になります。",
 						err,
 						true,
 					)
-					break LOOP
+					slog.Debug("=== search aborted")
+					return err
 				}
 
 			}
 
-			vRepo.AddSortedVideos(resp.Videos)
-
-			reqTime := reqEndAt.Sub(reqBeginAt)
-			if i < len(queries)-1 {
-				// API利用制限: 「繰り返しAPIリクエストを行う場合は、前回のAPIレスポンス時間と同じだけ待機時間を設けてご利用ください。」
-				// 基本的に1分待つ。ただし念の為リクエストにそれ以上かかった場合はそれだけ待つ
-				waitTime := 1 * time.Minute
-				if reqTime > waitTime {
-					waitTime = reqTime
-				}
-				slog.Debug(fmt.Sprintf("    req time: %d ms, total videos: %d, continue to next query: %.2f sec", reqTime.Milliseconds(), len(resp.Videos), waitTime.Seconds()))
-
-				select {
-				case <-ctx.Done():
-					slog.Debug("worker(query): context done during wait between queries")
-					return
-				case <-time.After(waitTime):
-					// continue searching
-				}
-			} else {
-				slog.Debug(fmt.Sprintf("    req time: %d ms, total videos: %d", reqTime.Milliseconds(), len(resp.Videos)))
+			if resp.Truncated {
+				notifyTruncated(nRepo, q, resp)
 			}
-		}
-		slog.Debug("=== search end")
 
-	}
-
-	// vRepo内の動画を走査し、サムネイルのType, Lengthが未取得のものについて取得する。1件ごとに1秒待機する
-	doThumbnail := func(
-		ctx context.Context,
-		vRepo *repository.VideoRepository,
-		nRepo *repository.NotificationRepository,
-		tClient *client.ThumbnailClient,
-	) {
-		// セマフォで同時接続上限をかけながら集めてもいいのかもしれないが
-		// 踏ん切りがつかなかったために1秒間隔直列。200秒ならば許容範囲
-		const ERROR_KEEPON_THRESHOLD = 5
-		errorCount := 0
-
-		slog.Debug(fmt.Sprintf("=== thumbnail start (%d videos(include already fetched))", len(vRepo.Videos)))
-		waitMsSumForAvr := int64(0)
-		thumbnailFetchedCountForAvr := int64(0)
-		thumbnailFetchedCountTotal := int64(0)
-	LOOP:
-		for i, v := range vRepo.Videos {
-			if v.ThumbnailType == "" || v.ThumbnailLength == 0 {
-				thumbCtx, cancel := context.WithTimeout(ctx, 20*time.Second)
-
-				reqBeginAt := time.Now()
-				thumbMeta, err := tClient.FetchThumbnailMeta(thumbCtx, v.ThumbnailURL)
-				reqEndAt := time.Now()
-				cancel()
-				if err != nil {
-					slog.Error(err.Error())
-					slog.Debug(fmt.Sprintf("%d", i))
-
-					errorCount++
-					if errorCount >= ERROR_KEEPON_THRESHOLD {
-						nRepo.AddNotification(
-							repository.NotificationError,
-							"サムネイル画像情報取得の際に連続でエラーが発生しました。次回取得はクールダウン後になります。",
-							err,
-							true,
-						)
-						break LOOP
-					}
+			// 除外の条件に当てはまる動画はフィードに追加しない。続きから検索できるよう、取り込み済みの日時には含める
+			videos := make([]*repository.Video, 0, len(resp.Videos))
+			rules := feeds.excludeRulesFor(q)
+			for _, v := range resp.Videos {
+				if reason, excluded := rules.Excludes(v); excluded {
+					slog.Debug(fmt.Sprintf("    excluded %s: %s", v.ID, reason))
 					continue
-
-				}
-
-				errorCount = 0
-
-				v.ThumbnailType = thumbMeta.Type
-				v.ThumbnailLength = thumbMeta.Length
-
-				thumbnailFetchedCountForAvr++
-				thumbnailFetchedCountTotal++
-
-				reqTime := reqEndAt.Sub(reqBeginAt)
-				if i < len(vRepo.Videos)-1 {
-					// API利用制限: 「繰り返しAPIリクエストを行う場合は、前回のAPIレスポンス時間と同じだけ待機時間を設けてご利用ください。」
-					// CDNにも適用されるのか分からないが
-					// 基本的に1秒待つ。ただし念の為リクエストにそれ以上かかった場合はそれだけ待つ
-					waitTime := 1 * time.Second
-					if reqTime > waitTime {
-						waitTime = reqTime
-					}
-					waitMsSumForAvr += waitTime.Milliseconds()
-					select {
-					case <-ctx.Done():
-						slog.Debug("worker(thumbnail): context done during wait between queries")
-						return
-					case <-time.After(waitTime):
-						// continue fetching thumbnails
-					}
 				}
+				v.Sources = []string{q.Key()}
+				videos = append(videos, v)
 			}
-
-			if (i+1)%50 == 0 {
-				avr := float64(waitMsSumForAvr)
-				if thumbnailFetchedCountForAvr > 0 { // thumbnailFetchedCount=0のときゼロ除算する
-					avr = float64(waitMsSumForAvr) / float64(thumbnailFetchedCountForAvr)
+			for _, f := range feeds.all() {
+				if f.includes(q) {
+					f.vRepo.AddSortedVideos(videos)
 				}
-				slog.Debug(fmt.Sprintf("   %d. request cooldown average: %.2f msec.(%d requests)", i+1, avr, thumbnailFetchedCountForAvr))
-				waitMsSumForAvr = 0
-				thumbnailFetchedCountForAvr = 0
 			}
+			feeds.advanceMark(q, resp.Videos)
+
+			slog.Debug(fmt.Sprintf("    req time: %d ms, total videos: %d, excluded: %d", resp.ResponseTime.Milliseconds(), len(resp.Videos), len(resp.Videos)-len(videos)))
 		}
+		slog.Debug("=== search end")
 
-		slog.Debug(fmt.Sprintf("=== thumbnail end (total %d thumbnails metadata fetched)", thumbnailFetchedCountTotal))
+		if resolved := nRepo.ResolveUnseenSince(repository.NotificationKindSearch, searchBeginAt); resolved > 0 {
+			slog.Info(fmt.Sprintf("動画検索の通知%d件を解消済みとしました", resolved))
+		}
+		return nil
 	}
 
 	GetNoNewDataLaterFallbackVal := func() time.Time { return time.Now() }
+	// データ切り替え日時から、APIが提供するデータの最終日時(05:00)を求める
+	GetNoNewDataLater := func(lastModified time.Time) time.Time {
+		return time.Date(lastModified.Year(), lastModified.Month(), lastModified.Day(), 5, 0, 0, 0, lastModified.Location())
+	}
 
 	// 15分毎に動画取得・サムネイル取得・RSS生成・貯蓄を繰り返す
 	const LOOP_INTERVAL = 15 * time.Minute
 	noNewDataLater := GetNoNewDataLaterFallbackVal()
+	if !lastModified.IsZero() {
+		noNewDataLater = GetNoNewDataLater(lastModified)
+	}
+	// 全フィードを生成し直す
+	publishAll := func(feeds *feedSet) {
+		if err := feeds.publish(nRepo); err != nil {
+			panic(fmt.Sprintf("RSSの生成に失敗しました: %v", err))
+		}
+	}
+
+	// 再読込に成功した設定は次の周回の開始時に反映する。失敗した場合は以前の設定のまま動作を続け、直るまで毎周回通知する
+	// 失敗の通知は次に再読込に成功して反映した時点で解消する
+	var pendingCfg *config.Config
+	var reloadErr error
+	receiveReload := func(res reloadResult) {
+		if res.cfg != nil {
+			pendingCfg = res.cfg
+		}
+		reloadErr = res.err
+	}
+	notifyReloadErr := func() {
+		if reloadErr != nil {
+			nRepo.AddNotification(
+				repository.NotificationKindConfig,
+				repository.NotificationError,
+				"設定ファイルの再読込に失敗しました。以前の設定で動作を続けます。",
+				reloadErr,
+				true,
+			)
+		}
+	}
+
+	// 通知は周回ごとに消さず、原因ごとに解消した時点で取り除く
 	for {
-		nRepo.ClearNotifications()
+		// 周回の途中で届いた再読込結果を受け取る
+		select {
+		case res := <-reloads:
+			receiveReload(res)
+		default:
+		}
+		if pendingCfg != nil {
+			next := currentFeeds.Load().reconfigure(pendingCfg)
+			thumbsErr := next.setThumbnailCache(pendingCfg.Thumbnail.Cache)
+			currentFeeds.Store(next)
+			logLevel.Set(parseLogLevel(pendingCfg.Log))
+			nRepo.SetRules(pendingCfg.Notifications.Rules())
+			thumbnail = pendingCfg.Thumbnail
+			tClient.SetLimit(thumbnail.Concurrency, thumbnail.MinInterval())
+			nRepo.ResolveKind(repository.NotificationKindConfig)
+			if thumbsErr != nil {
+				nRepo.AddNotification(
+					repository.NotificationKindConfig,
+					repository.NotificationError,
+					"サムネイルのキャッシュを利用できません。以前のキャッシュの設定で動作を続けます。",
+					thumbsErr,
+					true,
+				)
+			}
+			slog.Info(fmt.Sprintf("設定ファイルを反映しました(検索クエリ: %d件, 名前付きフィード: %d件, ログレベル: %s)", len(next.queries), len(pendingCfg.Feeds), strings.ToUpper(pendingCfg.Log)))
+			pendingCfg = nil
+		}
+		notifyReloadErr()
+		feeds := currentFeeds.Load()
 
 		searchStart := time.Now()
 		searchStart = searchStart.AddDate(0, 0, -1) // APIが提供するデータは05:00時点。24時間ずれなければずっと05:00時点データで固まる
-		searchEnd := searchStart.AddDate(-1, 0, 0)
+
+		// メンテナンス中と分かった時点で以降のリクエストを全て取りやめ、指示された時間(無ければ通常の間隔)だけ待つ
+		var maintenance *client.APIError
+		asMaintenance := func(err error) *client.APIError {
+			if apiErr, ok := client.AsAPIError(err); ok && apiErr.Maintenance() {
+				return apiErr
+			}
+			return nil
+		}
 
 		t := time.Now() // for debug output
 		if searchStart.Before(noNewDataLater.Add(LOOP_INTERVAL)) {
-			doVideo(ctx, vRepo, nRepo, vClient, queries, searchStart, searchEnd)
+			nRepo.ResolveKind(repository.NotificationKindPaused)
+			maintenance = asMaintenance(doVideo(ctx, feeds, nRepo, vClient, feeds.queries, searchStart))
 		} else {
 			slog.Debug("### Update skipped, there are no new data")
 			nRepo.AddNotification(
+				repository.NotificationKindPaused,
 				repository.NotificationInfo,
 				"更新を一時停止中...",
 				errors.New("動画スナップショットAPIのデータ切り替えを待っています"),
 				true,
 			)
 		}
-		doThumbnail(ctx, vRepo, nRepo, tClient) // 別に上のifへ入れてもいいが全部揃っているならリクエストしないしエラーなどで不足あれば取得した方が良いので
+		// 新しい動画が無くても時間の経過で保持期間を過ぎるため、毎周回取り除く
+		feeds.trim()
+		if maintenance == nil {
+			doThumbnail(ctx, feeds, nRepo, tClient, thumbnail.Concurrency, PUBLISH_INTERVAL, func() { publishAll(feeds) }) // 別に上のifへ入れてもいいが全部揃っているならリクエストしないしエラーなどで不足あれば取得した方が良いので
+			if evicted, err := feeds.syncThumbnailCache(time.Now()); err != nil {
+				slog.Error(err.Error())
+			} else if evicted > 0 {
+				slog.Debug(fmt.Sprintf("フィードから外れた動画のサムネイルのキャッシュを%d件削除しました", evicted))
+			}
+
+			fetchedLastModified, err := vClient.FetchLastModified(ctx)
+			if maintenance = asMaintenance(err); maintenance != nil {
+				slog.Error(fmt.Sprintf("データ切り替え日時を取得できません: %v", err))
+			} else if err != nil {
+				slog.Error(fmt.Sprintf("データ切り替え日時を取得できません: %v", err))
+				noNewDataLater = GetNoNewDataLaterFallbackVal()
+				lastModified = time.Time{}
+			} else {
+				lastModified = fetchedLastModified
+				noNewDataLater = GetNoNewDataLater(lastModified)
+			}
+		}
 
-		lastModified, err := vClient.FetchLastModified(ctx)
-		if err != nil {
-			slog.Error(fmt.Sprintf("データ切り替え日時を取得できません: %v", err))
-			noNewDataLater = GetNoNewDataLaterFallbackVal()
+		nextInterval := LOOP_INTERVAL
+		if maintenance != nil {
+			nextInterval = maintenanceInterval(maintenance.RetryAfter, LOOP_INTERVAL)
+			nextAttempt := time.Now().Add(nextInterval)
+			slog.Info(fmt.Sprintf("メンテナンス中のため %s まで更新を一時停止します", nextAttempt.Format(time.RFC3339)))
+			nRepo.AddNotification(
+				repository.NotificationKindMaintenance,
+				repository.NotificationInfo,
+				"メンテナンス中のため更新を一時停止中...",
+				fmt.Errorf("次回の取得は%s頃の予定です: %w", nextAttempt.Format("01/02 15:04"), maintenance),
+				true,
+			)
 		} else {
-			noNewDataLater = time.Date(lastModified.Year(), lastModified.Month(), lastModified.Day(), 5, 0, 0, 0, lastModified.Location())
+			nRepo.ResolveKind(repository.NotificationKindMaintenance)
+			// 1周回終えたので起動中表示は不要
+			nRepo.ResolveKind(repository.NotificationKindStartup)
 		}
 
 		slog.Debug(fmt.Sprintf("動画データは %s 時点まで存在", noNewDataLater.Format(time.RFC3339)))
 		slog.Debug(fmt.Sprintf("### All done! (%s)", time.Since(t)))
+		for _, st := range client.DefaultLimiter.Stats() {
+			slog.Debug(fmt.Sprintf("rate limiter %s: %d requests, waiting %d, in flight %d, wait total %s / max %s, last response %s",
+				st.Host, st.Requests, st.Waiting, st.InFlight, st.TotalWait.Round(time.Millisecond), st.MaxWait.Round(time.Millisecond), st.LastResponseTime.Round(time.Millisecond)))
+		}
 
-		rssBytes, err := rss.GenerateRSS(nRepo.Notifications, vRepo.Videos)
-		if err != nil {
-			panic(fmt.Sprintf("RSSの生成に失敗しました: %v", err))
+		publishAll(feeds)
+
+		state := feeds.state()
+		state.Notifications = nRepo.Notifications()
+		state.LastModified = lastModified
+		if err := repository.SaveState(statePath, state); err != nil {
+			slog.Error(fmt.Sprintf("状態ファイルを保存できません: %v", err))
 		}
-		rRepo.SetFeed(rssBytes)
 
-		select {
-		case <-ctx.Done():
-			slog.Debug("worker(loop): context done, exiting")
-			return
-		case <-time.After(LOOP_INTERVAL):
-			// continue
+		timer := time.NewTimer(nextInterval)
+	WAIT:
+		for {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				slog.Debug("worker(loop): context done, exiting")
+				return
+			case res := <-reloads:
+				receiveReload(res)
+				if reloadErr != nil {
+					// 失敗は次の周回を待たずにフィードへ通知する
+					notifyReloadErr()
+					publishAll(feeds)
+				}
+			case <-timer.C:
+				break WAIT
+			}
+		}
+	}
+}
+
+const (
+	ERROR_KEEPON_THRESHOLD = 5                // サムネイル画像情報の取得に連続でこの回数失敗した場合は残りを取りやめる
+	PUBLISH_INTERVAL       = 10 * time.Second // サムネイル画像情報の取得中にフィードを生成し直す間隔
+)
+
+// doThumbnail 全フィードの動画を走査し、サムネイルのType, Lengthが未取得のものについて取得する
+// キャッシュが有効な場合は、キャッシュに無いものについて画像全体を取得してキャッシュする
+// concurrency個のgoroutineで並行して取得する。同時実行数・間隔の上限はクライアントのRateLimiterが守る
+// 取得結果はこのgoroutineで動画へ反映し、publishIntervalごとにpublishでフィードを生成し直して少しずつ公開する
+// 最後まで走査し終えた場合、今回再発しなかったサムネイルの通知は解消したものとして取り除く
+func doThumbnail(
+	ctx context.Context,
+	feeds *feedSet,
+	nRepo *repository.NotificationRepository,
+	tClient *client.ThumbnailClient,
+	concurrency int,
+	publishInterval time.Duration,
+	publish func(),
+) {
+	thumbnailBeginAt := time.Now()
+	ids, videosByID := feeds.videosByID()
+	pending := make([]string, 0, len(ids))
+	urls := make(map[string]string, len(ids))
+	for _, id := range ids {
+		v := videosByID[id][0]
+		if v.NeedsThumbnailMeta() || (feeds.thumbs != nil && !v.ThumbnailUnavailable && !feeds.thumbs.Has(id)) {
+			pending = append(pending, id)
+			urls[id] = v.ThumbnailURL
+		}
+	}
+	slog.Debug(fmt.Sprintf("=== thumbnail start (%d/%d videos, concurrency %d)", len(pending), len(ids), concurrency))
+
+	type thumbnailResult struct {
+		id   string
+		meta *client.ThumbnailMeta
+		err  error
+	}
+	fetchCtx, abort := context.WithCancel(ctx)
+	defer abort()
+	jobs := make(chan string)
+	results := make(chan thumbnailResult)
+	var wg sync.WaitGroup
+	for range max(min(concurrency, len(pending)), 1) {
+		wg.Go(func() {
+			for id := range jobs {
+				var meta *client.ThumbnailMeta
+				var err error
+				if feeds.thumbs != nil {
+					meta, err = tClient.CacheThumbnail(fetchCtx, feeds.thumbs, id, urls[id])
+				} else {
+					meta, err = tClient.FetchThumbnailMeta(fetchCtx, urls[id])
+				}
+				results <- thumbnailResult{id: id, meta: meta, err: err}
+			}
+		})
+	}
+	go func() {
+		defer close(jobs)
+		for _, id := range pending {
+			select {
+			case jobs <- id:
+			case <-fetchCtx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// 取りやめた後も、実行中のリクエストが終わるまで結果を受け取り続ける
+	errorCount := 0
+	aborted := false
+	thumbnailFetchedCountTotal := 0
+	lastPublishAt := time.Now()
+	for res := range results {
+		if res.err != nil {
+			if fetchCtx.Err() != nil {
+				continue // 取りやめによるキャンセルは数えない
+			}
+			if apiErr, ok := client.AsAPIError(res.err); ok && apiErr.Permanent() {
+				// 削除済みの動画など、その動画だけの問題なので連続エラーには数えず次回以降は取得しない
+				slog.Info(fmt.Sprintf("%sのサムネイル情報を取得できないため、以降は取得しません: %v", res.id, res.err))
+				feeds.updateVideo(res.id, func(v *repository.Video) {
+					v.ThumbnailUnavailable = true
+				})
+				continue
+			}
+			slog.Error(res.err.Error())
+
+			errorCount++
+			if errorCount >= ERROR_KEEPON_THRESHOLD {
+				nRepo.AddNotification(
+					repository.NotificationKindThumbnail,
+					repository.NotificationError,
+					"サムネイル画像情報取得の際に連続でエラーが発生しました。次回取得はクールダウン後になります。",
+					res.err,
+					true,
+				)
+				slog.Debug("=== thumbnail aborted")
+				aborted = true
+				abort()
+			}
+			continue
+		}
+
+		errorCount = 0
+		feeds.updateVideo(res.id, func(v *repository.Video) {
+			v.ThumbnailType = res.meta.Type
+			v.ThumbnailLength = res.meta.Length
+			if res.meta.Width > 0 {
+				v.ThumbnailWidth = res.meta.Width
+				v.ThumbnailHeight = res.meta.Height
+			}
+		})
+		thumbnailFetchedCountTotal++
+
+		if thumbnailFetchedCountTotal%50 == 0 {
+			slog.Debug(fmt.Sprintf("   %d/%d thumbnails metadata fetched", thumbnailFetchedCountTotal, len(pending)))
+		}
+		if time.Since(lastPublishAt) >= publishInterval {
+			publish()
+			lastPublishAt = time.Now()
 		}
 	}
+
+	if ctx.Err() != nil {
+		slog.Debug("worker(thumbnail): context done")
+		return
+	}
+	if aborted {
+		return
+	}
+	slog.Debug(fmt.Sprintf("=== thumbnail end (total %d thumbnails metadata fetched)", thumbnailFetchedCountTotal))
+
+	if resolved := nRepo.ResolveUnseenSince(repository.NotificationKindThumbnail, thumbnailBeginAt); resolved > 0 {
+		slog.Info(fmt.Sprintf("サムネイル画像情報取得の通知%d件を解消済みとしました", resolved))
+	}
+}
+
+// notifyTruncated 検索結果を全て取得できなかったことを通知する。通知はクエリごとに分かれ、次回も取得できなければ同じ通知として扱われる
+func notifyTruncated(nRepo *repository.NotificationRepository, q config.SearchQuery, resp *client.SearchVideoResponse) {
+	nRepo.AddNotification(
+		repository.NotificationKindSearch,
+		repository.NotificationInfo,
+		"検索結果が多すぎるため、一部の動画を取得できませんでした。",
+		fmt.Errorf("全%d件中%d件: %w", resp.Meta.TotalCount, len(resp.Videos), &client.TruncatedError{Query: q.Key()}),
+		true,
+	)
+}
+
+// メンテナンス中に一時停止する時間の範囲。Retry-Afterが極端な値でも更新が止まり続けたり、APIを頻繁に叩いたりしないようにする
+const (
+	minMaintenanceInterval = time.Minute
+	maxMaintenanceInterval = 6 * time.Hour
+)
+
+// maintenanceInterval メンテナンス中に次の取得まで空ける時間を返す
+// Retry-Afterの指示(retryAfter)があればminMaintenanceInterval～maxMaintenanceIntervalに収めて使い、無ければfallbackを返す
+func maintenanceInterval(retryAfter, fallback time.Duration) time.Duration {
+	if retryAfter <= 0 {
+		return fallback
+	}
+	return min(max(retryAfter, minMaintenanceInterval), maxMaintenanceInterval)
 }
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"nicovideoRSSDIY/internal/client"
+	"nicovideoRSSDIY/internal/repository"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNotifyTruncated(t *testing.T) {
+	const totalCount = 200000
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		offset, _ := strconv.Atoi(r.URL.Query().Get("_offset"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("_limit"))
+
+		data := make([]map[string]any, 0, limit)
+		for i := offset; i < offset+limit && i < totalCount; i++ {
+			data = append(data, map[string]any{"contentId": fmt.Sprintf("sm%d", i+1), "startTime": "2025-11-10T00:00:00+09:00"})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"meta": map[string]any{"status": 200, "totalCount": totalCount},
+			"data": data,
+		})
+	}))
+	defer srv.Close()
+
+	cfg := loadTestConfig(t, `{
+	    "retention": {"maxItems": 150000},
+	    "searchQueries": [{"query": "VOCALOID"}, {"query": "UTAU"}]
+	}`)
+	vocaloid, utau := cfg.SearchQueries[0], cfg.SearchQueries[1]
+	feeds := newFeedSet(cfg)
+
+	// フィードに載り得る件数が_offsetの上限を超える新しい順の検索
+	c := client.NewVideoClient(srv.URL, "niconico-rss-diy/0.1 test")
+	resp, err := c.SearchAllVideos(context.Background(), vocaloid.Query, nil, client.SearchOptions{MaxResults: feeds.capacityFor(vocaloid)})
+	if err != nil {
+		t.Fatalf("SearchAllVideos error: %v", err)
+	}
+	if !resp.Truncated {
+		t.Fatalf("expected truncated result, got %d of %d", len(resp.Videos), resp.Meta.TotalCount)
+	}
+
+	nRepo := repository.NewNotificationRepository()
+	notifyTruncated(nRepo, vocaloid, resp)
+	notifyTruncated(nRepo, utau, resp)
+	// 件数が変わっても同じクエリなら同じ通知になる
+	resp.Videos = resp.Videos[:100]
+	notifyTruncated(nRepo, vocaloid, resp)
+
+	notifications := nRepo.Notifications()
+	if len(notifications) != 2 {
+		t.Fatalf("expected one notification per query, got %d", len(notifications))
+	}
+	for i, q := range []string{vocaloid.Key(), utau.Key()} {
+		n := notifications[i]
+		if !strings.Contains(n.Description.Error(), q) {
+			t.Fatalf("expected notification to name the query %s, got %q", q, n.Description.Error())
+		}
+		if !errors.Is(n.Description, client.ErrTruncated) {
+			t.Fatalf("expected ErrTruncated, got %v", n.Description)
+		}
+	}
+	if notifications[0].DuplicateCount != 1 {
+		t.Fatalf("expected duplicate count 1, got %d", notifications[0].DuplicateCount)
+	}
+}
+
+func TestMaintenanceInterval(t *testing.T) {
+	cases := []struct {
+		name       string
+		retryAfter time.Duration
+		want       time.Duration
+	}{
+		{"none", 0, 15 * time.Minute},
+		{"within_range", 30 * time.Minute, 30 * time.Minute},
+		{"too_short", time.Second, minMaintenanceInterval},
+		{"too_long", 30 * 24 * time.Hour, maxMaintenanceInterval},
+		{"min", minMaintenanceInterval, minMaintenanceInterval},
+		{"max", maxMaintenanceInterval, maxMaintenanceInterval},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := maintenanceInterval(c.retryAfter, 15*time.Minute); got != c.want {
+				t.Fatalf("maintenanceInterval(%s) = %s, want %s", c.retryAfter, got, c.want)
+			}
+		})
+	}
+}
+
+// thumbnailCDN サムネイルのCDNの代わり。statusが200以外を返すパスの応答はその値にする
+func thumbnailCDN(t *testing.T, delay time.Duration, status func(path string) int) (srv *httptest.Server, requests, maxInFlight *atomic.Int32) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 3))); err != nil {
+		t.Fatalf("png encode: %v", err)
+	}
+	requests, maxInFlight = new(atomic.Int32), new(atomic.Int32)
+	var inFlight atomic.Int32
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(delay)
+
+		if code := status(r.URL.Path); code != http.StatusOK {
+			w.WriteHeader(code)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+		w.Write(buf.Bytes())
+	}))
+	t.Cleanup(srv.Close)
+	return srv, requests, maxInFlight
+}
+
+// thumbnailTestFeeds サムネイル画像情報が未取得のn件の動画を載せたフィード
+func thumbnailTestFeeds(t *testing.T, cdnURL string, n int) *feedSet {
+	t.Helper()
+	feeds := newFeedSet(loadTestConfig(t, `{"searchQueries": [{"query": "VOCALOID"}]}`))
+	start := time.Date(2025, 11, 10, 0, 0, 0, 0, time.UTC)
+	videos := make([]*repository.Video, 0, n)
+	for i := range n {
+		id := fmt.Sprintf("sm%d", n-i)
+		videos = append(videos, &repository.Video{ID: id, StartTime: start.Add(-time.Duration(i) * time.Minute), ThumbnailURL: cdnURL + "/" + id})
+	}
+	feeds.merged.vRepo.AddSortedVideos(videos)
+	return feeds
+}
+
+func newTestThumbnailClient() *client.ThumbnailClient {
+	tClient := client.NewThumbnailClient("niconico-rss-diy/0.1 test")
+	tClient.Limiter = nil // 同時実行数はdoThumbnailのconcurrencyのみで抑える
+	return tClient
+}
+
+func TestDoThumbnail_Concurrency(t *testing.T) {
+	const concurrency = 3
+	cdn, requests, maxInFlight := thumbnailCDN(t, 20*time.Millisecond, func(string) int { return http.StatusOK })
+	feeds := thumbnailTestFeeds(t, cdn.URL, 12)
+	nRepo := repository.NewNotificationRepository()
+
+	// 取得した分から少しずつ公開する
+	var published []int
+	publish := func() {
+		fetched := 0
+		for _, v := range feeds.merged.vRepo.Videos() {
+			if v.ThumbnailType != "" {
+				fetched++
+			}
+		}
+		published = append(published, fetched)
+	}
+	doThumbnail(context.Background(), feeds, nRepo, newTestThumbnailClient(), concurrency, 0, publish)
+
+	if got := requests.Load(); got != 12 {
+		t.Fatalf("expected 12 requests, got %d", got)
+	}
+	if got := maxInFlight.Load(); got > concurrency || got < 2 {
+		t.Fatalf("expected concurrent requests within %d, got %d", concurrency, got)
+	}
+	for _, v := range feeds.merged.vRepo.Videos() {
+		if v.ThumbnailType != "image/png" || v.ThumbnailLength <= 0 {
+			t.Fatalf("expected thumbnail metadata for %s, got %+v", v.ID, v)
+		}
+	}
+	if len(published) != 12 || !slices.IsSorted(published) || published[0] != 1 {
+		t.Fatalf("expected a publish after each fetched thumbnail, got %v", published)
+	}
+
+	// 間隔が経たなければ途中では公開しない
+	feeds = thumbnailTestFeeds(t, cdn.URL, 5)
+	calls := 0
+	doThumbnail(context.Background(), feeds, nRepo, newTestThumbnailClient(), concurrency, time.Hour, func() { calls++ })
+	if calls != 0 {
+		t.Fatalf("expected no publish within the interval, got %d", calls)
+	}
+}
+
+func TestDoThumbnail_AbortsAfterConsecutiveErrors(t *testing.T) {
+	cdn, requests, _ := thumbnailCDN(t, 0, func(string) int { return http.StatusInternalServerError })
+	feeds := thumbnailTestFeeds(t, cdn.URL, 20)
+	nRepo := repository.NewNotificationRepository()
+
+	doThumbnail(context.Background(), feeds, nRepo, newTestThumbnailClient(), 1, PUBLISH_INTERVAL, func() {})
+
+	if got := requests.Load(); got != ERROR_KEEPON_THRESHOLD {
+		t.Fatalf("expected to stop after %d requests, got %d", ERROR_KEEPON_THRESHOLD, got)
+	}
+	notifications := nRepo.Notifications()
+	if len(notifications) != 1 || notifications[0].Kind != repository.NotificationKindThumbnail {
+		t.Fatalf("expected a thumbnail notification, got %+v", notifications)
+	}
+	for _, v := range feeds.merged.vRepo.Videos() {
+		if v.ThumbnailUnavailable {
+			t.Fatalf("expected retryable errors not to mark %s unavailable", v.ID)
+		}
+	}
+}
+
+func TestDoThumbnail_PermanentFailure(t *testing.T) {
+	// 恒久的な失敗は連続エラーに数えず、その動画を以降取得しないようにする
+	cdn, requests, _ := thumbnailCDN(t, 0, func(path string) int {
+		if path == "/sm10" {
+			return http.StatusOK
+		}
+		return http.StatusNotFound
+	})
+	feeds := thumbnailTestFeeds(t, cdn.URL, 10)
+	nRepo := repository.NewNotificationRepository()
+
+	doThumbnail(context.Background(), feeds, nRepo, newTestThumbnailClient(), 1, PUBLISH_INTERVAL, func() {})
+
+	if got := requests.Load(); got != 10 {
+		t.Fatalf("expected all 10 thumbnails to be requested, got %d", got)
+	}
+	if notifications := nRepo.Notifications(); len(notifications) != 0 {
+		t.Fatalf("expected no notification, got %+v", notifications)
+	}
+	for _, v := range feeds.merged.vRepo.Videos() {
+		if unavailable := v.ID != "sm10"; v.ThumbnailUnavailable != unavailable {
+			t.Fatalf("%s: expected ThumbnailUnavailable %t, got %+v", v.ID, unavailable, v)
+		}
+	}
+
+	// 次回は取得しない
+	requests.Store(0)
+	doThumbnail(context.Background(), feeds, nRepo, newTestThumbnailClient(), 1, PUBLISH_INTERVAL, func() {})
+	if got := requests.Load(); got != 0 {
+		t.Fatalf("expected no requests for unavailable thumbnails, got %d", got)
+	}
+}
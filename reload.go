@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"nicovideoRSSDIY/internal/config"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// reloadResult 設定ファイル再読込の結果
+// cfgはまだ受け取られていない最後に読み込めた設定、errはそれより後の読込の失敗で、少なくとも一方が入る
+type reloadResult struct {
+	cfg *config.Config
+	err error
+}
+
+// merge 受け取られていない結果oldに新しい結果を重ねたものを返す
+// 失敗した場合もoldの読み込めた設定は捨てず、成功した場合はoldの設定・失敗を置き換える
+func (old reloadResult) merge(res reloadResult) reloadResult {
+	if res.cfg == nil {
+		res.cfg = old.cfg
+	}
+	return res
+}
+
+// watchConfig SIGHUPを受け取るか、interval毎の確認で設定ファイルの更新を検知した場合に設定ファイルを読み直して結果を送る
+// 設定ファイルから参照されているファイル(ブロックリスト。最初はwatched、以降は最後に読み込めた設定のもの)の更新も検知する
+// 結果が受け取られないうちに次の読込が起きた場合は新しい方で置き換える。ただし読み込めた設定は後の失敗で捨てず、失敗と合わせて送る
+func watchConfig(ctx context.Context, path string, watched []string, interval time.Duration) <-chan reloadResult {
+	out := make(chan reloadResult, 1)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	// 更新の検知には更新日時とサイズを用いる
+	type fileStamp struct {
+		modTime time.Time
+		size    int64
+	}
+	stamp := func() (map[string]fileStamp, bool) {
+		stamps := make(map[string]fileStamp, len(watched)+1)
+		for _, p := range append([]string{path}, watched...) {
+			info, err := os.Stat(p)
+			if err != nil {
+				// エディタによる保存中などで一時的に存在しないことがある
+				return nil, false
+			}
+			stamps[p] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+		}
+		return stamps, true
+	}
+
+	send := func(res reloadResult) {
+		select {
+		case old := <-out: // 受け取られていない古い結果に重ねる
+			res = old.merge(res)
+		default:
+		}
+		out <- res
+	}
+
+	// 戻った直後の更新も検知できるよう、goroutineを始める前に記録しておく
+	last, _ := stamp()
+	go func() {
+		defer signal.Stop(hup)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				slog.Info("SIGHUPを受け取りました。設定ファイルを再読込します")
+			case <-ticker.C:
+				current, ok := stamp()
+				if !ok || maps.Equal(current, last) {
+					continue
+				}
+				slog.Info("設定ファイルの更新を検知しました。再読込します")
+			}
+
+			last, _ = stamp()
+
+			cfg, err := config.LoadConfig(path)
+			if err != nil {
+				slog.Error(fmt.Sprintf("設定ファイルの再読込に失敗しました: %v", err))
+				send(reloadResult{err: err})
+				continue
+			}
+			if next := cfg.WatchedFiles(); !slices.Equal(next, watched) {
+				watched = next
+				last, _ = stamp()
+			}
+			send(reloadResult{cfg: cfg})
+		}
+	}()
+
+	return out
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"nicovideoRSSDIY/internal/config"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func writeReloadConfig(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+}
+
+func receiveReloadResult(t *testing.T, reloads <-chan reloadResult) reloadResult {
+	t.Helper()
+	select {
+	case res := <-reloads:
+		return res
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for a reload result")
+		return reloadResult{}
+	}
+}
+
+func TestWatchConfig_Poll(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeReloadConfig(t, path, `{"searchQueries": [{"query": "VOCALOID"}]}`)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloads := watchConfig(ctx, path, nil, 10*time.Millisecond)
+
+	writeReloadConfig(t, path, `{"searchQueries": [{"query": "UTAU"}, {"query": "MMD"}]}`)
+	res := receiveReloadResult(t, reloads)
+	if res.err != nil || res.cfg == nil || len(res.cfg.SearchQueries) != 2 || res.cfg.SearchQueries[0].Query != "UTAU" {
+		t.Fatalf("expected the updated config, got %+v", res)
+	}
+
+	writeReloadConfig(t, path, `{"searchQueries": [`)
+	res = receiveReloadResult(t, reloads)
+	if res.err == nil || res.cfg != nil {
+		t.Fatalf("expected only an error for a broken config, got %+v", res)
+	}
+}
+
+func TestWatchConfig_SIGHUP(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeReloadConfig(t, path, `{"searchQueries": [{"query": "VOCALOID"}]}`)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// 確認の間隔を長くし、SIGHUPでのみ読み直すようにする
+	reloads := watchConfig(ctx, path, nil, time.Hour)
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatalf("failed to send SIGHUP: %v", err)
+	}
+	res := receiveReloadResult(t, reloads)
+	if res.err != nil || res.cfg == nil || res.cfg.SearchQueries[0].Query != "VOCALOID" {
+		t.Fatalf("expected the config to be reloaded on SIGHUP, got %+v", res)
+	}
+}
+
+func TestWatchConfig_KeepsConfigAfterLaterError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeReloadConfig(t, path, `{"searchQueries": [{"query": "VOCALOID"}]}`)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloads := watchConfig(ctx, path, nil, 10*time.Millisecond)
+
+	// 受け取らないうちに、読み込める設定の後で壊れた設定を読ませる
+	writeReloadConfig(t, path, `{"searchQueries": [{"query": "UTAU"}]}`)
+	time.Sleep(300 * time.Millisecond)
+	writeReloadConfig(t, path, `{"searchQueries": [`)
+	time.Sleep(300 * time.Millisecond)
+
+	res := receiveReloadResult(t, reloads)
+	if res.cfg == nil || res.cfg.SearchQueries[0].Query != "UTAU" {
+		t.Fatalf("expected the last good config to be kept, got %+v", res)
+	}
+	if res.err == nil {
+		t.Fatalf("expected the later error to be reported")
+	}
+}
+
+func TestReloadResult_Merge(t *testing.T) {
+	good := &config.Config{Log: "info"}
+	newer := &config.Config{Log: "debug"}
+	errBroken := errors.New("broken")
+
+	cases := []struct {
+		name     string
+		old, res reloadResult
+		want     reloadResult
+	}{
+		{"error_after_config", reloadResult{cfg: good}, reloadResult{err: errBroken}, reloadResult{cfg: good, err: errBroken}},
+		{"config_after_error", reloadResult{cfg: good, err: errBroken}, reloadResult{cfg: newer}, reloadResult{cfg: newer}},
+		{"error_after_error", reloadResult{err: errors.New("old")}, reloadResult{err: errBroken}, reloadResult{err: errBroken}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.old.merge(c.res); got != c.want {
+				t.Fatalf("merge = %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
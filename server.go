@@ -0,0 +1,165 @@
+package main
+
+import (
+	"log/slog"
+	"mime"
+	"net/http"
+	"nicovideoRSSDIY/internal/client"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// feedFormat 配信するフィードの形式
+type feedFormat int
+
+const (
+	formatRSS feedFormat = iota
+	formatAtom
+	formatJSON
+)
+
+// contentType 形式に対応するContent-Typeを返す
+func (f feedFormat) contentType() string {
+	switch f {
+	case formatAtom:
+		return "application/atom+xml; charset=utf-8"
+	case formatJSON:
+		return "application/feed+json; charset=utf-8"
+	default:
+		return "application/rss+xml; charset=utf-8"
+	}
+}
+
+// fileName http.ServeContentへ渡すファイル名を返す
+func (f feedFormat) fileName() string {
+	switch f {
+	case formatAtom:
+		return "atom.xml"
+	case formatJSON:
+		return "feed.json"
+	default:
+		return "feed.xml"
+	}
+}
+
+// negotiableFormats Acceptヘッダで選択可能な形式。同じ優先度の場合は先にあるものを選ぶ
+var negotiableFormats = []struct {
+	mediaType string
+	format    feedFormat
+}{
+	{"application/rss+xml", formatRSS},
+	{"application/atom+xml", formatAtom},
+	{"application/feed+json", formatJSON},
+}
+
+// negotiateFormat Acceptヘッダから返すフィード形式を決める。判断できない場合はRSSとする
+// 各形式には最も具体的に一致するメディアレンジ(完全一致 > application/* > */*)のqを使い、qが最も大きい形式を選ぶ
+// 書式の誤ったメディアレンジ・qは無視する
+func negotiateFormat(accept string) feedFormat {
+	type mediaRange struct {
+		mediaType string
+		q         float64
+	}
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if qStr, ok := params["q"]; ok {
+			parsed, err := strconv.ParseFloat(qStr, 64)
+			if err != nil || parsed < 0 || parsed > 1 {
+				continue
+			}
+			q = parsed
+		}
+		ranges = append(ranges, mediaRange{mediaType, q})
+	}
+
+	best := formatRSS
+	bestQ := 0.0
+	for _, nf := range negotiableFormats {
+		mainType, _, _ := strings.Cut(nf.mediaType, "/")
+		q, specificity := 0.0, 0
+		for _, r := range ranges {
+			s := 0
+			switch r.mediaType {
+			case nf.mediaType:
+				s = 3
+			case mainType + "/*":
+				s = 2
+			case "*/*":
+				s = 1
+			}
+			if s > specificity {
+				q, specificity = r.q, s
+			}
+		}
+		if q > bestQ {
+			best = nf.format
+			bestQ = q
+		}
+	}
+	return best
+}
+
+// registerHandlers フィード配信用のハンドラを登録する
+//
+//	/                       統合フィード(Acceptヘッダで形式を選択)
+//	/atom.xml               統合フィード(Atom)
+//	/feed.json              統合フィード(JSON Feed)
+//	/feeds/{name}           名前付きフィード(Acceptヘッダで形式を選択)
+//	/feeds/{name}/atom.xml  名前付きフィード(Atom)
+//	/feeds/{name}/feed.json 名前付きフィード(JSON Feed)
+//	/notifications          通知のみのフィード(atom.xml, feed.json も同様)
+//	/thumb/{contentId}      キャッシュ済みのサムネイル画像(thumb.go)
+func registerHandlers(mux *http.ServeMux, currentFeeds *atomic.Pointer[feedSet], tClient *client.ThumbnailClient) {
+	handleFeed(mux, "/", func(r *http.Request) (*feed, bool) {
+		return currentFeeds.Load().merged, true
+	})
+	handleFeed(mux, "/feeds/{name}", func(r *http.Request) (*feed, bool) {
+		return currentFeeds.Load().get(r.PathValue("name"))
+	})
+	handleFeed(mux, "/notifications", func(r *http.Request) (*feed, bool) {
+		return currentFeeds.Load().notices, true
+	})
+	mux.Handle("/thumb/{contentId}", newThumbnailServer(currentFeeds, tClient))
+}
+
+// handleFeed baseでAcceptヘッダにより形式を選んだフィードを、base/atom.xml・base/feed.jsonで各形式のフィードを返すハンドラを登録する
+func handleFeed(mux *http.ServeMux, base string, lookup func(r *http.Request) (*feed, bool)) {
+	handler := func(format func(r *http.Request) feedFormat) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			f, ok := lookup(r)
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			serveFeed(w, r, f, format(r))
+		}
+	}
+	fixed := func(format feedFormat) func(r *http.Request) feedFormat {
+		return func(r *http.Request) feedFormat { return format }
+	}
+
+	prefix := strings.TrimSuffix(base, "/")
+	mux.HandleFunc(base, handler(func(r *http.Request) feedFormat {
+		return negotiateFormat(r.Header.Get("Accept"))
+	}))
+	mux.HandleFunc(prefix+"/atom.xml", handler(fixed(formatAtom)))
+	mux.HandleFunc(prefix+"/feed.json", handler(fixed(formatJSON)))
+}
+
+// serveFeed フィードを指定形式で返す
+func serveFeed(w http.ResponseWriter, r *http.Request, f *feed, format feedFormat) {
+	// これでいいのか?
+	slog.Info("HTTP_REQUEST", slog.String("method", r.Method), slog.String("path", r.URL.Path), slog.String("user-agent", r.UserAgent()))
+	// 内容とETag・更新日時が食い違わないよう、同じ時点のものを使う
+	snapshot := f.repo(format).Snapshot()
+	w.Header().Add("Vary", "Accept")
+	w.Header().Set("Content-Type", format.contentType())
+	w.Header().Set("ETag", snapshot.Etag)
+	http.ServeContent(w, r, format.fileName(), snapshot.ModifiedAt, snapshot.Reader())
+}
@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestNegotiateFormat(t *testing.T) {
+	cases := []struct {
+		name   string
+		accept string
+		want   feedFormat
+	}{
+		{"empty", "", formatRSS},
+		{"rss", "application/rss+xml", formatRSS},
+		{"atom", "application/atom+xml", formatAtom},
+		{"json", "application/feed+json", formatJSON},
+		{"unknown", "text/html", formatRSS},
+		{"with_charset", "application/atom+xml; charset=utf-8", formatAtom},
+		{"q_order", "application/rss+xml;q=0.5, application/feed+json;q=0.9, application/atom+xml;q=0.7", formatJSON},
+		{"q_zero", "application/rss+xml;q=0, application/atom+xml;q=0.1", formatAtom},
+		{"all_q_zero", "application/atom+xml;q=0", formatRSS},
+		{"any", "*/*", formatRSS},
+		{"any_lower_than_exact", "*/*;q=0.1, application/atom+xml", formatAtom},
+		{"any_higher_than_exact", "*/*, application/atom+xml;q=0.5", formatRSS},
+		{"subtype_wildcard", "application/*;q=0.5, application/feed+json", formatJSON},
+		{"exact_overrides_wildcard", "application/*, application/rss+xml;q=0", formatAtom},
+		{"exact_q_zero_overrides_any", "*/*, application/rss+xml;q=0, application/atom+xml;q=0", formatJSON},
+		{"tie_prefers_rss", "application/atom+xml, application/rss+xml", formatRSS},
+		{"tie_in_server_order", "application/feed+json, application/atom+xml", formatAtom},
+		{"malformed_q", "application/rss+xml;q=0.5, application/atom+xml;q=high", formatRSS},
+		{"q_out_of_range", "application/rss+xml;q=0.5, application/atom+xml;q=2", formatRSS},
+		{"malformed_params", "application/atom+xml;;=, application/feed+json;q=0.1", formatJSON},
+		{"malformed_type", "application/, application/atom+xml;q=0.2", formatAtom},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := negotiateFormat(c.accept); got != c.want {
+				t.Fatalf("negotiateFormat(%q) = %d, want %d", c.accept, got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"nicovideoRSSDIY/internal/client"
+	"nicovideoRSSDIY/internal/repository"
+	"nicovideoRSSDIY/internal/thumbnail"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// resizedCacheSize 縮小・拡大した画像をメモリに残す数。超えた場合は古いものから捨てる
+	resizedCacheSize = 256
+	// variantMissTTL CDNに無かった大きさ違いのサムネイルを再び取得しに行くまでの間隔
+	variantMissTTL = 24 * time.Hour
+)
+
+// thumbnailServer /thumb/{contentId}でキャッシュ済みのサムネイル画像を返す
+//
+//	/thumb/sm9        キャッシュ済みの画像
+//	/thumb/sm9.M      大きさ違いのサムネイル(.M・.L)。CDNから取得してキャッシュし、CDNに無ければ元の画像をその幅に拡大する
+//	/thumb/sm9?w=160  縦横比を保って幅160に縮小する(元より大きくはしない)
+type thumbnailServer struct {
+	currentFeeds *atomic.Pointer[feedSet]
+	client       *client.ThumbnailClient
+
+	mu      sync.Mutex
+	resized map[resizedKey]resizedThumbnail
+	order   []resizedKey         // resizedへ追加した順
+	misses  map[string]time.Time // CDNに無かった大きさ違いのサムネイルのキー -> 確認した日時
+}
+
+// resizedKey 縮小・拡大した画像の元とその幅。元が置き換えられた場合は別のキーになる
+type resizedKey struct {
+	key      string
+	cachedAt time.Time
+	width    int
+}
+
+type resizedThumbnail struct {
+	data     []byte
+	mimeType string
+	size     thumbnail.Size
+}
+
+func newThumbnailServer(currentFeeds *atomic.Pointer[feedSet], tClient *client.ThumbnailClient) *thumbnailServer {
+	return &thumbnailServer{
+		currentFeeds: currentFeeds,
+		client:       tClient,
+		resized:      make(map[resizedKey]resizedThumbnail),
+		misses:       make(map[string]time.Time),
+	}
+}
+
+func (s *thumbnailServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	thumbs := s.currentFeeds.Load().thumbs
+	if thumbs == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	width := 0
+	if widthStr := r.URL.Query().Get("w"); widthStr != "" {
+		var err error
+		width, err = strconv.Atoi(widthStr)
+		if err != nil || width < thumbnail.MinWidth || width > thumbnail.MaxWidth {
+			http.Error(w, thumbnail.ErrWidth.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	key := r.PathValue("contentId")
+	id, variant, isVariant := strings.Cut(key, ".")
+	if !isVariant {
+		entry, ok := thumbs.Get(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		s.serve(w, r, entry, width, false)
+		return
+	}
+
+	variantWidth, ok := thumbnail.VariantWidths[variant]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	// 幅の指定が無ければフィードに載せるURLそのものなので、返した画像の大きさをフィードで使えるよう記録する
+	record := func(size thumbnail.Size) {
+		if width == 0 {
+			thumbs.SetImageSize(key, size.Width, size.Height)
+		}
+	}
+	if entry, ok := s.variant(r.Context(), thumbs, id, variant); ok {
+		record(s.serve(w, r, entry, width, false))
+		return
+	}
+	// CDNに無い場合は元の画像をその幅にする
+	entry, ok := thumbs.Get(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	resizeWidth := width
+	if resizeWidth == 0 || resizeWidth > variantWidth {
+		resizeWidth = variantWidth
+	}
+	record(s.serve(w, r, entry, resizeWidth, true))
+}
+
+// variant 大きさ違いのサムネイルを返す。キャッシュに無ければCDNから取得してキャッシュする
+// CDNに無かったものはvariantMissTTLの間は取得しに行かない
+func (s *thumbnailServer) variant(ctx context.Context, thumbs *repository.ThumbnailCache, id string, variant string) (repository.ThumbnailEntry, bool) {
+	key := id + "." + variant
+	if entry, ok := thumbs.Get(key); ok {
+		return entry, true
+	}
+	source, ok := thumbs.Source(id)
+	if !ok || s.missed(key) {
+		return repository.ThumbnailEntry{}, false
+	}
+	if _, err := s.client.CacheThumbnail(ctx, thumbs, key, source+"."+variant); err != nil {
+		slog.Debug(fmt.Sprintf("大きさ違いのサムネイル%sを取得できないため元の画像から作ります: %v", key, err))
+		if ctx.Err() == nil {
+			s.markMissed(key)
+		}
+		return repository.ThumbnailEntry{}, false
+	}
+	return thumbs.Get(key)
+}
+
+func (s *thumbnailServer) missed(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	at, ok := s.misses[key]
+	return ok && time.Since(at) < variantMissTTL
+}
+
+func (s *thumbnailServer) markMissed(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for k, at := range s.misses {
+		if now.Sub(at) >= variantMissTTL {
+			delete(s.misses, k)
+		}
+	}
+	s.misses[key] = now
+}
+
+// serve キャッシュ済みの画像を返す。widthが0より大きい場合は縦横比を保ってその幅にする
+// upscaleでない場合、元の幅以上を指定されたら元の画像をそのまま返す。デコードできない形式(WebPなど)も元の画像を返す
+// 返した画像の幅と高さを返す。分からない場合は0
+func (s *thumbnailServer) serve(w http.ResponseWriter, r *http.Request, entry repository.ThumbnailEntry, width int, upscale bool) thumbnail.Size {
+	// 取得した後に削除・置き換えられた場合も開けた時点の内容を返す
+	data, err := os.ReadFile(entry.Path)
+	if err != nil {
+		http.NotFound(w, r)
+		return thumbnail.Size{}
+	}
+
+	mimeType := entry.Type
+	var size thumbnail.Size
+	if width > 0 {
+		if resized, ok := s.resize(entry, data, width, upscale); ok {
+			data, mimeType, size = resized.data, resized.mimeType, resized.size
+		}
+	}
+	if size.Width == 0 {
+		size, _ = thumbnail.DecodeSize(data)
+	}
+
+	w.Header().Set("Content-Type", mimeType)
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	http.ServeContent(w, r, "", entry.CachedAt, bytes.NewReader(data))
+	return size
+}
+
+// resize 画像を幅widthにしたものを返す。元のままでよい・変換できない場合はfalse
+func (s *thumbnailServer) resize(entry repository.ThumbnailEntry, data []byte, width int, upscale bool) (resizedThumbnail, bool) {
+	size, err := thumbnail.DecodeSize(data)
+	if err != nil || size.Width == width || (!upscale && size.Width < width) {
+		return resizedThumbnail{}, false
+	}
+
+	key := resizedKey{key: entry.ID, cachedAt: entry.CachedAt, width: width}
+	s.mu.Lock()
+	cached, ok := s.resized[key]
+	s.mu.Unlock()
+	if ok {
+		return cached, true
+	}
+
+	out, mimeType, resizedSize, err := thumbnail.Resize(data, width)
+	if err != nil {
+		slog.Error(fmt.Sprintf("サムネイル%sを変換できません: %v", entry.ID, err))
+		return resizedThumbnail{}, false
+	}
+	resized := resizedThumbnail{data: out, mimeType: mimeType, size: resizedSize}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.resized[key]; !exists {
+		s.resized[key] = resized
+		s.order = append(s.order, key)
+		for len(s.order) > resizedCacheSize {
+			delete(s.resized, s.order[0])
+			s.order = s.order[1:]
+		}
+	}
+	return resized, true
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"nicovideoRSSDIY/internal/client"
+	"nicovideoRSSDIY/internal/config"
+	"nicovideoRSSDIY/internal/repository"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func encodeTestPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatalf("png encode: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestThumbnailServer_FeedAdvertisesVariantSizes(t *testing.T) {
+	// .LのみCDNにあり、.Mは元の画像から作る
+	large := encodeTestPNG(t, 640, 360)
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/sm9.L" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(large)
+	}))
+	defer cdn.Close()
+
+	cfg := loadTestConfig(t, `{"searchQueries": [{"query": "VOCALOID"}]}`)
+	feeds := newFeedSet(cfg)
+	if err := feeds.setThumbnailCache(&config.ThumbnailCache{Dir: t.TempDir(), PublicBaseURL: "http://localhost:2525"}); err != nil {
+		t.Fatalf("setThumbnailCache error: %v", err)
+	}
+	if err := feeds.thumbs.Put("sm9", "image/png", encodeTestPNG(t, 130, 100)); err != nil {
+		t.Fatalf("Put error: %v", err)
+	}
+	feeds.merged.vRepo.AddSortedVideos([]*repository.Video{{
+		ID: "sm9", StartTime: time.Now(), ThumbnailURL: cdn.URL + "/sm9",
+		ThumbnailType: "image/png", ThumbnailLength: 100, ThumbnailWidth: 130, ThumbnailHeight: 100,
+	}})
+	feeds.syncThumbnailCache(time.Now())
+
+	var currentFeeds atomic.Pointer[feedSet]
+	currentFeeds.Store(feeds)
+	tClient := client.NewThumbnailClient("niconico-rss-diy/0.1 test")
+	tClient.Limiter = nil
+	mux := http.NewServeMux()
+	mux.Handle("/thumb/{contentId}", newThumbnailServer(&currentFeeds, tClient))
+
+	for _, path := range []string{"/thumb/sm9.M", "/thumb/sm9.L", "/thumb/sm9.M?w=100"} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: expected 200, got %d", path, rec.Code)
+		}
+	}
+
+	nRepo := repository.NewNotificationRepository()
+	if err := feeds.publish(nRepo); err != nil {
+		t.Fatalf("publish error: %v", err)
+	}
+	var parsed struct {
+		Item struct {
+			Thumbnails []struct {
+				URL    string `xml:"url,attr"`
+				Width  int    `xml:"width,attr"`
+				Height int    `xml:"height,attr"`
+			} `xml:"http://search.yahoo.com/mrss/ thumbnail"`
+		} `xml:"channel>item"`
+	}
+	if err := xml.Unmarshal(feeds.merged.rRepo.Snapshot().Data, &parsed); err != nil {
+		t.Fatalf("failed to unmarshal RSS: %v", err)
+	}
+
+	type advertised struct {
+		url           string
+		width, height int
+	}
+	want := []advertised{
+		{"http://localhost:2525/thumb/sm9", 130, 100},
+		{"http://localhost:2525/thumb/sm9.M", 320, 246}, // 元の画像を拡大した大きさ。?w=100の分では上書きされない
+		{"http://localhost:2525/thumb/sm9.L", 640, 360}, // CDNの画像の大きさ
+	}
+	if len(parsed.Item.Thumbnails) != len(want) {
+		t.Fatalf("expected %d media:thumbnail, got %+v", len(want), parsed.Item.Thumbnails)
+	}
+	for i, w := range want {
+		got := parsed.Item.Thumbnails[i]
+		if (advertised{got.URL, got.Width, got.Height}) != w {
+			t.Fatalf("media:thumbnail[%d]: expected %+v, got %+v", i, w, got)
+		}
+	}
+}